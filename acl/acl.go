@@ -0,0 +1,205 @@
+package acl
+
+import(
+	"errors"
+	"os"
+	"encoding/json"
+	"github.com/sech90/go-message-hub/topic"
+	"github.com/sech90/go-message-hub/metadata"
+)
+
+/* Access policy deciding who can send to whom, loaded from a JSON file like:
+ *
+ *	{
+ *		"default": "deny",
+ *		"rules": [
+ *			{"action": "allow", "from": {"principal": "pricing"}, "to": {"filter": "role=worker"}},
+ *			{"action": "deny", "from": {"principal": "guest"}, "topic": "admin/#"},
+ *			{"action": "allow", "from": {}, "group": "*"}
+ *		]
+ *	}
+ *
+ * A selector matches the clients with the principal, if set, and with tags
+ * matching the filter, if set (see package metadata); an empty selector matches
+ * every client. Each rule has one target: the receiving clients ("to"), a group
+ * name or ANY ("group"), or a topic filter ("topic"). Rules are checked in order
+ * and the first one matching decides, otherwise the default action does.
+ * The default is to deny.
+ *
+ * The tags are registered by the clients themselves, so senders are selected by
+ * their principal only: a sender could drop or claim any tag to escape a rule.
+ * Receivers can be selected by their tags, but a client claiming a tag is reached
+ * by the rules written for it
+ */
+const(
+	ALLOW = "allow"
+	DENY  = "deny"
+
+	//matches every group
+	ANY = "*"
+)
+
+var(
+	ErrAction = errors.New("Action must be allow or deny")
+	ErrTarget = errors.New("Rule must have exactly one of to, group and topic")
+	ErrFromFilter = errors.New("Senders can't be selected by their tags")
+)
+
+/* What the policy knows about a client. Clients not connected have no principal and no tags */
+type Subject struct {
+	Principal 	string
+	Tags 		map[string]string
+}
+
+type selector struct {
+	Principal 	string 	`json:"principal"`
+	Filter 		string 	`json:"filter"`
+
+	filter 		*metadata.Filter
+}
+
+type rule struct {
+	Action 	string 		`json:"action"`
+	From 	selector 	`json:"from"`
+	To 		*selector 	`json:"to"`
+	Group 	string 		`json:"group"`
+	Topic 	string 		`json:"topic"`
+
+	allow 	bool
+}
+
+/* Parsed policy, safe to use from several goroutines */
+type Policy struct {
+	Default string 	`json:"default"`
+	Rules 	[]rule 	`json:"rules"`
+
+	allow 	bool
+}
+
+func Load(path string) (*Policy, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Policy, error) {
+
+	p := new(Policy)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if p.allow, err = parseAction(p.Default, false); err != nil {
+		return nil, err
+	}
+
+	for i := range p.Rules {
+		if err := p.Rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+//an empty action is the default one
+func parseAction(action string, empty bool) (bool, error) {
+
+	switch action {
+	case ALLOW:
+		return true, nil
+	case DENY:
+		return false, nil
+	case "":
+		return empty, nil
+	}
+	return false, ErrAction
+}
+
+func (r *rule) compile() error {
+
+	if r.Action == "" {
+		return ErrAction
+	}
+
+	var err error
+	if r.allow, err = parseAction(r.Action, false); err != nil {
+		return err
+	}
+
+	targets := 0
+	for _, set := range []bool{r.To != nil, r.Group != "", r.Topic != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return ErrTarget
+	}
+
+	if r.Topic != "" {
+		if err := topic.ValidateFilter(r.Topic); err != nil {
+			return err
+		}
+	}
+
+	//the sender chooses its own tags
+	if r.From.Filter != "" {
+		return ErrFromFilter
+	}
+
+	if err := r.From.compile(); err != nil {
+		return err
+	}
+	if r.To != nil {
+		return r.To.compile()
+	}
+	return nil
+}
+
+func (s *selector) compile() error {
+
+	var err error
+	s.filter, err = metadata.ParseFilter(s.Filter)
+	return err
+}
+
+func (s *selector) match(sub Subject) bool {
+	return (s.Principal == "" || s.Principal == sub.Principal) && s.filter.Match(sub.Tags)
+}
+
+//true if the sender can relay, broadcast or stream to the receiver
+func (p *Policy) CanRelay(from, to Subject) bool {
+	return p.decide(from, func(r *rule) bool {
+		return r.To != nil && r.To.match(to)
+	})
+}
+
+//true if the sender can relay to the members of the group
+func (p *Policy) CanSendToGroup(from Subject, group string) bool {
+	return p.decide(from, func(r *rule) bool {
+		return r.Group == ANY || (r.Group != "" && r.Group == group)
+	})
+}
+
+//true if the sender can publish on the topic
+func (p *Policy) CanPublish(from Subject, name string) bool {
+	return p.decide(from, func(r *rule) bool {
+		return r.Topic != "" && topic.Match(r.Topic, name)
+	})
+}
+
+//action of the first rule matching the sender and the target
+func (p *Policy) decide(from Subject, target func(r *rule) bool) bool {
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if target(r) && r.From.match(from) {
+			return r.allow
+		}
+	}
+	return p.allow
+}
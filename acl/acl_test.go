@@ -0,0 +1,119 @@
+package acl_test
+
+import(
+	"os"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/sech90/go-message-hub/acl"
+)
+
+var policy = []byte(`{
+	"default": "deny",
+	"rules": [
+		{"action": "deny",  "from": {"principal": "guest"}, "to": {}},
+		{"action": "allow", "from": {"principal": "pricing"}, "to": {"filter": "role=worker"}},
+		{"action": "allow", "from": {"principal": "w1"}, "to": {"principal": "pricing"}},
+		{"action": "allow", "from": {}, "group": "lobby"},
+		{"action": "allow", "from": {"principal": "admin"}, "group": "*"},
+		{"action": "deny",  "from": {}, "topic": "admin/#"},
+		{"action": "allow", "from": {}, "topic": "#"}
+	]
+}`)
+
+var(
+	pricing = acl.Subject{Principal: "pricing", Tags: map[string]string{"role": "scheduler"}}
+	worker  = acl.Subject{Principal: "w1", Tags: map[string]string{"role": "worker"}}
+	guest   = acl.Subject{Principal: "guest", Tags: map[string]string{"role": "pricing"}}
+	admin   = acl.Subject{Principal: "admin"}
+	nobody  = acl.Subject{}
+)
+
+func TestParse(t *testing.T){
+	assert := assert.New(t)
+
+	p, err := acl.Parse(policy)
+	assert.Nil(err, "Policy should be valid")
+	assert.NotNil(p)
+
+	p, err = acl.Parse([]byte(`{}`))
+	assert.Nil(err, "Empty policy is valid")
+	assert.False(p.CanRelay(nobody, nobody), "The default is to deny")
+
+	p, err = acl.Parse([]byte(`{"default": "allow"}`))
+	assert.Nil(err, "Allow by default")
+	assert.True(p.CanRelay(nobody, nobody), "Everything allowed")
+
+	invalid := []string{
+		`not json`,
+		`{"default": "maybe"}`,
+		`{"rules": [{"from": {}, "to": {}}]}`,
+		`{"rules": [{"action": "drop", "from": {}, "to": {}}]}`,
+		`{"rules": [{"action": "allow", "from": {}}]}`,
+		`{"rules": [{"action": "allow", "from": {}, "to": {}, "group": "lobby"}]}`,
+		`{"rules": [{"action": "allow", "from": {"filter": "role=worker"}, "to": {}}]}`,
+		`{"rules": [{"action": "allow", "from": {}, "to": {"filter": "role=a*b"}}]}`,
+		`{"rules": [{"action": "allow", "from": {}, "to": {"filter": "=x"}}]}`,
+		`{"rules": [{"action": "allow", "from": {}, "topic": "a/#/b"}]}`,
+	}
+	for _, data := range invalid {
+		_, err := acl.Parse([]byte(data))
+		assert.NotNil(err, "Policy should be invalid: "+data)
+	}
+
+	_, err = acl.Parse([]byte(`{"default": "maybe"}`))
+	assert.Equal(acl.ErrAction, err)
+	_, err = acl.Parse([]byte(`{"rules": [{"action": "allow", "from": {}}]}`))
+	assert.Equal(acl.ErrTarget, err)
+	_, err = acl.Parse([]byte(`{"rules": [{"action": "allow", "from": {"filter": "role=worker"}, "to": {}}]}`))
+	assert.Equal(acl.ErrFromFilter, err, "Senders choose their own tags")
+}
+
+func TestRelay(t *testing.T){
+	assert := assert.New(t)
+	p, _ := acl.Parse(policy)
+
+	assert.True(p.CanRelay(pricing, worker), "Pricing can send to workers")
+	assert.True(p.CanRelay(worker, pricing), "Workers can answer to pricing")
+	assert.False(p.CanRelay(worker, worker), "Workers can't talk to each other")
+	assert.False(p.CanRelay(pricing, pricing), "Pricing is not a worker")
+	assert.False(p.CanRelay(guest, worker), "Tags don't change who the sender is")
+	assert.False(p.CanRelay(pricing, nobody), "Offline receivers have no tags")
+}
+
+func TestGroup(t *testing.T){
+	assert := assert.New(t)
+	p, _ := acl.Parse(policy)
+
+	assert.True(p.CanSendToGroup(worker, "lobby"), "Everyone can send to the lobby")
+	assert.False(p.CanSendToGroup(worker, "ops"), "Only the admin can send to other groups")
+	assert.True(p.CanSendToGroup(admin, "ops"), "The admin can send to any group")
+}
+
+func TestTopic(t *testing.T){
+	assert := assert.New(t)
+	p, _ := acl.Parse(policy)
+
+	assert.True(p.CanPublish(worker, "prices/eu"), "Topics are allowed")
+	assert.False(p.CanPublish(worker, "admin/reset"), "Admin topics are denied")
+	assert.False(p.CanPublish(admin, "admin"), "The filter matches its parent level")
+}
+
+func TestLoad(t *testing.T){
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "acl")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.json")
+	assert.Nil(ioutil.WriteFile(path, policy, 0600))
+
+	p, err := acl.Load(path)
+	assert.Nil(err, "Policy should be loaded")
+	assert.True(p.CanRelay(pricing, worker))
+
+	_, err = acl.Load(filepath.Join(dir, "missing.json"))
+	assert.NotNil(err, "Missing file")
+}
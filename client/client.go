@@ -3,17 +3,60 @@ package client
 import( 
 	"log" 
 	"net" 
+	"sync"
+	"time"
 	"errors" 
+	"context"
 	"strconv" 
+	"sync/atomic"
+	"crypto/tls"
 	"github.com/sech90/go-message-hub/message"
 	"github.com/sech90/go-message-hub/mexsocket"
+	"github.com/sech90/go-message-hub/statbucket"
 )
 
+const(
+	//maximum time to wait for the hub to answer a synchronous request
+	RequestTimeout = 5 * time.Second
+
+	//a hub not answering Hello in time is assumed to predate it, see Client.hello
+	HelloTimeout = 2 * time.Second
+
+	//features asked by default, see message.Protocol
+	DEFAULT_FEATURES = message.FeatureCompression | message.FeatureAcks | message.FeatureTopics | message.FeaturePresence | message.FeatureTags | message.FeatureGroups
+)
+
+//the hub didn't agree to the feature needed by the request
+var ErrUnsupported = errors.New("feature not negotiated with the hub")
+
+/* Builds the credential answering the hub challenge. See hub.Authenticator */
+type Credentials func(nonce []byte) []byte
+
 type Client struct {
 	id 			uint64
 
-	//underlying message socket.
+	//session token given by the hub, used to resume the id after a reconnection
+	token 		[]byte
+
+	//sent to the hub during the handshake, if set
+	credentials	Credentials
+
+	//features asked to the hub when saying Hello
+	features 	uint32
+
+	//registered with the hub, nil if never registered
+	tags 		map[string]string
+
+	//underlying message socket. Replaced on reconnection
 	socket 		*mexsocket.MexSocket
+	lock 		sync.RWMutex
+
+	//opens a new connection to the hub
+	dial 		func() (net.Conn, error)
+
+	//nil if reconnection is disabled
+	reconnect 	*ReconnectOptions
+	states 		chan State
 
 	//channels for controlling goroutine execution
 	quitting		chan bool
@@ -23,7 +66,37 @@ type Client struct {
 	incomingId 		chan *message.Answer
 	incomingList 	chan *message.Answer
 	incomingRelay 	chan *message.Answer
-	lastClientList	[]uint64
+	incomingStat 	chan *message.Answer
+	incomingReport 	chan *message.Answer
+	incomingPresence chan *message.Answer
+	incomingGroup 	chan *message.Answer
+
+	//other clients, from the last list and the presence events since
+	peers 			[]uint64
+	watching 		bool
+	peersLock 		sync.RWMutex
+
+	//channels of the subscribed topics
+	subs 			map[string]chan *message.Answer
+	subsLock 		sync.RWMutex
+
+	//groups joined, to join again after a reconnection
+	groups 			map[string]bool
+	groupsLock 		sync.Mutex
+
+	//answers awaited by synchronous requests, by correlation id
+	pending 		map[uint32]chan *message.Answer
+	pendingLock 	sync.Mutex
+	nextCorr 		uint32
+
+	//ordered hand-off to each channel
+	lanes 			map[chan *message.Answer]*lane
+	lanesLock 		sync.Mutex
+
+	//streams being received, used only by the connection loop
+	streams 		map[streamKey]*Stream
+	incomingStream 	chan *Stream
+	nextStream 		uint32
 }
 
 func NewClient() *Client {
@@ -33,6 +106,18 @@ func NewClient() *Client {
     	incomingId: 	make(chan *message.Answer),
     	incomingList: 	make(chan *message.Answer),
     	incomingRelay: 	make(chan *message.Answer),
+    	incomingStat: 	make(chan *message.Answer),
+    	incomingReport: make(chan *message.Answer),
+    	incomingPresence: make(chan *message.Answer, PRESENCE_BUFFER),
+    	incomingGroup: 	make(chan *message.Answer),
+    	groups: 		make(map[string]bool),
+    	states: 		make(chan State, STATES_BUFFER),
+    	subs: 			make(map[string]chan *message.Answer),
+    	pending: 		make(map[uint32]chan *message.Answer),
+    	features: 		DEFAULT_FEATURES,
+    	streams: 		make(map[streamKey]*Stream),
+    	lanes: 			make(map[chan *message.Answer]*lane),
+    	incomingStream: make(chan *Stream, INCOMING_STREAMS),
 	}
 }
 
@@ -48,102 +133,478 @@ func (c *Client) IncomingRelay() <-chan *message.Answer {
 	return c.incomingRelay
 }
 
+func (c *Client) IncomingStat() <-chan *message.Answer {
+	return c.incomingStat
+}
+
+//delivery reports of relays sent with Ack, outside SendRelayAndWait
+func (c *Client) IncomingReport() <-chan *message.Answer {
+	return c.incomingReport
+}
+
 func (c *Client) QuitChan() <-chan bool {
 	return c.quitting
 }
 
 func (c *Client) Id() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	return c.id
 }
 
-func (c *Client) List() []uint64 {
-	return c.lastClientList
+//session token of the client, nil if the hub doesn't resume sessions
+func (c *Client) Token() []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.token
+}
+
+func (c *Client) setIdentity(ans *message.Answer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.id = ans.Id()
+	if token := ans.Token(); token != nil {
+		c.token = token
+	}
+}
+
+func (c *Client) getSocket() *mexsocket.MexSocket {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.socket
+}
+
+func (c *Client) setSocket(s *mexsocket.MexSocket) {
+	c.lock.Lock()
+	c.socket = s
+	c.lock.Unlock()
+}
+
+//static token, checked by hub.TokenAuthenticator
+func TokenCredentials(token string) Credentials {
+	return func(nonce []byte) []byte {
+		return []byte(token)
+	}
+}
+
+//shared secret, checked by hub.SecretAuthenticator
+func SecretCredentials(secret []byte) Credentials {
+	return func(nonce []byte) []byte {
+		return secret
+	}
+}
+
+//challenge signed with the principal's key, checked by hub.HMACAuthenticator
+func HMACCredentials(principal string, key []byte) Credentials {
+	return func(nonce []byte) []byte {
+		return message.NewHMACCredential(principal, key, nonce)
+	}
+}
+
+/* Features asked to the hub on connection, DEFAULT_FEATURES if not called.
+ * The hub may agree to only some of them, see Protocol(). Must be called before connecting
+ */
+func (c *Client) SetFeatures(features uint32) {
+	c.features = features
+}
+
+//protocol agreed with the hub on the current connection
+func (c *Client) Protocol() message.Protocol {
+	if s := c.getSocket(); s != nil {
+		return s.Protocol()
+	}
+	return message.Protocol{}
+}
+
+//set the credentials used on the next connection
+func (c *Client) SetCredentials(cred Credentials) {
+	c.credentials = cred
 }
 
 func (c *Client) Connect(address string, port int) error {
 
 	//already connected or pending connection
-	if c.socket != nil {
+	if c.getSocket() != nil {
 		return errors.New("client connection already open")
 	}
 
 	//dial the connection to the server
-	conn, err := net.Dial("tcp", address+":"+strconv.Itoa(port)) 
+	c.dial = func() (net.Conn, error) {
+		return net.Dial("tcp", address+":"+strconv.Itoa(port)) 
+	}
+
+	return c.start()
+}
+
+/* Connect to a hub over TLS. To authenticate with a client certificate,
+ * put it in the Certificates of the config
+ */
+func (c *Client) ConnectTLS(address string, port int, config *tls.Config) error {
+
+	//already connected or pending connection
+	if c.getSocket() != nil {
+		return errors.New("client connection already open")
+	}
+
+	//dial the connection and complete the handshake before using it
+	c.dial = func() (net.Conn, error) {
+		return tls.Dial("tcp", address+":"+strconv.Itoa(port), config)
+	}
+
+	return c.start()
+}
+
+//open the first connection, start the services and ask for an id
+func (c *Client) start() error {
+
+	c.setState(StateConnecting)
+
+	conn, err := c.dial()
 	if err != nil {
 		return err
 	}
 
+	//a hub that never answers the handshake would block the caller
+	conn.SetDeadline(time.Now().Add(RequestTimeout))
+	s, ans, err := c.open(conn)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
 	//enable connection on client
-	c.socket = mexsocket.New(0,conn)
+	c.setSocket(s)
+	c.setState(StateConnected)
 
 	go c.handleConnection()
 
+	//authenticated hubs send the id at the end of the handshake
+	if ans != nil {
+		c.queueAnswer(ans)
+		return nil
+	}
+
 	idMex := message.NewRequest(message.Identity)
-	_, err = c.socket.Send(idMex)
+	_, err = s.Send(idMex)
 	return err
 }
 
+/* Create the socket on a new connection, negotiate the protocol and authenticate
+ * if credentials are set. Returns the identity sent by an authenticating hub
+ */
+func (c *Client) open(conn net.Conn) (*mexsocket.MexSocket, *message.Answer, error) {
+
+	s := mexsocket.New(0,conn)
+
+	challenge, err := c.hello(conn, s)
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	if c.credentials == nil {
+		return s, nil, nil
+	}
+
+	ans, err := c.authenticate(s, challenge)
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+	return s, ans, nil
+}
+
+/* Say Hello and switch to the protocol chosen by the hub. An authenticating hub
+ * sends its challenge before reading the Hello, the challenge is returned.
+ * A hub predating Hello ignores it: if nothing comes back within HelloTimeout,
+ * the client keeps the original protocol
+ */
+func (c *Client) hello(conn net.Conn, s *mexsocket.MexSocket) (*message.Answer, error) {
+
+	if _, err := s.Send(message.NewHelloRequest(c.features)); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(HelloTimeout))
+	defer conn.SetReadDeadline(time.Now().Add(RequestTimeout))
+
+	var challenge *message.Answer
+	for {
+		ans := new(message.Answer)
+		if n, err := s.Read(ans); err != nil {
+
+			//nothing was read, so the connection is still usable
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 && challenge == nil {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		switch ans.MexType {
+		case message.Hello:
+			s.SetProtocol(ans.Protocol())
+			return challenge, nil
+		case message.Auth:
+			challenge = ans
+		case message.Error:
+			return nil, errors.New(ans.ErrorText())
+		default:
+			return nil, errors.New("unexpected answer during the protocol negotiation")
+		}
+	}
+}
+
+/* Answer the hub challenge before the services start, so the handshake
+ * messages are read synchronously
+ */
+func (c *Client) authenticate(s *mexsocket.MexSocket, challenge *message.Answer) (*message.Answer, error) {
+
+	if challenge == nil {
+		return nil, errors.New("hub did not send an authentication challenge")
+	}
+
+	req := message.NewAuthRequest(c.credentials(challenge.Nonce()))
+	if req == nil {
+		return nil, errors.New("invalid credentials")
+	}
+
+	if _, err := s.Send(req); err != nil {
+		return nil, err
+	}
+
+	ans := new(message.Answer)
+	if _, err := s.Read(ans); err != nil {
+		return nil, err
+	}
+
+	switch ans.MexType {
+	case message.Identity:
+		return ans, nil
+	case message.Error:
+		return nil, errors.New(ans.ErrorText())
+	default:
+		return nil, errors.New("unexpected answer during authentication")
+	}
+}
+
 func (c *Client) Send(mex *message.Request) error {
 
 	//already connected or pending connection
-	if c.socket == nil {
+	s := c.getSocket()
+	if s == nil {
 		return errors.New("client is not connected")
 	}
 
-	_, err := c.socket.Send(mex)
+	_, err := s.Send(mex)
 	return err
 }
 
 func (c *Client) SendBytes(payload []byte) error {
 
 	//already connected or pending connection
-	if c.socket == nil {
+	s := c.getSocket()
+	if s == nil {
 		return errors.New("client is not connected")
 	}
 
-	_, err := c.socket.WriteBytes(payload)
+	_, err := s.WriteBytes(payload)
 	return err
 }
 
+//ask the hub for its statistics and wait for the answer
+func (c *Client) RequestStats() (*statbucket.StatBucket, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	ans, err := c.roundTrip(ctx, message.NewRequest(message.Stat))
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := new(statbucket.StatBucket)
+	if err = bucket.FromByteArray(ans.Stats()); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+/* Relay the body and wait for the hub to report the outcome for each receiver.
+ * Delivered means queued for the receiver, not yet read by it
+ */
+func (c *Client) SendRelayAndWait(ctx context.Context, receivers []uint64, body []byte) ([]message.Delivery, error) {
+
+	if !c.Protocol().Has(message.FeatureAcks) {
+		return nil, ErrUnsupported
+	}
+
+	req := message.NewRelayRequest(receivers, body)
+	if req == nil {
+		return nil, errors.New("too many receivers or payload too large")
+	}
+	req.Ack = true
+
+	ans, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Report(), nil
+}
+
+//ask the hub for the other connected clients and wait for the answer
+func (c *Client) ListPeers(ctx context.Context) ([]uint64, error) {
+
+	ans, err := c.roundTrip(ctx, message.NewRequest(message.List))
+	if err != nil {
+		return nil, err
+	}
+	return ans.List(), nil
+}
+
+//ask the hub for the id of this client and wait for the answer
+func (c *Client) Identity(ctx context.Context) (uint64, error) {
+
+	ans, err := c.roundTrip(ctx, message.NewRequest(message.Identity))
+	if err != nil {
+		return 0, err
+	}
+	return ans.Id(), nil
+}
+
+/* Send a request with a fresh correlation id and wait for the answer carrying
+ * the same id. Correlated answers are not delivered on the Incoming channels
+ */
+func (c *Client) roundTrip(ctx context.Context, req *message.Request) (*message.Answer, error) {
+
+	//never modify the request of the caller
+	correlated := *req
+	correlated.Corr = atomic.AddUint32(&c.nextCorr, 1)
+	if correlated.Corr == 0 {
+		correlated.Corr = atomic.AddUint32(&c.nextCorr, 1)
+	}
+
+	//buffered, so the answer never blocks when nobody waits anymore
+	ch := make(chan *message.Answer, 1)
+	c.pendingLock.Lock()
+	c.pending[correlated.Corr] = ch
+	c.pendingLock.Unlock()
+
+	defer func(){
+		c.pendingLock.Lock()
+		delete(c.pending, correlated.Corr)
+		c.pendingLock.Unlock()
+	}()
+
+	if err := c.Send(&correlated); err != nil {
+		return nil, err
+	}
+
+	select{
+	case ans := <- ch:
+		if ans.MexType == message.Error {
+			return nil, errors.New(ans.ErrorText())
+		}
+		return ans, nil
+	case <- ctx.Done():
+		return nil, ctx.Err()
+	case <- c.quitting:
+		return nil, errors.New("client disconnected")
+	}
+}
+
+//deliver an answer to the request waiting for it, if any
+func (c *Client) resolve(ans *message.Answer) bool {
+
+	if ans.Corr == 0 {
+		return false
+	}
+
+	c.pendingLock.Lock()
+	ch, ok := c.pending[ans.Corr]
+	delete(c.pending, ans.Corr)
+	c.pendingLock.Unlock()
+
+	if ok {
+		ch <- ans
+	}
+	return ok
+}
+
 func (c *Client) Disconnect() {
 
     close(c.quitting)
-    c.socket.Close()
-
-    <- c.socket.QuitChan()
     <- c.doneQuit
 }
 
 func (c *Client) handleConnection(){
 
-	go c.socket.StartReadService(mexsocket.ModeClient)
-	go c.socket.StartWriteService()
+	for {
+		//the connection dropped: get it back, if enabled
+		if !c.serve(c.getSocket()) && c.reconnect != nil && c.redial() {
+			go c.restore()
+			continue
+		}
+
+		c.setState(StateClosed)
+		<- c.quitting
+		c.doneQuit <- nil
+		return
+	}
+}
 
-	incoming := c.socket.Incoming()
-	errChan  := c.socket.ErrorChan()
+/* Run the socket services and deliver the answers until the socket closes.
+ * Returns true if the client is disconnecting
+ */
+func (c *Client) serve(s *mexsocket.MexSocket) bool {
+
+	go s.StartReadService(mexsocket.ModeClient)
+	go s.StartWriteService()
+
+	incoming := s.Incoming()
+	errChan  := s.ErrorChan()
+
+	//a stream can't resume on another connection
+	defer c.abortStreams()
 
 	for {
 
 		select{
-        	//got new message from server
+        	//got new message from server. A closed channel is disabled until quit
         	case answer,ok := <- incoming:    
-        		if ok {
-	        		//don't block on forwarding messages to outgoing channel
-	        		go c.queueAnswer(answer.(*message.Answer))
+        		if !ok {
+	        		incoming = nil
+	        		break
+	        	}
+
+	        	//answers are handed off in order, without blocking the loop
+	        	if ans := answer.(*message.Answer); ans.MexType == message.Chunk {
+	        		c.receiveChunk(ans)
+	        	} else {
+	        		c.updatePeers(ans)
+	        		c.queueAnswer(ans)
 	        	}
 
-			/* if socket gives error, print it... at least! There should be a proper error handling, a mechanism
-	         * to recover the connection or eventual special errors.. Need more requirements..
-	         */
+			//errors are only logged, a broken connection closes the socket
 			case err := <- errChan:
 				log.Println("received error",err)
 
+			//connection closed by the hub or the network
+			case <- s.QuitChan():
+				select{
+				case <- c.quitting:
+					return true
+				default:
+					return false
+				}
+
 			//call disconnect
 			case <-c.quitting:  		
-	            c.socket.Close()		
-	            c.doneQuit <- nil
-	            return
-      
+	            s.Close()		
+	            return true
 		}
 	}
 }
@@ -154,23 +615,50 @@ func (c *Client) queueAnswer(ans *message.Answer){
 
 	switch ans.MexType{
 	case message.Identity:
-		c.id = ans.Id()
+		c.setIdentity(ans)
 		ch = c.incomingId
 	case message.List:
-		c.lastClientList = ans.List()
 		ch = c.incomingList
+	case message.PeerJoined, message.PeerLeft:
+		ch = c.incomingPresence
 	case message.Relay:
 		ch = c.incomingRelay
+	case message.GroupRelay:
+		ch = c.incomingGroup
+	case message.Stat:
+		ch = c.incomingStat
+	case message.Report:
+		ch = c.incomingReport
+	case message.Publish:
+		//a topic can match several filters, each gets the message
+		for _, sub := range c.subscriptions(ans.Topic()) {
+			c.laneOf(sub).push(ans, c.quitting)
+		}
+		return
+	case message.Ok, message.Directory, message.GroupMembers:
+		//confirmations and directories matter only to the waiting request
+		c.resolve(ans)
+		return
+	case message.Error:
+		//errors without a waiting request are only logged
+		if !c.resolve(ans) {
+			log.Println("Client",c.Id(),"received error:",ans.ErrorText())
+		}
+		return
+	case message.Shutdown:
+		log.Println("Client",c.Id(),"hub is shutting down")
+		c.getSocket().Close()
+		return
 	default:
 		log.Println("Client",c.Id(),"Received unknown answer",ans.MexType)
 		return
 	}
 
-	//Exit if client closes
-	select{
-		case ch <- ans:
-			return
-		case <- c.quitting:
-			return
+	//answers to synchronous requests go only to the waiting caller
+	if c.resolve(ans) {
+		return
 	}
+
+	//delivered after the previous answers for the same channel
+	c.laneOf(ch).push(ans, c.quitting)
 }
\ No newline at end of file
@@ -1,11 +1,14 @@
 package client_test
 
 import( 
+	"time"
+	"context"
 	"testing"
 	"github.com/stretchr/testify/assert"
 	"github.com/sech90/go-message-hub/client"
 	"github.com/sech90/go-message-hub/message"
 	"github.com/sech90/go-message-hub/testutils"
+	"github.com/sech90/go-message-hub/statbucket"
 )
 
 const(
@@ -85,10 +88,118 @@ func TestRelay(t *testing.T){
 	err := c.Send(mex)
 	assert.Nil(err, "Client should send without errors")
 
-	server.WriteTo(c.Id(), message.NewAnswerRelay(testBody))
+	server.WriteTo(c.Id(), message.NewAnswerRelay(7, 3, testBody))
 	ans := <- c.IncomingRelay()
 	assert.Nil(testutils.CompareBytes(testBody, ans.Body()), "Bodies should be the same")
+	assert.Equal(uint64(7), ans.Sender(), "Sender should be exposed on relays")
+	assert.Equal(uint64(3), ans.Seq(), "Sequence number should be exposed on relays")
+
+	//relays are delivered in the order they arrive, even if read late
+	for seq := uint64(1); seq <= 20; seq++ {
+		server.WriteTo(c.Id(), message.NewAnswerRelay(7, seq, testBody))
+	}
+	time.Sleep(50 * time.Millisecond)
+	for seq := uint64(1); seq <= 20; seq++ {
+		ans = <- c.IncomingRelay()
+		assert.Equal(seq, ans.Seq(), "Relays should be delivered in order")
+	}
+}
+
+func TestStats(t *testing.T){
+	assert := assert.New(t)
+
+	c := client.NewClient()
+	c.Connect(addr,port)
+	<- c.IncomingId()
+
+	var served statbucket.StatBucket
+	served.ClientsConnected.Set(3)
+	served.ByteRead.Set(1024)
+
+	server.Handle(message.Stat, func(id uint64, req *message.Request) *message.Answer {
+		return message.NewAnswerStat(served.ToByteArray())
+	})
+	defer server.Handle(message.Stat, nil)
+
+	stats, err := c.RequestStats()
+
+	assert.Nil(err, "Stats request should succeed")
+	if assert.NotNil(stats, "Stats should be decoded") {
+		assert.Equal(uint64(3), stats.ClientsConnected.Get(), "Stats should match the ones from server")
+		assert.Equal(uint64(1024), stats.ByteRead.Get(), "Stats should match the ones from server")
+	}
+
+	c.Disconnect()
+}
+
+func TestCorrelation(t *testing.T){
+	assert := assert.New(t)
 
+	c := client.NewClient()
+	c.Connect(addr,port)
+	<- c.IncomingId()
+
+	//every answer depends on the correlation id, so a mixup is detected
+	server.Handle(message.List, func(id uint64, req *message.Request) *message.Answer {
+		return message.NewAnswerList([]uint64{uint64(req.Corr)})
+	})
+	defer server.Handle(message.List, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	const calls = 20
+	results := make(chan []uint64, calls)
+	for i := 0; i < calls; i++ {
+		go func(){
+			list, err := c.ListPeers(ctx)
+			assert.Nil(err, "Concurrent requests should all get an answer")
+			results <- list
+		}()
+	}
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < calls; i++ {
+		list := <- results
+		if assert.Len(list, 1, "Answer should come from the handler") {
+			assert.False(seen[list[0]], "Every caller should get its own answer")
+			seen[list[0]] = true
+		}
+	}
+
+	id, err := c.Identity(ctx)
+	assert.Nil(err, "Identity request should succeed")
+	assert.Equal(c.Id(), id, "Identity should match the one from server")
+
+	//without an answer the request times out
+	server.Handle(message.List, nil)
+	short, cancelShort := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancelShort()
+
+	_, err = c.ListPeers(short)
+	assert.Equal(context.DeadlineExceeded, err, "Unanswered request should time out")
+
+	c.Disconnect()
+}
+
+func TestLegacyHub(t *testing.T){
+	assert := assert.New(t)
+
+	//a hub predating Hello doesn't answer it
+	server.Handle(message.Hello, func(id uint64, req *message.Request) *message.Answer {
+		return nil
+	})
+	defer server.Handle(message.Hello, nil)
+
+	c := client.NewClient()
+	err := c.Connect(addr,port)
+	assert.Nil(err, "Connection should fall back to the original protocol")
+	assert.Equal(message.LegacyProtocol, c.Protocol(), "Client should keep the original protocol")
+
+	id := <- c.IncomingId()
+	assert.Equal(id.Id(), c.Id(), "Client should get an id after the fallback")
+
+	c.Disconnect()
 }
 
 func TestTerminate(t *testing.T){
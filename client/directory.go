@@ -0,0 +1,82 @@
+package client
+
+import(
+	"log"
+	"errors"
+	"context"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/metadata"
+)
+
+var ErrTagsTooLarge = errors.New("tags exceed the maximum size")
+
+/* Describe the client to its peers, replacing the tags registered before.
+ * See package metadata for the well known keys
+ */
+func (c *Client) Register(tags map[string]string) error {
+
+	if !c.Protocol().Has(message.FeatureTags) {
+		return ErrUnsupported
+	}
+
+	if err := metadata.Validate(tags); err != nil {
+		return err
+	}
+
+	req := message.NewRegisterRequest(tags)
+	if req == nil {
+		return ErrTagsTooLarge
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	if _, err := c.roundTrip(ctx, req); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.tags = tags
+	c.lock.Unlock()
+	return nil
+}
+
+//the other clients with tags matching the filter, see package metadata for the syntax
+func (c *Client) Directory(filter string) ([]message.PeerInfo, error) {
+
+	if !c.Protocol().Has(message.FeatureTags) {
+		return nil, ErrUnsupported
+	}
+
+	if _, err := metadata.ParseFilter(filter); err != nil {
+		return nil, err
+	}
+
+	req := message.NewDirectoryRequest(filter)
+	if req == nil {
+		return nil, metadata.ErrFilter
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	ans, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return ans.Directory(), nil
+}
+
+//register again after a reconnection, the hub forgets the tags with the connection
+func (c *Client) reregister() {
+
+	c.lock.RLock()
+	tags := c.tags
+	c.lock.RUnlock()
+
+	if tags != nil {
+		if err := c.Register(tags); err != nil {
+			log.Println("Client",c.Id(),"cannot register tags:",err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import(
+	"log"
+	"context"
+	"github.com/sech90/go-message-hub/message"
+)
+
+/* Create a group and join it. An owned group is closed when the client leaves it,
+ * the others when their last member leaves. A limit of 0 means no limit
+ */
+func (c *Client) CreateGroup(name string, limit uint32, owned bool) error {
+	return c.groupRequest(message.NewCreateGroupRequest(name, limit, owned))
+}
+
+func (c *Client) JoinGroup(name string) error {
+	return c.groupRequest(message.NewGroupRequest(message.JoinGroup, name))
+}
+
+func (c *Client) LeaveGroup(name string) error {
+	return c.groupRequest(message.NewGroupRequest(message.LeaveGroup, name))
+}
+
+/* Send the body to the other members of a group the client joined. The members
+ * get it on IncomingGroup
+ */
+func (c *Client) SendToGroup(name string, body []byte) error {
+
+	if !c.Protocol().Has(message.FeatureGroups) {
+		return ErrUnsupported
+	}
+
+	req := message.NewGroupRelayRequest(name, body)
+	if req == nil {
+		return message.ErrInvalidTopic
+	}
+	return c.Send(req)
+}
+
+//current members of a group, including the client if it joined
+func (c *Client) GroupMembers(name string) ([]uint64, error) {
+
+	if !c.Protocol().Has(message.FeatureGroups) {
+		return nil, ErrUnsupported
+	}
+
+	req := message.NewGroupRequest(message.GroupMembers, name)
+	if req == nil {
+		return nil, message.ErrInvalidTopic
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	ans, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return ans.List(), nil
+}
+
+func (c *Client) IncomingGroup() <-chan *message.Answer {
+	return c.incomingGroup
+}
+
+//send a create, join or leave request and track the groups joined
+func (c *Client) groupRequest(req *message.Request) error {
+
+	if !c.Protocol().Has(message.FeatureGroups) {
+		return ErrUnsupported
+	}
+
+	if req == nil {
+		return message.ErrInvalidTopic
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	if _, err := c.roundTrip(ctx, req); err != nil {
+		return err
+	}
+
+	c.groupsLock.Lock()
+	if req.MexType == message.LeaveGroup {
+		delete(c.groups, req.Topic)
+	} else {
+		c.groups[req.Topic] = true
+	}
+	c.groupsLock.Unlock()
+	return nil
+}
+
+//join again after a reconnection, in case the hub didn't keep the session
+func (c *Client) rejoin() {
+
+	c.groupsLock.Lock()
+	names := make([]string, 0, len(c.groups))
+	for name := range c.groups {
+		names = append(names, name)
+	}
+	c.groupsLock.Unlock()
+
+	for _, name := range names {
+		if err := c.JoinGroup(name); err != nil {
+			log.Println("Client",c.Id(),"cannot join group",name,":",err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package client
+
+import(
+	"sync"
+	"github.com/sech90/go-message-hub/message"
+)
+
+/* Ordered hand-off of answers to one of the client channels. The connection
+ * loop pushes without blocking, a goroutine sends the answers in the order
+ * they arrived for as long as the lane is not empty
+ */
+type lane struct {
+	ch 		chan<- *message.Answer
+	queue 	[]*message.Answer
+	running bool
+	lock 	sync.Mutex
+}
+
+func newLane(ch chan<- *message.Answer) *lane {
+	return &lane{ch: ch}
+}
+
+func (l *lane) push(ans *message.Answer, quit <-chan bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.queue = append(l.queue, ans)
+	if !l.running {
+		l.running = true
+		go l.run(quit)
+	}
+}
+
+func (l *lane) run(quit <-chan bool) {
+	for {
+		l.lock.Lock()
+		if len(l.queue) == 0 {
+			l.running = false
+			l.lock.Unlock()
+			return
+		}
+		ans := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		l.lock.Unlock()
+
+		select{
+		case l.ch <- ans:
+		case <- quit:
+			return
+		}
+	}
+}
+
+//the lane of a channel, created on first use
+func (c *Client) laneOf(ch chan *message.Answer) *lane {
+	c.lanesLock.Lock()
+	defer c.lanesLock.Unlock()
+
+	l, ok := c.lanes[ch]
+	if !ok {
+		l = newLane(ch)
+		c.lanes[ch] = l
+	}
+	return l
+}
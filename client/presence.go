@@ -0,0 +1,116 @@
+package client
+
+import(
+	"log"
+	"context"
+	"github.com/sech90/go-message-hub/message"
+)
+
+const(
+	//presence events waiting to be read
+	PRESENCE_BUFFER = 64
+)
+
+/* Ask the hub for PeerJoined and PeerLeft events, delivered on IncomingPresence.
+ * The hub answers with the connected clients, and from then on List is kept
+ * up to date by the events, without polling
+ */
+func (c *Client) WatchPresence() error {
+
+	if !c.Protocol().Has(message.FeaturePresence) {
+		return ErrUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	if _, err := c.roundTrip(ctx, message.NewRequest(message.WatchPresence)); err != nil {
+		return err
+	}
+
+	c.peersLock.Lock()
+	c.watching = true
+	c.peersLock.Unlock()
+	return nil
+}
+
+//stop the events. List is updated again only by List requests
+func (c *Client) UnwatchPresence() error {
+
+	if !c.Protocol().Has(message.FeaturePresence) {
+		return ErrUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	if _, err := c.roundTrip(ctx, message.NewRequest(message.UnwatchPresence)); err != nil {
+		return err
+	}
+
+	c.peersLock.Lock()
+	c.watching = false
+	c.peersLock.Unlock()
+	return nil
+}
+
+func (c *Client) IncomingPresence() <-chan *message.Answer {
+	return c.incomingPresence
+}
+
+//last known list of the other clients
+func (c *Client) List() []uint64 {
+	c.peersLock.RLock()
+	defer c.peersLock.RUnlock()
+
+	if c.peers == nil {
+		return nil
+	}
+	return append([]uint64{}, c.peers...)
+}
+
+/* Apply a list or a presence event to the cached list. Runs in the connection
+ * loop, so they are applied in the order the hub sent them
+ */
+func (c *Client) updatePeers(ans *message.Answer) {
+
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+
+	switch ans.MexType {
+	case message.List:
+		c.peers = ans.List()
+
+	case message.PeerJoined:
+		id := ans.Peer()
+		for _, peer := range c.peers {
+			if peer == id {
+				return
+			}
+		}
+		c.peers = append(c.peers, id)
+
+	case message.PeerLeft:
+		id := ans.Peer()
+		for i, peer := range c.peers {
+			if peer == id {
+				c.peers = append(c.peers[:i], c.peers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+//watch again after a reconnection, the hub forgets it with the connection
+func (c *Client) rewatch() {
+
+	c.peersLock.RLock()
+	watching := c.watching
+	c.peersLock.RUnlock()
+
+	if watching {
+		if err := c.WatchPresence(); err != nil {
+			log.Println("Client",c.Id(),"cannot watch presence:",err)
+		}
+	}
+}
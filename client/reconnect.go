@@ -0,0 +1,197 @@
+package client
+
+import(
+	"log"
+	"time"
+	"errors"
+	"math/rand"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/mexsocket"
+)
+
+/* Connection states, notified on the States channel */
+type State int
+
+const(
+	StateConnecting 	State = 1
+	StateConnected 		State = 2
+	StateReconnecting 	State = 3
+	StateClosed 		State = 4
+
+	//states not read in time are discarded
+	STATES_BUFFER = 16
+
+	DEFAULT_MIN_DELAY = 100 * time.Millisecond
+	DEFAULT_MAX_DELAY = 10 * time.Second
+)
+
+/* Configuration of the automatic reconnection */
+type ReconnectOptions struct {
+	//wait before the first attempt, doubled after each failure up to MaxDelay
+	MinDelay 	time.Duration
+	MaxDelay 	time.Duration
+
+	//attempts before giving up and closing the client. 0 retries forever
+	MaxAttempts int
+}
+
+func DefaultReconnectOptions() ReconnectOptions {
+	return ReconnectOptions{
+		MinDelay: 	DEFAULT_MIN_DELAY,
+		MaxDelay: 	DEFAULT_MAX_DELAY,
+	}
+}
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateReconnecting:
+		return "Reconnecting"
+	case StateClosed:
+		return "Closed"
+	}
+	return "Unknown"
+}
+
+/* Reconnect automatically when the connection drops. The client gets back its id
+ * if the hub resumes sessions and the client comes back before the session expires.
+ * Must be called before connecting
+ */
+func (c *Client) EnableReconnect(opts ReconnectOptions) {
+	c.reconnect = &opts
+}
+
+func (c *Client) States() <-chan State {
+	return c.states
+}
+
+//never block the connection on a state nobody reads
+func (c *Client) setState(state State) {
+	select{
+	case c.states <- state:
+	default:
+	}
+}
+
+//try to reconnect with exponential backoff. Returns false if the client gives up or quits
+func (c *Client) redial() bool {
+
+	opts  := c.reconnect
+	delay := opts.MinDelay
+
+	c.setState(StateReconnecting)
+
+	for attempt := 1; ; attempt++ {
+
+		select{
+		case <- time.After(jitter(delay)):
+		case <- c.quitting:
+			return false
+		}
+
+		c.setState(StateConnecting)
+		err := c.resume()
+		if err == nil {
+			c.setState(StateConnected)
+			return true
+		}
+
+		log.Println("Client", c.Id(), "reconnection failed:", err)
+		if opts.MaxAttempts > 0 && attempt >= opts.MaxAttempts {
+			return false
+		}
+
+		delay *= 2
+		if delay > opts.MaxDelay {
+			delay = opts.MaxDelay
+		}
+	}
+}
+
+//the hub may have lost the state of the client with the previous connection
+func (c *Client) restore() {
+	c.resubscribe()
+	c.rewatch()
+	c.reregister()
+	c.rejoin()
+}
+
+//random wait between d/2 and d, so clients dropped together don't come back together
+func jitter(d time.Duration) time.Duration {
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(d - half)))
+}
+
+/* Open a new connection and claim the previous id with the session token.
+ * The answers are read synchronously, before the services start
+ */
+func (c *Client) resume() error {
+
+	//an authenticating hub replaces the token on connection
+	token := c.Token()
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(RequestTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	s, ans, err := c.open(conn)
+	if err != nil {
+		return err
+	}
+
+	if ans != nil {
+		c.setIdentity(ans)
+	}
+
+	var req *message.Request
+	if token != nil {
+		req = message.NewResumeRequest(token)
+	} else if ans == nil {
+		req = message.NewRequest(message.Identity)
+	}
+
+	if req != nil {
+		if _, err = s.Send(req); err == nil {
+			ans, err = c.readIdentity(s)
+		}
+		if err != nil {
+			s.Close()
+			return err
+		}
+		c.setIdentity(ans)
+	}
+
+	c.setSocket(s)
+	return nil
+}
+
+//wait for the identity answer, delivering the answers received meanwhile
+func (c *Client) readIdentity(s *mexsocket.MexSocket) (*message.Answer, error) {
+
+	for {
+		ans := new(message.Answer)
+		if _, err := s.Read(ans); err != nil {
+			return nil, err
+		}
+
+		switch ans.MexType {
+		case message.Identity:
+			return ans, nil
+		case message.Error:
+			return nil, errors.New(ans.ErrorText())
+		default:
+			c.queueAnswer(ans)
+		}
+	}
+}
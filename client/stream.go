@@ -0,0 +1,189 @@
+package client
+
+import(
+	"io"
+	"errors"
+	"sync/atomic"
+	"github.com/sech90/go-message-hub/message"
+)
+
+const(
+	//chunks of a stream waiting to be read. When full, the client stops reading from the hub
+	STREAM_BUFFER = 64
+
+	//streams announced but not yet taken from IncomingStream
+	INCOMING_STREAMS = 16
+)
+
+var(
+	ErrStreamAborted = errors.New("stream aborted by the sender")
+	//the hub forgets the streams of a connection, sent and received, when it drops
+	ErrStreamLost 	 = errors.New("connection lost during the stream")
+)
+
+/* A payload received in chunks. Read returns io.EOF after the last chunk, or an
+ * error if the stream broke. Every stream must be read until the end, or the
+ * client stops receiving the other messages
+ */
+type Stream struct {
+	Sender 	uint64
+	Id 		uint32
+
+	chunks 	chan []byte
+	current []byte
+
+	//set before chunks is closed
+	err 	error
+}
+
+//identifies a stream among the ones of all senders
+type streamKey struct {
+	sender 	uint64
+	id 		uint32
+}
+
+func newStream(sender uint64, id uint32) *Stream {
+	return &Stream{
+		Sender: sender,
+		Id: 	id,
+		chunks: make(chan []byte, STREAM_BUFFER),
+	}
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+
+	for len(st.current) == 0 {
+		chunk, ok := <- st.chunks
+		if !ok {
+			return 0, st.err
+		}
+		st.current = chunk
+	}
+
+	n := copy(p, st.current)
+	st.current = st.current[n:]
+	return n, nil
+}
+
+func (st *Stream) close(err error) {
+	st.err = err
+	close(st.chunks)
+}
+
+func (c *Client) IncomingStream() <-chan *Stream {
+	return c.incomingStream
+}
+
+/* Send everything read from r to the receivers, in chunks of message.CHUNK_LEN,
+ * so the payload can exceed message.MAX_PAYLOAD. Blocks until r returns io.EOF.
+ * Returns ErrStreamLost if the connection drops in the middle, even if the client reconnects
+ */
+func (c *Client) SendStream(receivers []uint64, r io.Reader) error {
+
+	//the whole stream goes on this connection
+	s := c.getSocket()
+	if s == nil {
+		return errors.New("client is not connected")
+	}
+
+	id 	  := atomic.AddUint32(&c.nextStream, 1)
+	flags := message.CHUNK_FIRST
+	buf   := make([]byte, message.CHUNK_LEN)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			//the receivers already got part of the stream
+			if flags & message.CHUNK_FIRST == 0 {
+				s.Send(message.NewChunkRequest(id, message.CHUNK_ABORT, nil, nil))
+			}
+			return err
+		}
+
+		if last {
+			flags |= message.CHUNK_LAST
+		}
+
+		req := message.NewChunkRequest(id, flags, receivers, buf[:n])
+		if req == nil {
+			return errors.New("too many receivers")
+		}
+
+		//a new connection doesn't know the stream, the hub would refuse the rest
+		if c.getSocket() != s {
+			return ErrStreamLost
+		}
+
+		if _, err := s.Send(req); err != nil {
+			if s.IsClosed() {
+				return ErrStreamLost
+			}
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		flags, receivers = 0, nil
+	}
+}
+
+/* Deliver a chunk to its stream. Runs in the connection loop, so the chunks keep
+ * their order and a stream not read in time slows down the sender
+ */
+func (c *Client) receiveChunk(ans *message.Answer) {
+
+	key   := streamKey{ans.Sender(), ans.Stream()}
+	flags := ans.ChunkFlags()
+
+	st, ok := c.streams[key]
+	if flags & message.CHUNK_FIRST != 0 {
+		//the sender reused the id of a stream it never finished
+		if ok {
+			st.close(ErrStreamAborted)
+		}
+
+		st, ok = newStream(key.sender, key.id), true
+		c.streams[key] = st
+
+		go func(){
+			select{
+			case c.incomingStream <- st:
+			case <- c.quitting:
+			}
+		}()
+	}
+
+	//started before this connection
+	if !ok {
+		return
+	}
+
+	if data := ans.Body(); len(data) > 0 {
+		select{
+		case st.chunks <- data:
+		case <- c.quitting:
+			return
+		}
+	}
+
+	switch {
+	case flags & message.CHUNK_ABORT != 0:
+		delete(c.streams, key)
+		st.close(ErrStreamAborted)
+	case flags & message.CHUNK_LAST != 0:
+		delete(c.streams, key)
+		st.close(io.EOF)
+	}
+}
+
+//the chunks still missing are lost with the connection
+func (c *Client) abortStreams() {
+	for key, st := range c.streams {
+		delete(c.streams, key)
+		st.close(ErrStreamLost)
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import(
+	"context"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/topic"
+)
+
+const(
+	//messages of a topic waiting to be read by the subscriber
+	TOPIC_BUFFER = 64
+)
+
+/* Subscribe to a topic filter, which can contain wildcards (see package topic).
+ * The messages published on matching topics are delivered on the returned channel,
+ * subscribing again to the same filter returns the same channel
+ */
+func (c *Client) Subscribe(filter string) (<-chan *message.Answer, error) {
+
+	if !c.Protocol().Has(message.FeatureTopics) {
+		return nil, ErrUnsupported
+	}
+
+	if err := topic.ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+
+	req := message.NewSubscribeRequest(filter)
+	if req == nil {
+		return nil, message.ErrInvalidTopic
+	}
+
+	//register before the hub confirms, messages can follow the confirmation closely
+	c.subsLock.Lock()
+	ch, existing := c.subs[filter]
+	if !existing {
+		ch = make(chan *message.Answer, TOPIC_BUFFER)
+		c.subs[filter] = ch
+	}
+	c.subsLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	if _, err := c.roundTrip(ctx, req); err != nil {
+		if !existing {
+			c.subsLock.Lock()
+			delete(c.subs, filter)
+			c.subsLock.Unlock()
+		}
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+//stop receiving the messages of the filter. The channel is not closed
+func (c *Client) Unsubscribe(filter string) error {
+
+	if !c.Protocol().Has(message.FeatureTopics) {
+		return ErrUnsupported
+	}
+
+	if err := topic.ValidateFilter(filter); err != nil {
+		return err
+	}
+
+	req := message.NewUnsubscribeRequest(filter)
+	if req == nil {
+		return message.ErrInvalidTopic
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+
+	if _, err := c.roundTrip(ctx, req); err != nil {
+		return err
+	}
+
+	c.subsLock.Lock()
+	delete(c.subs, filter)
+	c.subsLock.Unlock()
+	return nil
+}
+
+//send the body to all the clients subscribed to a filter matching the topic
+func (c *Client) Publish(name string, body []byte) error {
+
+	if !c.Protocol().Has(message.FeatureTopics) {
+		return ErrUnsupported
+	}
+
+	if err := topic.ValidateName(name); err != nil {
+		return err
+	}
+
+	req := message.NewPublishRequest(name, body)
+	if req == nil {
+		return message.ErrInvalidTopic
+	}
+	return c.Send(req)
+}
+
+//channels of the subscriptions matching the topic
+func (c *Client) subscriptions(name string) []chan *message.Answer {
+	c.subsLock.RLock()
+	defer c.subsLock.RUnlock()
+
+	var out []chan *message.Answer
+	for filter, ch := range c.subs {
+		if topic.Match(filter, name) {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
+
+//subscribe again after a reconnection, in case the hub didn't keep the session
+func (c *Client) resubscribe() {
+
+	c.subsLock.RLock()
+	filters := make([]string, 0, len(c.subs))
+	for filter := range c.subs {
+		filters = append(filters, filter)
+	}
+	c.subsLock.RUnlock()
+
+	for _, filter := range filters {
+		c.Send(message.NewSubscribeRequest(filter))
+	}
+}
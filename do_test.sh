@@ -3,9 +3,13 @@ go test -cover ./mexsocket/
 go test -cover ./statbucket/
 go test -cover ./client/
 go test -cover ./hub/idpool/
+go test -cover ./topic/
+go test -cover ./metadata/
+go test -cover ./acl/
 go test -cover ./hub/
 go test
 
 go test -bench=. ./message/
 go test -bench=. ./mexsocket/
 go test -bench=. ./hub/idpool/
+go test -bench=. ./topic/
@@ -1,7 +1,10 @@
 package main_test
 
 import(
+	"io"
 	"log"
+	"bytes"
+	"context"
 	"time"
 	"sync"
 	"testing"
@@ -10,6 +13,7 @@ import(
 	"github.com/sech90/go-message-hub/client"
 	"github.com/sech90/go-message-hub/syncmap"
 	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/metadata"
 	"github.com/sech90/go-message-hub/testutils"
 )
 
@@ -24,12 +28,16 @@ const(
 )
 
 var climap 	 = syncmap.NewSyncMap()
-var server 	 = hub.NewHub(Port)
+var server 	 *hub.Hub
 var testBody = testutils.GenPayload(PayloadBytes)
 var allCliId []uint64
 
 func TestInit(t *testing.T){
-	go server.Run()
+	var err error
+	server, err = hub.NewHub(Port)
+	assert.Nil(t, err, "Hub should listen")
+
+	go server.Run(context.Background())
 }
 
 func TestIdentity(t *testing.T){
@@ -142,6 +150,197 @@ func TestRelay(t *testing.T){
 	wg.Wait()
 }
 
+func TestRelayAndWait(t *testing.T){
+	assert := assert.New(t)
+
+	if len(allCliId) < 2 {
+		return
+	}
+
+	val,_ := climap.Get(allCliId[0])
+	c1 := val.(*client.Client)
+	val,_ = climap.Get(allCliId[1])
+	c2 := val.(*client.Client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), TimeoutTime)
+	defer cancel()
+
+	report, err := c1.SendRelayAndWait(ctx, []uint64{c2.Id(), 0}, testBody)
+	assert.Nil(err, "Report should be received")
+	assert.Equal([]message.Delivery{
+		{Id: c2.Id(), Status: message.StatusDelivered},
+		{Id: 0, Status: message.StatusUnknown},
+	}, report, "Report should list every receiver")
+
+	<- c2.IncomingRelay()
+}
+
+func TestPubSub(t *testing.T){
+	assert := assert.New(t)
+
+	filter := "pubsub/#"
+	subscriptions := make([]<-chan *message.Answer, 0, ClientsNum)
+
+	for _, id := range allCliId {
+		val,_ := climap.Get(id)
+		ch, err := val.(*client.Client).Subscribe(filter)
+		assert.Nil(err, "Subscription should be confirmed")
+		subscriptions = append(subscriptions, ch)
+	}
+
+	val,_ := climap.Get(allCliId[0])
+	publisher := val.(*client.Client)
+	assert.NotNil(publisher.Publish(filter, testBody), "Wildcards should not be published")
+	assert.Nil(publisher.Publish("pubsub/news", testBody), "Publish should be sent")
+
+	for _, ch := range subscriptions {
+		select{
+		case ans := <- ch:
+			assert.Equal(publisher.Id(), ans.Sender(), "Every subscriber should get the message")
+		case <- time.After(TimeoutTime):
+			t.Error("Published message timed out")
+		}
+	}
+}
+
+func TestStream(t *testing.T){
+	assert := assert.New(t)
+
+	if len(allCliId) < 2 {
+		return
+	}
+
+	val,_ := climap.Get(allCliId[0])
+	c1 := val.(*client.Client)
+	val,_ = climap.Get(allCliId[1])
+	c2 := val.(*client.Client)
+
+	//larger than any single message
+	payload := testutils.GenPayload(message.MAX_PAYLOAD * 3)
+
+	sent := make(chan error, 1)
+	go func(){
+		sent <- c1.SendStream([]uint64{c2.Id()}, bytes.NewReader(payload))
+	}()
+
+	select{
+	case st := <- c2.IncomingStream():
+		assert.Equal(c1.Id(), st.Sender, "Stream should come from the sender")
+		data, err := io.ReadAll(st)
+		assert.Nil(err, "Stream should end cleanly")
+		assert.Equal(payload, data, "Payload should be reassembled")
+	case <- time.After(TimeoutTime):
+		t.Error("Stream timed out")
+	}
+
+	assert.Nil(<- sent, "Stream should be sent")
+}
+
+func TestPresence(t *testing.T){
+	assert := assert.New(t)
+
+	if len(allCliId) < 1 {
+		return
+	}
+
+	val,_ := climap.Get(allCliId[0])
+	watcher := val.(*client.Client)
+	assert.Nil(watcher.WatchPresence(), "Presence should be watched")
+	assert.Len(watcher.List(), len(allCliId) - 1, "List should come with the opt-in")
+
+	cli := client.NewClient()
+	assert.Nil(cli.Connect(Addr, Port), "new client should connect")
+	<- cli.IncomingId()
+
+	//the cached list follows the events
+	expect := func(mexType byte, present bool) {
+		select{
+		case ans := <- watcher.IncomingPresence():
+			assert.Equal(mexType, ans.Type(), "Event type should match")
+			assert.Equal(cli.Id(), ans.Peer(), "Event should be about the new client")
+			assert.Equal(present, contains(watcher.List(), cli.Id()), "List should be updated by the event")
+		case <- time.After(TimeoutTime):
+			t.Error("Presence event timed out")
+		}
+	}
+
+	expect(message.PeerJoined, true)
+	cli.Disconnect()
+	expect(message.PeerLeft, false)
+
+	assert.Nil(watcher.UnwatchPresence(), "Presence should be unwatched")
+}
+
+func contains(list []uint64, id uint64) bool {
+	for _, el := range list {
+		if el == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDirectory(t *testing.T){
+	assert := assert.New(t)
+
+	if len(allCliId) < 2 {
+		return
+	}
+
+	val,_ := climap.Get(allCliId[0])
+	c1 := val.(*client.Client)
+	val,_ = climap.Get(allCliId[1])
+	c2 := val.(*client.Client)
+
+	tags := map[string]string{metadata.NAME: "pricing", metadata.ROLE: "worker"}
+	assert.Nil(c1.Register(tags), "Tags should be registered")
+
+	peers, err := c2.Directory("name=pricing")
+	assert.Nil(err, "Directory should be answered")
+	assert.Equal([]message.PeerInfo{{Id: c1.Id(), Tags: tags}}, peers, "Registered client should be found")
+
+	_, err = c2.Directory("name=")
+	assert.Nil(err, "Empty values can be matched")
+	_, err = c2.Directory("=pricing")
+	assert.NotNil(err, "Malformed filter should be refused")
+	assert.NotNil(c1.Register(map[string]string{"a b": "c"}), "Invalid tags should be refused")
+}
+
+func TestGroups(t *testing.T){
+	assert := assert.New(t)
+
+	if len(allCliId) < 2 {
+		return
+	}
+
+	val,_ := climap.Get(allCliId[0])
+	c1 := val.(*client.Client)
+	val,_ = climap.Get(allCliId[1])
+	c2 := val.(*client.Client)
+
+	assert.Nil(c1.CreateGroup("general", 0, false), "Group should be created")
+	assert.Nil(c2.JoinGroup("general"), "Group should be joined")
+
+	members, err := c1.GroupMembers("general")
+	assert.Nil(err, "Members should be listed")
+	assert.ElementsMatch([]uint64{c1.Id(), c2.Id()}, members, "Both clients should be members")
+
+	assert.Nil(c1.SendToGroup("general", testBody), "Group relay should be sent")
+	select{
+	case ans := <- c2.IncomingGroup():
+		assert.Equal(c1.Id(), ans.Sender(), "Member should get the message")
+		assert.Equal("general", ans.Group(), "Group should be preserved")
+	case <- time.After(TimeoutTime):
+		t.Error("Group relay timed out")
+	}
+
+	assert.NotNil(c1.JoinGroup("missing"), "Unknown group should be refused")
+	assert.Nil(c2.LeaveGroup("general"), "Group should be left")
+	assert.Nil(c1.LeaveGroup("general"), "Group should be left")
+	_, err = c1.GroupMembers("general")
+	assert.NotNil(err, "Empty group should be closed")
+}
+
 func TestDisconnect(t *testing.T){
 
 	for _, id := range allCliId {
@@ -180,7 +379,166 @@ func TestPostDisconnect(t *testing.T){
 }
 
 func TestEnd(t  *testing.T){
-	server.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), TimeoutTime)
+	defer cancel()
+
+	assert.Nil(t, server.Shutdown(ctx), "Hub should shut down gracefully")
+}
+
+func TestTLS(t *testing.T){
+	assert := assert.New(t)
+
+	const tlsPort = Port - 10
+
+	pki, err := testutils.NewTestPKI("tls-client")
+	assert.Nil(err, "Certificates should be generated")
+
+	opts := hub.DefaultOptions()
+	opts.TLSConfig = pki.ServerConfig()
+	h, err := hub.NewHubWithOptions(tlsPort, opts)
+	assert.Nil(err, "Hub should listen")
+	go h.Run(context.Background())
+	defer h.Stop()
+
+	c1, c2 := client.NewClient(), client.NewClient()
+	assert.Nil(c1.ConnectTLS(Addr, tlsPort, pki.ClientConfig()), "TLS connection should work")
+	assert.Nil(c2.ConnectTLS(Addr, tlsPort, pki.ClientConfig()), "TLS connection should work")
+	<- c1.IncomingId()
+	<- c2.IncomingId()
+
+	principal, _ := h.Principal(c1.Id())
+	assert.Equal("CN=tls-client", principal, "Certificate subject should be the principal")
+
+	c1.Send(message.NewRelayRequest([]uint64{c2.Id()}, testBody))
+	select{
+	case ans := <- c2.IncomingRelay():
+		assert.Equal(c1.Id(), ans.Sender(), "Relay should be delivered over TLS")
+	case <- time.After(TimeoutTime):
+		t.Error("Relay over TLS timed out")
+	}
+
+	c1.Disconnect()
+	c2.Disconnect()
+}
+
+func TestAuth(t *testing.T){
+	assert := assert.New(t)
+
+	const authPort = Port - 11
+
+	opts := hub.DefaultOptions()
+	opts.Authenticator = hub.NewHMACAuthenticator(map[string][]byte{"worker": []byte("worker key")})
+	h, err := hub.NewHubWithOptions(authPort, opts)
+	assert.Nil(err, "Hub should listen")
+	go h.Run(context.Background())
+	defer h.Stop()
+
+	bad := client.NewClient()
+	bad.SetCredentials(client.HMACCredentials("worker", []byte("wrong key")))
+	assert.NotNil(bad.Connect(Addr, authPort), "Wrong key should be rejected")
+
+	c := client.NewClient()
+	c.SetCredentials(client.HMACCredentials("worker", []byte("worker key")))
+	assert.Nil(c.Connect(Addr, authPort), "Right key should be accepted")
+
+	select{
+	case ans := <- c.IncomingId():
+		assert.Equal(c.Id(), ans.Id(), "Client should know its id")
+	case <- time.After(TimeoutTime):
+		t.Error("Identity after authentication timed out")
+	}
+
+	principal, _ := h.Principal(c.Id())
+	assert.Equal("worker", principal, "Key owner should be the principal")
+
+	//the protocol is negotiated before the challenge is answered
+	assert.Equal(message.MAX_PROTOCOL_VERSION, c.Protocol().Version, "Highest version should be agreed")
+	assert.True(c.Protocol().Has(client.DEFAULT_FEATURES), "Default features should be agreed")
+
+	c.Disconnect()
+
+	//features not asked can't be used
+	c = client.NewClient()
+	c.SetFeatures(message.FeatureAcks)
+	c.SetCredentials(client.HMACCredentials("worker", []byte("worker key")))
+	assert.Nil(c.Connect(Addr, authPort), "Client should connect")
+	_, err = c.Subscribe("news")
+	assert.Equal(client.ErrUnsupported, err, "Topics were not negotiated")
+
+	c.Disconnect()
+}
+
+func TestReconnect(t *testing.T){
+	assert := assert.New(t)
+
+	const reconnectPort = Port - 12
+
+	opts := hub.DefaultOptions()
+	opts.SessionTTL = TimeoutTime
+	h, err := hub.NewHubWithOptions(reconnectPort, opts)
+	assert.Nil(err, "Hub should listen")
+	go h.Run(context.Background())
+	defer h.Stop()
+
+	reconnectOpts := client.DefaultReconnectOptions()
+	reconnectOpts.MinDelay = 10 * time.Millisecond
+
+	c, sender := client.NewClient(), client.NewClient()
+	c.EnableReconnect(reconnectOpts)
+	assert.Nil(c.Connect(Addr, reconnectPort), "Connection should work")
+	assert.Nil(sender.Connect(Addr, reconnectPort), "Connection should work")
+	<- c.IncomingId()
+	<- sender.IncomingId()
+	id := c.Id()
+
+	waitState := func(expected client.State) {
+		for {
+			select{
+			case state := <- c.States():
+				if state == expected {
+					return
+				}
+			case <- time.After(TimeoutTime):
+				t.Errorf("Timed out waiting for state %s", expected)
+				return
+			}
+		}
+	}
+	waitState(client.StateConnected)
+
+	//drop the connection from the hub side
+	assert.True(h.Disconnect(id), "Client should be connected")
+	waitState(client.StateReconnecting)
+	waitState(client.StateConnected)
+	assert.Equal(id, c.Id(), "Reconnected client should keep its id")
+
+	sender.Send(message.NewRelayRequest([]uint64{id}, testBody))
+	select{
+	case ans := <- c.IncomingRelay():
+		assert.Equal(sender.Id(), ans.Sender(), "Relay should reach the reconnected client")
+	case <- time.After(TimeoutTime):
+		t.Error("Relay after reconnection timed out")
+	}
+
+	//a stream doesn't survive the connection, the new one can't send the rest of it
+	r, w := io.Pipe()
+	sent := make(chan error, 1)
+	go func(){
+		sent <- c.SendStream([]uint64{sender.Id()}, r)
+	}()
+
+	w.Write(make([]byte, message.CHUNK_LEN))
+	assert.True(h.Disconnect(id), "Client should be connected")
+	waitState(client.StateReconnecting)
+	waitState(client.StateConnected)
+
+	w.Write([]byte("rest"))
+	w.Close()
+	assert.Equal(client.ErrStreamLost, <- sent, "Sender should know the stream is broken")
+
+	c.Disconnect()
+	waitState(client.StateClosed)
+	sender.Disconnect()
 }
 
 func ForwardAndListen(cli *client.Client) int {
@@ -0,0 +1,157 @@
+package hub
+
+import(
+	"log"
+	"errors"
+	"strconv"
+	"github.com/sech90/go-message-hub/acl"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/mexsocket"
+)
+
+var(
+	ErrDenied = errors.New("Denied by the access policy")
+
+	//ReloadACL without Options.ACLFile
+	ErrNoACLFile = errors.New("No access policy file")
+)
+
+//the policy in Options.ACLFile, nil if not set
+func loadACL(opts Options) (*acl.Policy, error) {
+
+	if opts.ACLFile == "" {
+		return nil, nil
+	}
+	return acl.Load(opts.ACLFile)
+}
+
+/* Replace the access policy checked on every relay, broadcast, publication,
+ * group relay and stream. A nil policy allows everything
+ */
+func (hub *Hub) SetACL(policy *acl.Policy) {
+	hub.aclLock.Lock()
+	hub.policy = policy
+	hub.aclLock.Unlock()
+}
+
+/* Load Options.ACLFile again. If the file can't be read or is not a valid
+ * policy, the current policy is kept and the error returned
+ */
+func (hub *Hub) ReloadACL() error {
+
+	if hub.opts.ACLFile == "" {
+		return ErrNoACLFile
+	}
+
+	policy, err := acl.Load(hub.opts.ACLFile)
+	if err != nil {
+		return err
+	}
+
+	hub.SetACL(policy)
+	log.Println("Access policy loaded from", hub.opts.ACLFile)
+	return nil
+}
+
+func (hub *Hub) getACL() *acl.Policy {
+	hub.aclLock.RLock()
+	defer hub.aclLock.RUnlock()
+
+	return hub.policy
+}
+
+//what the policy knows about a client
+func subject(p *peer) acl.Subject {
+	return acl.Subject{Principal: p.principal, Tags: p.Tags()}
+}
+
+//a receiver not connected is matched by its id only, with no principal and tags
+func (hub *Hub) receiver(id uint64) acl.Subject {
+
+	if p, ok := hub.getPeer(id); ok {
+		return subject(p)
+	}
+	return acl.Subject{}
+}
+
+/* The receivers the sender can reach and the number of the others. The policy
+ * is checked once for each receiver
+ */
+func (hub *Hub) permitted(sender *peer, ids []uint64) ([]uint64, int) {
+
+	policy := hub.getACL()
+	if policy == nil {
+		return ids, 0
+	}
+
+	from := subject(sender)
+	allowed := make([]uint64, 0, len(ids))
+
+	for _, id := range ids {
+		if policy.CanRelay(from, hub.receiver(id)) {
+			allowed = append(allowed, id)
+		}
+	}
+
+	denied := len(ids) - len(allowed)
+	hub.stats.Denied.Increase(uint64(denied))
+	return allowed, denied
+}
+
+/* Like deliver, for the receivers the sender can reach. The others are
+ * reported as denied, the report follows the order of ids
+ */
+func (hub *Hub) deliverPermitted(sender *peer, ids []uint64, mex *message.Answer) ([]message.Delivery, int) {
+
+	policy := hub.getACL()
+	if policy == nil {
+		return hub.deliver(ids, mex), 0
+	}
+
+	from := subject(sender)
+	frame := mexsocket.NewSharedFrame(mex.ToByteArray())
+	report := make([]message.Delivery, len(ids))
+	denied := 0
+
+	for i, id := range ids {
+		status := message.StatusDenied
+		if policy.CanRelay(from, hub.receiver(id)) {
+			status = hub.deliverTo(id, frame)
+		} else {
+			denied++
+		}
+		report[i] = message.Delivery{Id: id, Status: status}
+	}
+
+	hub.stats.Denied.Increase(uint64(denied))
+	return report, denied
+}
+
+func (hub *Hub) canPublish(sender *peer, name string) bool {
+
+	policy := hub.getACL()
+	if policy == nil || policy.CanPublish(subject(sender), name) {
+		return true
+	}
+
+	hub.stats.Denied.Increase(1)
+	return false
+}
+
+func (hub *Hub) canSendToGroup(sender *peer, group string) bool {
+
+	policy := hub.getACL()
+	if policy == nil || policy.CanSendToGroup(subject(sender), group) {
+		return true
+	}
+
+	hub.stats.Denied.Increase(1)
+	return false
+}
+
+//tell a sender that didn't ask for a delivery report how many receivers were denied
+func (hub *Hub) refuseReceivers(sender *peer, req *message.Request, denied int) {
+
+	err := errors.New(ErrDenied.Error() + " for " + strconv.Itoa(denied) + " receivers")
+	hub.refuse(sender.socket, req, message.CodeDenied, err)
+}
@@ -0,0 +1,125 @@
+package hub
+
+import(
+	"errors"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/mexsocket"
+)
+
+var ErrAuthFailed = errors.New("Authentication failed")
+
+/* Validates the credential sent by a client in answer to the hub challenge.
+ * Returns the principal of the client, which may be empty for anonymous credentials
+ */
+type Authenticator interface {
+	Authenticate(nonce []byte, credential []byte) (string, error)
+}
+
+/* Accepts a set of static tokens, each belonging to a principal */
+type TokenAuthenticator struct {
+	tokens map[string]string
+}
+
+/* Accepts any client knowing the shared secret */
+type SecretAuthenticator struct {
+	secret 		[]byte
+	principal 	string
+}
+
+/* Accepts clients signing the challenge with their key, see message.NewHMACCredential */
+type HMACAuthenticator struct {
+	keys map[string][]byte
+}
+
+//tokens maps every valid token to its principal
+func NewTokenAuthenticator(tokens map[string]string) *TokenAuthenticator {
+	return &TokenAuthenticator{tokens}
+}
+
+//all the clients knowing the secret share the same principal
+func NewSecretAuthenticator(secret []byte, principal string) *SecretAuthenticator {
+	return &SecretAuthenticator{secret, principal}
+}
+
+//keys maps every principal to its key
+func NewHMACAuthenticator(keys map[string][]byte) *HMACAuthenticator {
+	return &HMACAuthenticator{keys}
+}
+
+func (auth *TokenAuthenticator) Authenticate(nonce []byte, credential []byte) (string, error) {
+
+	//compare all the tokens in constant time
+	principal, found := "", false
+	for token, p := range auth.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), credential) == 1 {
+			principal, found = p, true
+		}
+	}
+
+	if !found {
+		return "", ErrAuthFailed
+	}
+	return principal, nil
+}
+
+func (auth *SecretAuthenticator) Authenticate(nonce []byte, credential []byte) (string, error) {
+
+	if subtle.ConstantTimeCompare(auth.secret, credential) != 1 {
+		return "", ErrAuthFailed
+	}
+	return auth.principal, nil
+}
+
+func (auth *HMACAuthenticator) Authenticate(nonce []byte, credential []byte) (string, error) {
+
+	principal, signature, err := message.ParseHMACCredential(credential)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+
+	key, ok := auth.keys[principal]
+	if !ok || !hmac.Equal(signature, message.SignNonce(key, nonce)) {
+		return "", ErrAuthFailed
+	}
+	return principal, nil
+}
+
+/* Challenge the client with a random nonce and validate its answer.
+ * Must run before the socket services are started
+ */
+func (hub *Hub) authenticate(s *mexsocket.MexSocket) (string, error) {
+
+	nonce := make([]byte, message.NONCE_SIZE)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	if _, err := s.Send(message.NewAnswerChallenge(nonce)); err != nil {
+		return "", err
+	}
+
+	req := new(message.Request)
+	if _, err := s.Read(req); err != nil {
+		return "", err
+	}
+
+	//clients negotiating the protocol say Hello before answering the challenge
+	if req.MexType == message.Hello {
+		if !hub.hello(s, req) {
+			return "", message.ErrUnsupportedVersion
+		}
+		if _, err := s.Read(req); err != nil {
+			return "", err
+		}
+	}
+
+	if req.MexType != message.Auth {
+		return "", ErrAuthFailed
+	}
+
+	return hub.opts.Authenticator.Authenticate(nonce, req.Body)
+}
@@ -0,0 +1,34 @@
+package hub
+
+import(
+	"sort"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/metadata"
+)
+
+/* The clients besides the sender whose tags match the filter, sorted by id.
+ * The answer holds as many of them as fit in MAX_PAYLOAD, a narrower
+ * filter finds the others
+ */
+func (hub *Hub) directory(sender uint64, filter *metadata.Filter) []message.PeerInfo {
+
+	var found []message.PeerInfo
+	for _, p := range hub.peers() {
+		if tags := p.Tags(); p.Id() != sender && filter.Match(tags) {
+			found = append(found, message.PeerInfo{Id: p.Id(), Tags: tags})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Id < found[j].Id
+	})
+
+	size := 0
+	for i, peer := range found {
+		size += 8 + message.TagsSize(peer.Tags)
+		if size > message.MAX_PAYLOAD {
+			return found[:i]
+		}
+	}
+	return found
+}
@@ -0,0 +1,12 @@
+package hub
+
+import(
+	"net"
+)
+
+/* Internals exposed to the tests of package hub_test only */
+
+//port the hub listens on, the one chosen by the system if the hub was created with port 0
+func (hub *Hub) Port() int {
+	return hub.listener.Addr().(*net.TCPAddr).Port
+}
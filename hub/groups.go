@@ -0,0 +1,250 @@
+package hub
+
+import(
+	"sort"
+	"sync"
+	"errors"
+	"github.com/sech90/go-message-hub/message"
+)
+
+var(
+	ErrUnknownGroup = errors.New("No group with this name")
+	ErrGroupExists 	= errors.New("Group already exists")
+	ErrGroupFull 	= errors.New("Group is full")
+	ErrNotMember 	= errors.New("Not a member of the group")
+)
+
+/* A named set of clients. An owned group is closed when its owner leaves,
+ * the others when their last member leaves
+ */
+type group struct {
+	//0 if the group has no owner
+	owner 	uint64
+
+	//0 if unlimited
+	limit 	int
+	members map[uint64]bool
+}
+
+/* Thread safe registry of the groups and of their members */
+type groupRegistry struct {
+	groups 	map[string]*group
+
+	//id --> set of groups, to clean up on disconnection
+	byId 	map[uint64]map[string]bool
+
+	lock 	sync.RWMutex
+}
+
+func newGroupRegistry() *groupRegistry {
+	return &groupRegistry{
+		groups: make(map[string]*group),
+		byId: 	make(map[uint64]map[string]bool),
+	}
+}
+
+//create the group with the client as first member
+func (reg *groupRegistry) create(name string, id uint64, limit int, owned bool) error {
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if _, exists := reg.groups[name]; exists {
+		return ErrGroupExists
+	}
+
+	g := &group{limit: limit, members: make(map[uint64]bool)}
+	if owned {
+		g.owner = id
+	}
+
+	reg.groups[name] = g
+	reg.add(name, g, id)
+	return nil
+}
+
+//joining a group twice is not an error
+func (reg *groupRegistry) join(name string, id uint64) error {
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	g, ok := reg.groups[name]
+	switch {
+	case !ok:
+		return ErrUnknownGroup
+	case g.members[id]:
+		return nil
+	case g.limit > 0 && len(g.members) >= g.limit:
+		return ErrGroupFull
+	}
+
+	reg.add(name, g, id)
+	return nil
+}
+
+func (reg *groupRegistry) leave(name string, id uint64) error {
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	g, ok := reg.groups[name]
+	if !ok {
+		return ErrUnknownGroup
+	}
+	if !g.members[id] {
+		return ErrNotMember
+	}
+
+	reg.remove(name, g, id)
+	return nil
+}
+
+//remove the client from all its groups
+func (reg *groupRegistry) leaveAll(id uint64) {
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	for name := range reg.byId[id] {
+		if g, ok := reg.groups[name]; ok {
+			reg.remove(name, g, id)
+		}
+	}
+}
+
+//ids of the members sorted, false if the group doesn't exist
+func (reg *groupRegistry) members(name string) ([]uint64, bool) {
+
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+
+	g, ok := reg.groups[name]
+	if !ok {
+		return nil, false
+	}
+
+	ids := make([]uint64, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, true
+}
+
+func (reg *groupRegistry) isMember(name string, id uint64) bool {
+
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+
+	g, ok := reg.groups[name]
+	return ok && g.members[id]
+}
+
+//must hold the lock
+func (reg *groupRegistry) add(name string, g *group, id uint64) {
+
+	if reg.byId[id] == nil {
+		reg.byId[id] = make(map[string]bool)
+	}
+
+	g.members[id] = true
+	reg.byId[id][name] = true
+}
+
+//must hold the lock. Closes the group if the owner or the last member leaves
+func (reg *groupRegistry) remove(name string, g *group, id uint64) {
+
+	members := []uint64{id}
+	if g.owner == id {
+		members = make([]uint64, 0, len(g.members))
+		for member := range g.members {
+			members = append(members, member)
+		}
+	}
+
+	for _, member := range members {
+		delete(g.members, member)
+		delete(reg.byId[member], name)
+		if len(reg.byId[member]) == 0 {
+			delete(reg.byId, member)
+		}
+	}
+
+	if len(g.members) == 0 {
+		delete(reg.groups, name)
+	}
+}
+
+//error codes of the group errors
+var groupCodes = map[error]byte{
+	ErrUnknownGroup: 	message.CodeUnknownGroup,
+	ErrGroupExists: 	message.CodeGroupExists,
+	ErrGroupFull: 		message.CodeGroupFull,
+	ErrNotMember: 		message.CodeNotMember,
+	ErrDenied: 			message.CodeDenied,
+}
+
+func (hub *Hub) processGroup(p *peer, req *message.Request) {
+
+	socket := p.socket
+	var err error
+
+	switch req.MexType {
+	case message.CreateGroup:
+		err = hub.groups.create(req.Topic, p.Id(), int(req.GroupLimit()), req.GroupOwned())
+
+	case message.JoinGroup:
+		err = hub.groups.join(req.Topic, p.Id())
+
+	case message.LeaveGroup:
+		err = hub.groups.leave(req.Topic, p.Id())
+
+	//only members can send to the group, the sender doesn't get its own message
+	case message.GroupRelay:
+		if !hub.groups.isMember(req.Topic, p.Id()) {
+			err = ErrNotMember
+			break
+		}
+		if !hub.canSendToGroup(p, req.Topic) {
+			err = ErrDenied
+			break
+		}
+
+		members, _ := hub.groups.members(req.Topic)
+
+		others := members[:0]
+		for _, id := range members {
+			if id != p.Id() {
+				others = append(others, id)
+			}
+		}
+
+		hub.Multicast(others, message.NewAnswerGroupRelay(p.Id(), socket.NextSeq(), req.Topic, req.Body))
+		return
+
+	case message.GroupMembers:
+		members, ok := hub.groups.members(req.Topic)
+		if !ok {
+			err = ErrUnknownGroup
+			break
+		}
+
+		answer := message.NewAnswerGroupMembers(members)
+		answer.Corr = req.Corr
+		socket.Send(answer)
+		return
+	}
+
+	if err != nil {
+		hub.refuse(socket, req, groupCodes[err], err)
+		return
+	}
+
+	answer := message.NewAnswerOk()
+	answer.Corr = req.Corr
+	socket.Send(answer)
+}
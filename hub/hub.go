@@ -3,6 +3,11 @@ package hub
 import( 
 	"log"
 	"net" 
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"crypto/tls"
 	"strconv" 
 	"gopkg.in/fatih/set.v0"
 
@@ -10,14 +15,92 @@ import(
 	"github.com/sech90/go-message-hub/syncmap"
 	"github.com/sech90/go-message-hub/message"
 	"github.com/sech90/go-message-hub/mexsocket"
+	"github.com/sech90/go-message-hub/statbucket"
+	"github.com/sech90/go-message-hub/topic"
+	"github.com/sech90/go-message-hub/metadata"
+	"github.com/sech90/go-message-hub/acl"
+)
+
+/* Policies for assigning ids to clients */
+const (
+	//ids of disconnected clients are given to new ones, after the quarantine
+	IdPolicyReusable = 0
+	//ids are never given out twice
+	IdPolicyIncremental = 1
+
+	//long enough for late relays addressed to a disconnected client to be discarded
+	DEFAULT_ID_QUARANTINE = 10 * time.Second
+
+	DEFAULT_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	//streams a client can send at the same time
+	MAX_OPEN_STREAMS = 64
+)
+
+/* Configuration of a Hub */
+type Options struct {
+	//applied to every client socket, see mexsocket.Options
+	Socket 		mexsocket.Options
+
+	//one of the IdPolicy constants
+	IdPolicy 		int
+
+	//time before a released id can be given to another client
+	IdQuarantine 	time.Duration
+
+	//if set, clients must connect with TLS. Set ClientAuth to verify client certificates:
+	//the subject of a verified certificate becomes the client's principal
+	TLSConfig 		*tls.Config
+
+	//if set, clients must authenticate before getting an id
+	Authenticator 	Authenticator
+
+	//maximum time for a new connection to complete the handshake
+	HandshakeTimeout time.Duration
+
+	//time a disconnected client can resume its id, see message.Resume.
+	//0 disables resumption and ids are released on disconnect
+	SessionTTL 		time.Duration
+
+	//relays for a disconnected client are held until it resumes the session
+	Mailbox 		MailboxOptions
+
+	//limits on the traffic sent by each client
+	RateLimit 		RateLimitOptions
+
+	//file with the access policy of relays, see package acl. If empty everything is allowed
+	ACLFile 		string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Socket: 		mexsocket.DefaultOptions(),
+		IdPolicy: 		IdPolicyReusable,
+		IdQuarantine: 	DEFAULT_ID_QUARANTINE,
+		HandshakeTimeout: DEFAULT_HANDSHAKE_TIMEOUT,
+	}
+}
+
+//returned by Run after the hub has been stopped
+var ErrHubClosed = errors.New("Hub closed")
+
+//the request needs a feature the client didn't negotiate
+var ErrUnsupported = errors.New("Feature not negotiated")
+
+//chunk errors
+var(
+	ErrUnknownStream  = errors.New("Chunk of a stream not opened")
+	ErrTooManyStreams = errors.New("Too many open streams")
 )
 
 /* main server and dispatcher for messages */
 type Hub struct{
 	listener 	net.Listener
 
-	//thread safe map for clients
-	socketMap 	*syncmap.SyncMap
+	opts 		Options
+
+	//thread safe map for clients, id --> *peer
+	peerMap 	*syncmap.SyncMap
 
 	//thread safe id pool for new clients
 	idPool 		idpool.IdPool
@@ -25,37 +108,112 @@ type Hub struct{
 	//thread safe set for caching clients ID
 	idSet		*set.Set
 
+	//resumable sessions, nil if disabled
+	sessions 	*sessionStore
+
+	//clients subscribed to each topic
+	topics 		*topicRegistry
+
+	//named groups and their members
+	groups 		*groupRegistry
+
+	//serializes the changes of the id bound to a client
+	bindLock 	sync.Mutex
+
+	//who can send to whom, nil if everything is allowed
+	policy 		*acl.Policy
+	aclLock 	sync.RWMutex
+
 	//used to signal all goroutines to close at once
 	quit		chan bool
+	quitOnce 	sync.Once
+
+	//set when the hub stops accepting clients and requests
+	closing 	bool
+	lock 		sync.RWMutex
+
+	//track connection and request goroutines, to wait for them on shutdown
+	conns 		sync.WaitGroup
+	requests 	sync.WaitGroup
+
+	//live statistics, shared by all the client sockets
+	stats 		*statbucket.StatBucket
+	startTime 	time.Time
 }
 
-func NewHub(port int) *Hub{
+func NewHub(port int) (*Hub, error) {
+	return NewHubWithOptions(port, DefaultOptions())
+}
 
-	// listen on all interfaces
-	ls, err := net.Listen("tcp", ":"+strconv.Itoa(port))  
+func NewHubWithOptions(port int, opts Options) (*Hub, error) {
 
-	log.Printf("Server begin listen at port: %d", port)
+	var ls net.Listener
+	var err error
+
+	//a broken policy is better found before accepting anyone
+	policy, err := loadACL(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// listen on all interfaces
+	if opts.TLSConfig != nil {
+		ls, err = tls.Listen("tcp", ":"+strconv.Itoa(port), opts.TLSConfig)
+	} else {
+		ls, err = net.Listen("tcp", ":"+strconv.Itoa(port))  
+	}
 	
 	//chec for connection error
 	if err != nil {
-		log.Fatalln(err)
-		return nil
+		return nil, err
 	}
 
+	log.Printf("Server begin listen at port: %d", port)
+
 	hub := &Hub{
 
 		listener: 	ls,
+		opts: 		opts,
 		quit: 		make(chan bool),
-		idPool: 	idpool.NewReusableIdPool(),
+		idPool: 	newIdPool(opts),
 		idSet: 		set.New(),
-		socketMap: syncmap.NewSyncMap(),
+		peerMap: 	syncmap.NewSyncMap(),
+		topics: 	newTopicRegistry(),
+		groups: 	newGroupRegistry(),
+		policy: 	policy,
+		stats: 		new(statbucket.StatBucket),
+		startTime: 	time.Now(),
 	}
 
-	return hub
+	if opts.SessionTTL > 0 {
+		hub.sessions = newSessionStore(opts.SessionTTL, opts.Mailbox, hub.stats)
+	}
+
+	return hub, nil
 
 }
 
-func (hub *Hub) Run() error {
+func newIdPool(opts Options) idpool.IdPool {
+
+	if opts.IdPolicy == IdPolicyIncremental {
+		return idpool.NewIncrementalPool()
+	}
+	return idpool.NewQuarantinedIdPool(opts.IdQuarantine)
+}
+
+/* Accept clients until the hub is stopped or the context is done.
+ * Returns ErrHubClosed after Stop or Shutdown, the context error if it was cancelled
+ */
+func (hub *Hub) Run(ctx context.Context) error {
+
+	//stop the hub together with the context
+	go func(){
+		select{
+		case <- ctx.Done():
+			hub.Stop()
+		case <- hub.quit:
+		}
+	}()
 
 	//main server loop
 	for{
@@ -63,124 +221,758 @@ func (hub *Hub) Run() error {
 		conn, err := hub.listener.Accept()
 
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if hub.isClosing() {
+				return ErrHubClosed
+			}
 			hub.Stop()
 			return err
 		}
 
-		//manage connection
-		go hub.handleConnection(conn)
+		//manage connection, unless the hub is going down
+		hub.lock.RLock()
+		if hub.closing {
+			conn.Close()
+		} else {
+			hub.conns.Add(1)
+			go hub.handleConnection(conn)
+		}
+		hub.lock.RUnlock()
 	}
 } 
 
+//returns the live statistics of the hub, with the uptime refreshed
+func (hub *Hub) Stats() *statbucket.StatBucket {
+	hub.stats.TimeAlive.Set(uint64(time.Since(hub.startTime).Nanoseconds()))
+	return hub.stats
+}
+
+//Immediately disconnect all clients, without waiting for pending messages
 func (hub *Hub) Stop() {
 
-	cliList := hub.idSet.List()
-	var id uint64
-	var val interface{} 
-	var ok bool
+	hub.stopAccepting()
 
 	//disconnect all connected clients
-	for _, val = range cliList {
-		id 	= val.(uint64)
-		val, ok = hub.socketMap.Get(id)
+	for _, p := range hub.peers() {
+		p.socket.Close()
+	}
+}
 
-		if ok{
-			val.(*mexsocket.MexSocket).Close()
-		}
+/* Gracefully stop the hub: stop accepting clients and requests, deliver the relays
+ * already in progress, notify the clients and wait for all the connections to terminate.
+ * If the context is done before, the remaining clients are disconnected immediately
+ */
+func (hub *Hub) Shutdown(ctx context.Context) error {
+
+	hub.stopAccepting()
+
+	//requests already dispatched may still be queueing relays
+	if err := waitContext(ctx, &hub.requests); err != nil {
+		hub.Stop()
+		return err
+	}
+
+	//the notice is queued behind the pending relays
+	notice := message.NewAnswerShutdown().ToByteArray()
+	peers := hub.peers()
+
+	for _, p := range peers {
+		p.socket.Enqueue(notice)
+	}
+
+	for _, p := range peers {
+		p.socket.Flush(ctx)
+		p.socket.Close()
+	}
+
+	if err := waitContext(ctx, &hub.conns); err != nil {
+		hub.Stop()
+		return err
+	}
+
+	return nil
+}
+
+func (hub *Hub) stopAccepting() {
+
+	hub.lock.Lock()
+	hub.closing = true
+	hub.lock.Unlock()
+
+	hub.quitOnce.Do(func(){
+		close(hub.quit)
+		hub.listener.Close()
+	})
+}
+
+func (hub *Hub) isClosing() bool {
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+
+	return hub.closing
+}
+
+//wait for the group, giving up when the context is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+
+	done := make(chan bool)
+	go func(){
+		wg.Wait()
+		close(done)
+	}()
+
+	select{
+	case <- done:
+		return nil
+	case <- ctx.Done():
+		return ctx.Err()
 	}
-	hub.listener.Close() 
+}
 
+//number of frames dropped because the client was too slow to read them
+func (hub *Hub) Dropped(id uint64) (uint64, bool) {
+
+	p, ok := hub.getPeer(id)
+	if !ok {
+		return 0, false
+	}
+	return p.socket.Dropped(), true
+}
+
+//identity proven by the client, if any
+func (hub *Hub) Principal(id uint64) (string, bool) {
+
+	p, ok := hub.getPeer(id)
+	if !ok {
+		return "", false
+	}
+	return p.principal, true
+}
+
+//close the connection of a client. With sessions enabled, the client can still resume its id
+func (hub *Hub) Disconnect(id uint64) bool {
+
+	p, ok := hub.getPeer(id)
+	if !ok {
+		return false
+	}
+
+	p.socket.Close()
+	return true
 }
 
 //Broadcast the message to the clients with id contained in the list
 func (hub *Hub) Multicast(ids []uint64, mex *message.Answer){
+	hub.deliver(ids, mex)
+}
 
-	//convert the message once
-	bytes := mex.ToByteArray()
-	for _, id := range ids {
-		
-		//get client from map
-		s, ok := hub.socketMap.Get(id)
+//current members of a group, false if there is no group with the name
+func (hub *Hub) GroupMembers(name string) ([]uint64, bool) {
+	return hub.groups.members(name)
+}
+
+//send the message to the clients and returns the outcome for each of them
+func (hub *Hub) deliver(ids []uint64, mex *message.Answer) []message.Delivery {
+
+	//convert the message once, and compress it at most once
+	frame  := mexsocket.NewSharedFrame(mex.ToByteArray())
+	report := make([]message.Delivery, len(ids))
+
+	for i, id := range ids {
+		report[i] = message.Delivery{Id: id, Status: hub.deliverTo(id, frame)}
+	}
+
+	return report
+}
+
+func (hub *Hub) deliverTo(id uint64, frame *mexsocket.SharedFrame) byte {
 
-		if ok == true {
-			//send the data directly to client's write goroutine
-			s.(*mexsocket.MexSocket).OutgoingBinary() <- bytes
+	//get client from map
+	p, ok := hub.getPeer(id)
+
+	if ok == true {
+		//queue the data for the client's write goroutine. A slow client
+		//is handled by the queue policy instead of stalling the others
+		status := p.send(frame)
+		if status != message.StatusDropped || !p.socket.IsClosed() {
+			return status
 		}
 	}
 
+	//the client may be offline, but coming back
+	if hub.sessions != nil {
+		return hub.sessions.store(id, frame.Bytes())
+	}
+	return message.StatusUnknown
 }
 
 func (hub *Hub) handleConnection(conn net.Conn){
 
+	defer hub.conns.Done()
+
+	//create a new socket, it gets an id after the handshake
+	s := mexsocket.NewWithOptions(0, conn, hub.opts.Socket)
+	s.SetStatBucket(hub.stats)
+
+	principal, err := hub.handshake(s, conn)
+	if err != nil {
+		log.Println("Handshake failed:", err)
+		s.Close()
+		return
+	}
+
 	//get an id from pool
-	id := hub.idPool.GetId()
+	s.Id = hub.idPool.GetId()
+	p := newPeer(s, principal)
+	p.limiter = newRateLimiter(hub.opts.RateLimit)
+
+	//resumable clients get a token together with the id
+	if hub.sessions != nil {
+		token, err := hub.sessions.open(p)
+		if err != nil {
+			log.Println("Cannot open session:", err)
+			hub.idPool.ReleaseId(p.Id())
+			s.Close()
+			return
+		}
+		p.setToken(token)
+	}
 
-	//create a new socket
-	s := mexsocket.New(id, conn)
+	//authenticated clients get the id as soon as they are accepted
+	if hub.opts.Authenticator != nil {
+		s.Send(message.NewAnswerSession(p.Id(), p.Token()))
+	}
 
 	//enable socket service goroutines
 	go s.StartReadService(mexsocket.ModeServer)
 	go s.StartWriteService()
 
-	//add socket to map
-	hub.socketMap.Set(id, s)
+	//add client to map and id to Set
+	hub.register(p)
+	hub.stats.ClientsConnected.Increase(1)
 
-	//add id to Set
-	hub.idSet.Add(id)
+	//the hub may have stopped while this client was registering
+	if hub.isClosing() {
+		s.Close()
+	}
+
+	incoming := s.Incoming()
 
 	for {
 		select{
 
-			//received a request to process
-			case mex, ok := <- s.Incoming():
-				if ok {
-					go hub.processRequest(s, mex.(*message.Request))
+			//received a request to process. A closed channel is disabled until quit
+			case mex, ok := <- incoming:
+				if !ok {
+					incoming = nil
+					break
+				}
+
+				//over its rate limits, the request may be delayed or refused
+				req := mex.(*message.Request)
+				if !hub.admit(p, req) {
+					break
+				}
+
+				//resuming changes the id of the client, and hello the protocol of the following
+				//requests, so they can't run concurrently with other requests
+				switch req.MexType {
+				case message.Resume:
+					hub.resume(p, req)
+				case message.Hello:
+					if !hub.hello(s, req) {
+						s.Close()
+					}
+				//chunks must keep their order
+				case message.Chunk:
+					hub.forwardChunk(p, req)
+				default:
+					hub.dispatch(p, req)
+				}
+
+			//a client announcing a frame too big is misbehaving: drop it
+			case err := <- s.ErrorChan():
+				if err == mexsocket.ErrFrameTooLarge {
+					log.Println("Client", p.Id(), "sent an oversized frame, disconnecting")
+					hub.stats.OversizedFrames.Increase(1)
+					s.Close()
 				}
 
 			//client is closing. Terminate loop
 			case <- s.QuitChan():
 
+				//the receivers of unfinished streams must not wait for them
+				hub.abortStreams(p)
+
 				//remove client info from structures
-				hub.socketMap.Remove(id)
-				hub.idSet.Remove(id)
+				hub.unregister(p)
+				hub.stats.ClientsDisconnected.Increase(1)
 				return
 		}
 	}
 }
 
-func (hub *Hub) processRequest(socket *mexsocket.MexSocket, req *message.Request){
+func (hub *Hub) register(p *peer) {
+
+	hub.bindLock.Lock()
+	defer hub.bindLock.Unlock()
+
+	hub.peerMap.Set(p.Id(), p)
+	hub.idSet.Add(p.Id())
+	hub.announce(p.Id(), message.NewAnswerPeerJoined(p.Id()))
+}
+
+/* Remove a disconnected client. Its id is released, unless the session
+ * keeps it for the client to resume
+ */
+func (hub *Hub) unregister(p *peer) {
+
+	hub.bindLock.Lock()
+	defer hub.bindLock.Unlock()
+
+	id := p.Id()
+
+	//the id was resumed by a newer connection, which owns it now
+	if cur, ok := hub.getPeer(id); !ok || cur != p {
+		return
+	}
+
+	hub.peerMap.Remove(id)
+	hub.idSet.Remove(id)
+	hub.announce(id, message.NewAnswerPeerLeft(id))
+
+	if hub.sessions == nil || !hub.sessions.detach(p, hub.expireSession) {
+		hub.releaseId(id)
+	}
+}
+
+//the client didn't come back in time, its id can be given to others
+func (hub *Hub) expireSession(sess *session) {
+	hub.releaseId(sess.id)
+}
+
+//forget all about the id and give it back to the pool
+func (hub *Hub) releaseId(id uint64) {
+	hub.topics.unsubscribeAll(id)
+	hub.groups.leaveAll(id)
+	hub.idPool.ReleaseId(id)
+}
+
+/* Bind the client to the session of the token, if valid, and tell the client its id.
+ * With an invalid token the client keeps the id it got on connection
+ */
+func (hub *Hub) resume(p *peer, req *message.Request) {
+
+	hub.bindLock.Lock()
+	defer hub.bindLock.Unlock()
+
+	//posted like relays, so the client gets the id before the stored relays.
+	//The client is waiting for it, so it is never dropped
+	identity := func(id uint64, token []byte) {
+		answer := message.NewAnswerSession(id, token)
+		answer.Corr = req.Corr
+		p.post(mexsocket.NewSharedFrame(answer.ToByteArray()), true)
+	}
+
+	if hub.sessions == nil {
+		identity(p.Id(), p.Token())
+		return
+	}
+
+	//the stored relays were accepted for the client: they are replayed whatever the queue policy
+	sess, ok := hub.sessions.claim(req.Body, p, func(sess *session, stored [][]byte){
+		identity(sess.id, []byte(sess.token))
+		for _, frame := range stored {
+			p.post(mexsocket.NewSharedFrame(frame), true)
+		}
+	})
+
+	if !ok {
+		identity(p.Id(), p.Token())
+		return
+	}
+
+	if sess.id == p.Id() {
+		return
+	}
+
+	//the hub may not have noticed yet that the previous connection dropped
+	if old, ok := hub.getPeer(sess.id); ok {
+		old.socket.Close()
+	}
+
+	//give back the id assigned on connection
+	newId := p.Id()
+	hub.peerMap.Remove(newId)
+	hub.idSet.Remove(newId)
+	hub.sessions.close(newId)
+	hub.releaseId(newId)
+
+	p.setId(sess.id)
+	p.setToken([]byte(sess.token))
+	hub.peerMap.Set(sess.id, p)
+	hub.idSet.Add(sess.id)
+
+	//to the others, the client joined with the id of the session
+	hub.announce(newId, message.NewAnswerPeerLeft(newId))
+	hub.announce(sess.id, message.NewAnswerPeerJoined(sess.id))
+
+	hub.stats.SessionsResumed.Increase(1)
+}
+
+/* Complete the TLS handshake and the authentication, if enabled, and returns
+ * the principal of the client. Runs before the client gets an id
+ */
+func (hub *Hub) handshake(s *mexsocket.MexSocket, conn net.Conn) (string, error) {
+
+	var principal string
+
+	if hub.opts.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(hub.opts.HandshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+
+		if err := tlsConn.Handshake(); err != nil {
+			return "", err
+		}
+
+		//only certificates verified against ClientCAs are trusted
+		state := tlsConn.ConnectionState()
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			principal = state.VerifiedChains[0][0].Subject.String()
+		}
+	}
+
+	if hub.opts.Authenticator == nil {
+		return principal, nil
+	}
+
+	authPrincipal, err := hub.authenticate(s)
+	if err == message.ErrUnsupportedVersion {
+		return "", err
+	}
+	if err != nil {
+		hub.stats.AuthFailures.Increase(1)
+		s.Send(message.NewAnswerError(message.CodeAuthFailed, ErrAuthFailed.Error()))
+		return "", err
+	}
+
+	//the authenticated identity is more specific than the certificate
+	if authPrincipal != "" {
+		principal = authPrincipal
+	}
+	return principal, nil
+}
+
+/* Forward a chunk to the receivers given when the stream was opened. Runs in the
+ * connection loop, so the chunks keep their order and, with the blocking queue
+ * policy, a slow receiver slows down the sender instead of piling up chunks
+ */
+func (hub *Hub) forwardChunk(p *peer, req *message.Request) {
+
+	if req.Flags & message.CHUNK_FIRST != 0 {
+
+		//the receivers are checked once, when the stream is opened
+		allowed, denied := hub.permitted(p, req.Receivers)
+		if denied > 0 {
+			hub.refuseReceivers(p, req, denied)
+		}
+
+		if !p.openStream(req.Stream, allowed) {
+			hub.refuse(p.socket, req, message.CodeTooManyStreams, ErrTooManyStreams)
+			return
+		}
+	}
+
+	receivers, ok := p.streamReceivers(req.Stream)
+	if !ok {
+		hub.refuse(p.socket, req, message.CodeUnknownStream, ErrUnknownStream)
+		return
+	}
+
+	if req.Flags & (message.CHUNK_LAST | message.CHUNK_ABORT) != 0 {
+		p.closeStream(req.Stream)
+	}
+
+	hub.deliver(receivers, message.NewAnswerChunk(p.Id(), req.Stream, req.Flags, req.Body))
+}
+
+//tell the receivers of the streams still open that they are broken
+func (hub *Hub) abortStreams(p *peer) {
+	for stream, receivers := range p.closeStreams() {
+		hub.deliver(receivers, message.NewAnswerChunk(p.Id(), stream, message.CHUNK_ABORT, nil))
+	}
+}
+
+/* Agree the protocol with a client saying Hello. Returns false if there is
+ * no version in common, in which case the client must be dropped
+ */
+func (hub *Hub) hello(s *mexsocket.MexSocket, req *message.Request) bool {
+
+	min, max := req.Versions()
+	protocol, err := message.NegotiateProtocol(min, max, req.Features(), hub.features())
+	if err != nil {
+		answer := message.NewAnswerError(message.CodeUnsupported, err.Error())
+		answer.Corr = req.Corr
+		s.Send(answer)
+		return false
+	}
+
+	//the client speaks the new protocol as soon as it gets the answer,
+	//which is still in the old one
+	s.SetReadProtocol(protocol)
+
+	answer := message.NewAnswerHello(protocol)
+	answer.Corr = req.Corr
+	s.Send(answer)
+
+	s.SetProtocol(protocol)
+	return true
+}
+
+//features offered to the clients
+func (hub *Hub) features() uint32 {
+
+	features := message.FeatureAcks | message.FeatureTopics | message.FeaturePresence | message.FeatureTags | message.FeatureGroups
+	if hub.opts.Socket.CompressThreshold >= 0 {
+		features |= message.FeatureCompression
+	}
+	return features
+}
+
+/* Process the request in a new goroutine, unless the hub is shutting down.
+ * Requests stamped with a sequence number are processed in order instead, see order
+ */
+func (hub *Hub) dispatch(p *peer, req *message.Request) {
+
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+
+	if hub.closing {
+		return
+	}
+
+	hub.requests.Add(1)
+
+	switch req.MexType {
+	case message.Relay, message.Broadcast, message.Publish, message.GroupRelay:
+		hub.order(p, req)
+	default:
+		go func(){
+			defer hub.requests.Done()
+			hub.processRequest(p, req)
+		}()
+	}
+}
+
+/* Queue the request behind the ones of the client still being processed. They are
+ * processed one at a time by a goroutine of the client, so the sequence numbers,
+ * and the order the receivers and the mailboxes get the relays, follow the sending order
+ */
+func (hub *Hub) order(p *peer, req *message.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.relays = append(p.relays, req)
+	if !p.relaying {
+		p.relaying = true
+		go hub.processOrdered(p)
+	}
+}
+
+//process the queued requests of the client, until there are none left
+func (hub *Hub) processOrdered(p *peer) {
+	for {
+		p.lock.Lock()
+		reqs := p.relays
+		p.relays = nil
+		if len(reqs) == 0 {
+			p.relaying = false
+		}
+		p.lock.Unlock()
+
+		if len(reqs) == 0 {
+			return
+		}
+
+		for _, req := range reqs {
+			hub.processRequest(p, req)
+			hub.requests.Done()
+		}
+	}
+}
+
+func (hub *Hub) processRequest(p *peer, req *message.Request){
 
 	if req == nil {
 		return
 	}
 
+	socket := p.socket
+
 	switch req.MexType {
 
 	//create a new answer and send it over the channel
 	case message.Identity:
-		answer := message.NewAnswerIdentity(socket.Id)
+		answer := message.NewAnswerSession(p.Id(), p.Token())
+		answer.Corr = req.Corr
 		socket.Send(answer)
 
 	//get the list of connected clients, remove the current one and send it over the channel
 	case message.List:
+		hub.bindLock.Lock()
+		hub.queueList(p, req.Corr)
+		hub.bindLock.Unlock()
+
+	//presence events are opt-in
+	case message.WatchPresence:
+		if hub.negotiated(socket, req, message.FeaturePresence) {
+			hub.watchPresence(p, req.Corr)
+		}
+
+	case message.UnwatchPresence:
+		if hub.negotiated(socket, req, message.FeaturePresence) {
+			hub.unwatchPresence(p, req.Corr)
+		}
 
-		//the resulting list is []interface{}
-		list := set.Difference(hub.idSet, set.New(socket.Id)).List()
+	//tags replace the ones registered before
+	case message.Register:
+		if !hub.negotiated(socket, req, message.FeatureTags) {
+			break
+		}
+
+		tags := req.Tags()
+		if err := metadata.Validate(tags); err != nil {
+			hub.refuse(socket, req, message.CodeInvalidTags, err)
+			break
+		}
 
-		//create new answer
-		answer := new(message.Answer) 
-		answer.MexType = message.List
-		answer.Payload = convertSetList(list)
+		p.setTags(tags)
+		answer := message.NewAnswerOk()
+		answer.Corr = req.Corr
+		socket.Send(answer)
+
+	//like List, with the tags of the clients matching the filter
+	case message.Directory:
+		if !hub.negotiated(socket, req, message.FeatureTags) {
+			break
+		}
+
+		filter, err := metadata.ParseFilter(req.Filter())
+		if err != nil {
+			hub.refuse(socket, req, message.CodeInvalidTags, err)
+			break
+		}
+
+		answer := message.NewAnswerDirectory(hub.directory(p.Id(), filter))
+		answer.Corr = req.Corr
+		socket.Send(answer)
+
+	//send a snapshot of the hub statistics
+	case message.Stat:
+		answer := message.NewAnswerStat(hub.Stats().ToByteArray())
+		answer.Corr = req.Corr
 		socket.Send(answer)
 
 	case message.Relay:
 		
-		//create an answer containing the payload
-		answer := message.NewAnswerRelay(req.Body)
+		//create an answer containing the payload, stamped with the sender identity
+		seq := socket.NextSeq()
+		answer := message.NewAnswerRelay(p.Id(), seq, req.Body)
+
+		//call hub to send the message to the clients the sender is allowed to reach
+		report, denied := hub.deliverPermitted(p, req.Receivers, answer)
+
+		if req.Ack && socket.Protocol().Has(message.FeatureAcks) {
+			ack := message.NewAnswerReport(seq, report)
+			ack.Corr = req.Corr
+			socket.Send(ack)
+		} else if denied > 0 {
+			hub.refuseReceivers(p, req, denied)
+		}
+
+	//relay to every connected client, the receivers are not listed
+	case message.Broadcast:
+		answer := message.NewAnswerRelay(p.Id(), socket.NextSeq(), req.Body)
+		if _, denied := hub.deliverPermitted(p, hub.connectedIds(p.Id(), req.Exclude), answer); denied > 0 {
+			hub.refuseReceivers(p, req, denied)
+		}
+
+	//subscriptions are kept until the id is released
+	case message.Subscribe:
+		if hub.validTopic(socket, req, topic.ValidateFilter(req.Topic)) {
+			hub.topics.subscribe(req.Topic, p.Id())
+			answer := message.NewAnswerOk()
+			answer.Corr = req.Corr
+			socket.Send(answer)
+		}
+
+	case message.Unsubscribe:
+		if hub.validTopic(socket, req, topic.ValidateFilter(req.Topic)) {
+			hub.topics.unsubscribe(req.Topic, p.Id())
+			answer := message.NewAnswerOk()
+			answer.Corr = req.Corr
+			socket.Send(answer)
+		}
+
+	//publish to a topic name, wildcards are for subscriptions only
+	case message.Publish:
+		if !hub.validTopic(socket, req, topic.ValidateName(req.Topic)) {
+			break
+		}
+		if !hub.canPublish(p, req.Topic) {
+			hub.refuse(socket, req, message.CodeDenied, ErrDenied)
+			break
+		}
+
+		answer := message.NewAnswerPublish(p.Id(), socket.NextSeq(), req.Topic, req.Body)
+		hub.deliver(hub.topics.subscribers(req.Topic), answer)
+
+	case message.CreateGroup, message.JoinGroup, message.LeaveGroup, message.GroupRelay, message.GroupMembers:
+		if hub.negotiated(socket, req, message.FeatureGroups) {
+			hub.processGroup(p, req)
+		}
+	}
+}
+
+//answer with an error if the topic of the request is malformed, or topics were not negotiated
+func (hub *Hub) validTopic(socket *mexsocket.MexSocket, req *message.Request, err error) bool {
+
+	code := message.CodeInvalidTopic
+	if !socket.Protocol().Has(message.FeatureTopics) {
+		code, err = message.CodeUnsupported, ErrUnsupported
+	}
 
-		//call hub to send the message to the list of clients provided
-		hub.Multicast(req.Receivers, answer)
+	if err == nil {
+		return true
 	}
+
+	answer := message.NewAnswerError(code, err.Error())
+	answer.Corr = req.Corr
+	socket.Send(answer)
+	return false
+}
+
+//refuse the request if the client didn't negotiate the feature it needs
+func (hub *Hub) negotiated(socket *mexsocket.MexSocket, req *message.Request, feature uint32) bool {
+
+	if socket.Protocol().Has(feature) {
+		return true
+	}
+
+	hub.refuse(socket, req, message.CodeUnsupported, ErrUnsupported)
+	return false
+}
+
+//answer the request with an error
+func (hub *Hub) refuse(socket *mexsocket.MexSocket, req *message.Request, code byte, err error) {
+	answer := message.NewAnswerError(code, err.Error())
+	answer.Corr = req.Corr
+	socket.Send(answer)
 }
 
 func convertSetList(list []interface{}) []byte {
@@ -1,15 +1,24 @@
 package hub_test
 
 import(
+	"os"
+	"bytes"
 	"net"
+	"context"
+	"crypto/tls"
 	"sync"
+	"time"
 	"strconv"
 	"testing"
+	"io/ioutil"
+	"path/filepath"
 	"github.com/stretchr/testify/assert"
 	"github.com/sech90/go-message-hub/hub"
 	"github.com/sech90/go-message-hub/message"
 	"github.com/sech90/go-message-hub/mexsocket"
 	"github.com/sech90/go-message-hub/testutils"
+	"github.com/sech90/go-message-hub/statbucket"
+	"github.com/sech90/go-message-hub/acl"
 )
 
 const(
@@ -31,13 +40,75 @@ var server *hub.Hub
 var cliList map[uint64]*Cli
 var testBody = make([]byte,bodySize)
 
+/* Start a hub with the options on a port chosen by the system, and stop it
+ * at the end of the test. Returns the hub and its port
+ */
+func startHub(t *testing.T, opts hub.Options) (*hub.Hub, int) {
+
+	h, err := hub.NewHubWithOptions(0, opts)
+	if err != nil {
+		t.Fatal("Hub should listen:", err)
+	}
+	go h.Run(context.Background())
+	t.Cleanup(h.Stop)
+
+	return h, h.Port()
+}
+
+//open a connection to the hub, without any request
+func dial(t *testing.T, port int) *mexsocket.MexSocket {
+
+	conn, err := net.Dial("tcp", addr+":"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal("Should be able to connect:", err)
+	}
+	return mexsocket.New(0, conn)
+}
+
+/* Connect to the hub and get an id. With features, the client says Hello first
+ * and speaks the protocol agreed, otherwise the original one
+ */
+func dialHub(t *testing.T, port int, features uint32) *mexsocket.MexSocket {
+
+	s := dial(t, port)
+	if features != 0 {
+		s.SetProtocol(ask(s, message.NewHelloRequest(features)).Protocol())
+	}
+	s.Id = ask(s, message.NewRequest(message.Identity)).Id()
+	return s
+}
+
+//close the connection and wait for the hub to notice the disconnection
+func disconnect(t *testing.T, h *hub.Hub, s *mexsocket.MexSocket) {
+
+	disconnected := h.Stats().ClientsDisconnected.Get()
+	s.Close()
+	assert.Eventually(t, func() bool {
+		return h.Stats().ClientsDisconnected.Get() > disconnected
+	}, time.Second * 5, time.Millisecond * 5, "Hub should notice the disconnection")
+}
+
+//send the request and wait for the answer
+func ask(s *mexsocket.MexSocket, req *message.Request) *message.Answer {
+
+	ans := new(message.Answer)
+	s.Send(req)
+	s.Read(ans)
+	return ans
+}
+
 
 func TestInit(t *testing.T){
 
+	var err error
 	cliList = make(map[uint64]*Cli)
-	server = hub.NewHub(port)
-	go server.Run()
+	server, err = hub.NewHub(port)
+	assert.Nil(t, err, "Hub should listen")
 
+	go server.Run(context.Background())
+
+	_, err = hub.NewHub(port)
+	assert.NotNil(t, err, "Port is already taken")
 }
 
 func TestCliConnect(t *testing.T){
@@ -124,6 +195,7 @@ func TestRelay(t *testing.T){
 				ans := new(message.Answer)
 				var totalMex = (cliNum-1) * messagesPerCLient
 				var i = 0
+				last := make(map[uint64]uint64)
 				defer wg.Done()
 				for ; i<totalMex; i++ {
 					n,err := cli.socket.Read(ans)
@@ -133,6 +205,9 @@ func TestRelay(t *testing.T){
 					assert.Nil(err, "Read shouldn't fail")
 					assert.Equal(message.Relay, ans.MexType, "type should be Relay")
 					assert.Nil( testutils.CompareBytes(testBody, ans.Body()), "body should be the same")
+					assert.True(testutils.IsInList(ans.Sender(), cli.peers), "sender should be one of the peers")
+					assert.Equal(last[ans.Sender()] + 1, ans.Seq(), "sequence numbers should follow the sender's order")
+					last[ans.Sender()] = ans.Seq()
 				}
 
 				assert.Equal(totalMex, i, "Message count mismatch")
@@ -142,6 +217,85 @@ func TestRelay(t *testing.T){
 	wg.Wait()
 }
 
+func TestStat(t *testing.T){
+	assert := assert.New(t)
+
+	var cli *Cli
+	for _,v := range cliList {
+		cli = v
+		break
+	}
+
+	req := message.NewRequest(message.Stat)
+	req.Corr = 11
+	cli.socket.Send(req)
+
+	ans := new(message.Answer)
+	_,err := cli.socket.Read(ans)
+	assert.Nil(err, "Answer should be valid")
+	assert.Equal(message.Stat, ans.MexType, "Answer type should be Stat")
+	assert.Equal(uint32(11), ans.Corr, "Correlation id should be echoed")
+
+	bucket := new(statbucket.StatBucket)
+	assert.Nil(bucket.FromByteArray(ans.Stats()), "Stats should be decoded")
+
+	relays := uint64(cliNum * messagesPerCLient)
+	assert.Equal(uint64(cliNum), bucket.ClientsConnected.Get(), "All the clients should be counted")
+	assert.True(bucket.IncomingMessages.Get() > relays, "Relays should be counted as incoming")
+	assert.True(bucket.OutgoingMessages.Get() >= relays * (cliNum-1), "Relays should be counted as outgoing")
+	assert.True(bucket.ByteRead.Get() > 0, "Bytes read should be counted")
+	assert.True(bucket.ByteWritten.Get() > 0, "Bytes written should be counted")
+	assert.True(bucket.TimeAlive.Get() > 0, "Uptime should be set")
+}
+
+func TestBroadcast(t *testing.T){
+	assert := assert.New(t)
+
+	var sender *Cli
+	for _,v := range cliList {
+		sender = v
+		break
+	}
+
+	//every client but the sender gets the message, then everyone does
+	for _, exclude := range []bool{true, false} {
+
+		sender.socket.Send(message.NewBroadcastRequest(testBody, exclude))
+
+		for _,v := range cliList {
+			if exclude && v == sender {
+				continue
+			}
+
+			ans := new(message.Answer)
+			_,err := v.socket.Read(ans)
+			assert.Nil(err, "Broadcast should be received")
+			assert.Equal(message.Relay, ans.MexType, "Broadcast should arrive as a relay")
+			assert.Equal(sender.id, ans.Sender(), "Sender should be preserved")
+			assert.Equal(testBody, ans.Body(), "Body should be preserved")
+		}
+	}
+}
+
+func TestOversizedFrame(t *testing.T){
+	assert := assert.New(t)
+
+	conn, err := net.Dial("tcp", addr+":"+strconv.Itoa(port)) 
+	assert.Nil(err, "Should be able to connect")
+
+	//announce a frame of 4GiB
+	conn.Write([]byte{0xff, 0xff, 0xff, 0xff})
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(err, "Hub should close the connection")
+
+	//the socket may close before the hub updates the counter
+	assert.Eventually(func() bool {
+		return server.Stats().OversizedFrames.Get() > 0
+	}, time.Second, time.Millisecond * 5, "Offender should be counted")
+	assert.Equal(uint64(1), server.Stats().OversizedFrames.Get(), "Offender should be counted once")
+}
+
 func TestDisconnect(t *testing.T){
 	
 	server.Stop()
@@ -155,3 +309,939 @@ func TestDisconnect(t *testing.T){
 
 
 
+
+func TestShutdown(t *testing.T){
+	assert := assert.New(t)
+
+	const relays = 20
+
+	//the hub is run here, to check what Run returns
+	h, err := hub.NewHub(0)
+	assert.Nil(err, "Hub should listen")
+	shutdownPort := h.Port()
+
+	done := make(chan error)
+	go func(){ done <- h.Run(context.Background()) }()
+
+	sender, receiver := dialHub(t, shutdownPort, 0), dialHub(t, shutdownPort, 0)
+
+	//the receiver doesn't read until the hub is shutting down
+	mex := message.NewRelayRequest([]uint64{receiver.Id}, testBody)
+	for i := 0; i < relays; i++ {
+		sender.Send(mex)
+	}
+
+	//the identities and the relays are on their way
+	assert.Eventually(func() bool {
+		return h.Stats().OutgoingMessages.Get() >= 2 + relays
+	}, time.Second * 5, time.Millisecond * 5, "Relays should be sent")
+
+	shut := make(chan error)
+	go func(){
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+		defer cancel()
+		shut <- h.Shutdown(ctx)
+	}()
+
+	ans := new(message.Answer)
+	for i := 0; i < relays; i++ {
+		_, err := receiver.Read(ans)
+		assert.Nil(err, "Pending relays should be delivered")
+		assert.Equal(message.Relay, ans.Type(), "Pending relays should be delivered")
+	}
+
+	_, err = receiver.Read(ans)
+	assert.Nil(err, "Shutdown notice should be delivered")
+	assert.Equal(message.Shutdown, ans.Type(), "Clients should be notified")
+
+	assert.Nil(<- shut, "Shutdown should complete in time")
+	assert.Equal(hub.ErrHubClosed, <- done, "Run should return after shutdown")
+
+	_, err = receiver.Read(ans)
+	assert.NotNil(err, "Connection should be closed")
+
+	//a cancelled context stops the hub as well
+	h, err = hub.NewHub(shutdownPort)
+	assert.Nil(err, "Port should be released")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func(){ done <- h.Run(ctx) }()
+	cancel()
+	assert.Equal(context.Canceled, <- done, "Run should return the context error")
+}
+
+func TestIdRelease(t *testing.T){
+	assert := assert.New(t)
+
+	var h *hub.Hub
+	var idPort int
+
+	//connect, get the id and disconnect
+	getId := func() uint64 {
+		s := dial(t, idPort)
+		ans := ask(s, message.NewRequest(message.Identity))
+
+		//the disconnection releases the id
+		disconnect(t, h, s)
+		return ans.Id()
+	}
+
+	opts := hub.DefaultOptions()
+	opts.IdQuarantine = 0
+	h, idPort = startHub(t, opts)
+
+	first := getId()
+	assert.Equal(first, getId(), "Released id should be reused")
+	h.Stop()
+
+	opts.IdPolicy = hub.IdPolicyIncremental
+	h, idPort = startHub(t, opts)
+
+	first = getId()
+	assert.NotEqual(first, getId(), "Incremental ids should not be reused")
+	h.Stop()
+}
+
+func TestTLS(t *testing.T){
+	assert := assert.New(t)
+
+	pki, err := testutils.NewTestPKI("test-client")
+	assert.Nil(err, "Certificates should be generated")
+
+	opts := hub.DefaultOptions()
+	opts.TLSConfig = pki.ServerConfig()
+	h, tlsPort := startHub(t, opts)
+
+	conn, err := tls.Dial("tcp", addr+":"+strconv.Itoa(tlsPort), pki.ClientConfig())
+	assert.Nil(err, "Client with certificate should connect")
+
+	s := mexsocket.New(0, conn)
+	ans := new(message.Answer)
+	s.Send(message.NewRequest(message.Identity))
+	_, err = s.Read(ans)
+	assert.Nil(err, "Client should get an id")
+
+	principal, ok := h.Principal(ans.Id())
+	assert.True(ok, "Client should be connected")
+	assert.Equal("CN=test-client", principal, "Certificate subject should be the principal")
+	s.Close()
+
+	//without a client certificate the hub refuses the connection
+	noCert := pki.ClientConfig()
+	noCert.Certificates = nil
+	conn, err = tls.Dial("tcp", addr+":"+strconv.Itoa(tlsPort), noCert)
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	assert.NotNil(err, "Client without certificate should be refused")
+}
+
+func TestAuth(t *testing.T){
+	assert := assert.New(t)
+
+	opts := hub.DefaultOptions()
+	opts.Authenticator = hub.NewTokenAuthenticator(map[string]string{"good-token": "worker"})
+	h, authPort := startHub(t, opts)
+
+	authenticate := func(token string) *message.Answer {
+		s := dial(t, authPort)
+
+		challenge := new(message.Answer)
+		_, err := s.Read(challenge)
+		assert.Nil(err, "Hub should send a challenge")
+		assert.Equal(message.Auth, challenge.Type(), "First answer should be the challenge")
+		assert.Len(challenge.Nonce(), message.NONCE_SIZE, "Challenge should carry a nonce")
+
+		s.Send(message.NewAuthRequest([]byte(token)))
+		ans := new(message.Answer)
+		_, err = s.Read(ans)
+		assert.Nil(err, "Hub should answer the credential")
+		return ans
+	}
+
+	ans := authenticate("bad-token")
+	assert.Equal(message.Error, ans.Type(), "Bad token should be rejected")
+	assert.Equal(message.CodeAuthFailed, ans.ErrorCode(), "Rejection should tell the reason")
+	assert.Equal(uint64(1), h.Stats().AuthFailures.Get(), "Failure should be counted")
+
+	ans = authenticate("good-token")
+	assert.Equal(message.Identity, ans.Type(), "Good token should get an id")
+
+	principal, ok := h.Principal(ans.Id())
+	assert.True(ok, "Client should be connected")
+	assert.Equal("worker", principal, "Token principal should be stored")
+}
+
+func TestSession(t *testing.T){
+	assert := assert.New(t)
+
+	opts := hub.DefaultOptions()
+	opts.SessionTTL = 200 * time.Millisecond
+	h, sessionPort := startHub(t, opts)
+
+	//connect and send the request, returns the identity answer
+	connect := func(req *message.Request) (*mexsocket.MexSocket, *message.Answer) {
+		s := dial(t, sessionPort)
+		return s, ask(s, req)
+	}
+
+	s, first := connect(message.NewRequest(message.Identity))
+	assert.Len(first.Token(), hub.TOKEN_SIZE, "Hub should issue a session token")
+	disconnect(t, h, s)
+
+	s, ans := connect(message.NewResumeRequest(first.Token()))
+	assert.Equal(first.Id(), ans.Id(), "Resumed session should keep the id")
+	assert.Equal(first.Token(), ans.Token(), "Resumed session should keep the token")
+	assert.Equal(uint64(1), h.Stats().SessionsResumed.Get(), "Resumption should be counted")
+
+	//a new connection can take over a session whose connection is still open
+	other, ans := connect(message.NewResumeRequest(first.Token()))
+	assert.Equal(first.Id(), ans.Id(), "Session should be taken over")
+	_, err := s.Read(new(message.Answer))
+	assert.NotNil(err, "Previous connection should be closed")
+
+	_, ans = connect(message.NewResumeRequest([]byte("not a token")))
+	assert.NotEqual(first.Id(), ans.Id(), "Unknown token should get a new id")
+
+	//after the ttl the session is gone
+	other.Close()
+	time.Sleep(opts.SessionTTL * 2)
+	_, ans = connect(message.NewResumeRequest(first.Token()))
+	assert.NotEqual(first.Id(), ans.Id(), "Expired session should not be resumed")
+}
+
+func TestMailbox(t *testing.T){
+	assert := assert.New(t)
+
+	opts := hub.DefaultOptions()
+	opts.SessionTTL = 5 * time.Second
+	opts.Mailbox = hub.MailboxOptions{MaxMessages: 2}
+	h, mailboxPort := startHub(t, opts)
+
+	connect := func(req *message.Request) (*mexsocket.MexSocket, *message.Answer) {
+		s := dial(t, mailboxPort)
+		return s, ask(s, req)
+	}
+
+	sender, _ := connect(message.NewRequest(message.Identity))
+	receiver, first := connect(message.NewRequest(message.Identity))
+	disconnect(t, h, receiver)
+
+	//the mailbox keeps only the last two
+	for i := byte(1); i <= 3; i++ {
+		sender.Send(message.NewRelayRequest([]uint64{first.Id()}, []byte{i}))
+	}
+	assert.Eventually(func() bool {
+		return h.Stats().StoredMessages.Get() == 3
+	}, time.Second * 5, time.Millisecond * 5, "Relays should be stored")
+
+	receiver, ans := connect(message.NewResumeRequest(first.Token()))
+	assert.Equal(first.Id(), ans.Id(), "Session should be resumed")
+
+	for i := byte(2); i <= 3; i++ {
+		relay := new(message.Answer)
+		_, err := receiver.Read(relay)
+		assert.Nil(err, "Stored relay should be delivered")
+		assert.Equal([]byte{i}, relay.Body(), "Stored relays should be delivered in order")
+	}
+
+	assert.Equal(uint64(3), h.Stats().StoredMessages.Get(), "Stored relays should be counted")
+	assert.Equal(uint64(1), h.Stats().DroppedMessages.Get(), "Evicted relays should be counted")
+
+	//relays to a connected client are not stored
+	sender.Send(message.NewRelayRequest([]uint64{first.Id()}, []byte{4}))
+	relay := new(message.Answer)
+	receiver.Read(relay)
+	assert.Equal([]byte{4}, relay.Body(), "Live relays should be delivered directly")
+	assert.Equal(uint64(3), h.Stats().StoredMessages.Get(), "Live relays should not be stored")
+
+	sender.Close()
+	receiver.Close()
+
+	//a mailbox larger than the socket queue is replayed whole, whatever the queue policy.
+	//The relays are sent at once: they are stored in the order they were sent
+	const stored = 100
+	opts.Socket.QueueSize = 2
+	opts.Socket.QueuePolicy = mexsocket.PolicyDisconnect
+	opts.Mailbox = hub.MailboxOptions{MaxMessages: stored}
+	h, mailboxPort = startHub(t, opts)
+
+	sender, _ = connect(message.NewRequest(message.Identity))
+	receiver, first = connect(message.NewRequest(message.Identity))
+	disconnect(t, h, receiver)
+
+	for i := byte(1); i <= stored; i++ {
+		sender.Send(message.NewRelayRequest([]uint64{first.Id()}, []byte{i}))
+	}
+	assert.Eventually(func() bool {
+		return h.Stats().StoredMessages.Get() == stored
+	}, time.Second * 5, time.Millisecond * 5, "Relays should be stored")
+
+	receiver, ans = connect(message.NewResumeRequest(first.Token()))
+	assert.Equal(message.Identity, ans.Type(), "Identity should not be dropped")
+	assert.Equal(first.Id(), ans.Id(), "Session should be resumed")
+
+	for i := byte(1); i <= stored; i++ {
+		relay := new(message.Answer)
+		_, err := receiver.Read(relay)
+		assert.Nil(err, "Resuming client should not be disconnected")
+		assert.Equal([]byte{i}, relay.Body(), "Stored relays should be delivered in order")
+	}
+
+	sender.Close()
+	receiver.Close()
+
+	//a relay sent while the replay is still being queued waits behind it, and it is reported
+	//as queued. The replay doesn't fit in the connection buffers, so it waits for the receiver
+	const large = 20
+	opts.Socket.QueuePolicy = mexsocket.PolicyBlock
+	opts.Mailbox = hub.MailboxOptions{MaxMessages: large}
+	h, mailboxPort = startHub(t, opts)
+
+	sender, _ = connect(message.NewRequest(message.Identity))
+	receiver, first = connect(message.NewRequest(message.Identity))
+	disconnect(t, h, receiver)
+
+	body := make([]byte, message.MAX_PAYLOAD)
+	for i := 0; i < large; i++ {
+		sender.Send(message.NewRelayRequest([]uint64{first.Id()}, body))
+	}
+	assert.Eventually(func() bool {
+		return h.Stats().StoredMessages.Get() == large
+	}, time.Second * 5, time.Millisecond * 5, "Relays should be stored")
+
+	receiver, _ = connect(message.NewResumeRequest(first.Token()))
+
+	req := message.NewRelayRequest([]uint64{first.Id()}, []byte{1})
+	req.Ack = true
+	assert.Equal([]message.Delivery{
+		{Id: first.Id(), Status: message.StatusQueued},
+	}, ask(sender, req).Report(), "Relay behind the replay should not be reported as delivered")
+
+	for i := 0; i < large; i++ {
+		receiver.Read(relay)
+	}
+	_, err := receiver.Read(relay)
+	assert.Nil(err, "Queued relay should be delivered")
+	assert.Equal([]byte{1}, relay.Body(), "Queued relay should follow the replay")
+
+	sender.Close()
+	receiver.Close()
+}
+
+func TestAck(t *testing.T){
+	assert := assert.New(t)
+
+	_, ackPort := startHub(t, hub.DefaultOptions())
+
+	sender, receiver := dialHub(t, ackPort, 0), dialHub(t, ackPort, 0)
+	const unknownId = 12345
+
+	req := message.NewRelayRequest([]uint64{receiver.Id, unknownId}, testBody)
+	req.Ack = true
+	req.Corr = 3
+	sender.Send(req)
+
+	ans := new(message.Answer)
+	_, err := sender.Read(ans)
+	assert.Nil(err, "Sender should get a report")
+	assert.Equal(message.Report, ans.Type(), "Answer should be a report")
+	assert.Equal(uint32(3), ans.Corr, "Correlation id should be echoed")
+	assert.Equal([]message.Delivery{
+		{Id: receiver.Id, Status: message.StatusDelivered},
+		{Id: unknownId, Status: message.StatusUnknown},
+	}, ans.Report(), "Every receiver should be reported")
+
+	relay := new(message.Answer)
+	receiver.Read(relay)
+	assert.Equal(ans.Seq(), relay.Seq(), "Report should refer to the delivered relay")
+
+	//relays wider than 255 receivers use the varint format
+	wide := []uint64{receiver.Id}
+	for i := uint64(0); i < 500; i++ {
+		wide = append(wide, unknownId + i)
+	}
+	req = message.NewRelayRequest(wide, testBody)
+	req.Ack = true
+	sender.Send(req)
+
+	sender.Read(ans)
+	assert.Equal(message.Report, ans.Type(), "Answer should be a report")
+	assert.Len(ans.Report(), len(wide), "Every receiver should be reported")
+	assert.Equal(message.StatusDelivered, ans.Report()[0].Status, "Receiver should get the wide relay")
+
+	receiver.Read(relay)
+	assert.Equal(ans.Seq(), relay.Seq(), "Report should refer to the wide relay")
+
+	sender.Close()
+	receiver.Close()
+}
+
+func TestTopics(t *testing.T){
+	assert := assert.New(t)
+
+	_, topicPort := startHub(t, hub.DefaultOptions())
+
+	//send the request and wait for the confirmation
+	confirm := func(s *mexsocket.MexSocket, req *message.Request) {
+		assert.Equal(message.Ok, ask(s, req).Type(), "Request should be confirmed")
+	}
+
+	publisher, subscriber, other := dialHub(t, topicPort, 0), dialHub(t, topicPort, 0), dialHub(t, topicPort, 0)
+	confirm(subscriber, message.NewSubscribeRequest("news"))
+	confirm(other, message.NewSubscribeRequest("sport"))
+
+	publisher.Send(message.NewPublishRequest("news", testBody))
+	ans := new(message.Answer)
+	subscriber.Read(ans)
+	assert.Equal(message.Publish, ans.Type(), "Subscriber should get the message")
+	assert.Equal("news", ans.Topic(), "Topic should be preserved")
+	assert.Equal(publisher.Id, ans.Sender(), "Publisher should be the sender")
+	assert.Equal(testBody, ans.Body(), "Body should be preserved")
+
+	//after unsubscribing only the relay arrives
+	confirm(subscriber, message.NewUnsubscribeRequest("news"))
+	publisher.Send(message.NewPublishRequest("news", testBody))
+	publisher.Send(message.NewRelayRequest([]uint64{subscriber.Id, other.Id}, testBody))
+
+	subscriber.Read(ans)
+	assert.Equal(message.Relay, ans.Type(), "Unsubscribed client should not get the message")
+	other.Read(ans)
+	assert.Equal(message.Relay, ans.Type(), "Other topics should not get the message")
+
+	//overlapping filters deliver the message once
+	confirm(subscriber, message.NewSubscribeRequest("sensors/+/temp"))
+	confirm(subscriber, message.NewSubscribeRequest("sensors/#"))
+	publisher.Send(message.NewPublishRequest("sensors/kitchen/temp", testBody))
+
+	subscriber.Read(ans)
+	assert.Equal(message.Publish, ans.Type(), "Wildcard subscriber should get the message")
+	assert.Equal("sensors/kitchen/temp", ans.Topic(), "Topic name should be preserved")
+
+	//a duplicate would arrive before the relay
+	publisher.Send(message.NewRelayRequest([]uint64{subscriber.Id}, testBody))
+	subscriber.Read(ans)
+	assert.Equal(message.Relay, ans.Type(), "Message should be delivered once")
+
+	//malformed topics are refused
+	subscriber.Send(message.NewSubscribeRequest("sensors/#/temp"))
+	subscriber.Read(ans)
+	assert.Equal(message.Error, ans.Type(), "Malformed filter should be refused")
+	assert.Equal(message.CodeInvalidTopic, ans.ErrorCode(), "Error should tell the topic is invalid")
+
+	publisher.Send(message.NewPublishRequest("sensors/+/temp", testBody))
+	publisher.Read(ans)
+	assert.Equal(message.CodeInvalidTopic, ans.ErrorCode(), "Wildcards should be refused when publishing")
+
+	publisher.Close()
+	subscriber.Close()
+	other.Close()
+}
+
+func TestHello(t *testing.T){
+	assert := assert.New(t)
+
+	opts := hub.DefaultOptions()
+	opts.Socket.CompressThreshold = -1
+	_, helloPort := startHub(t, opts)
+
+	s := dial(t, helloPort)
+
+	//the hub picks its highest version and the common features
+	s.Send(message.NewHelloRequest(message.FeatureAcks | message.FeatureCompression))
+	ans := new(message.Answer)
+	_, err := s.Read(ans)
+	assert.Nil(err, "Hub should answer the hello")
+	assert.Equal(message.Hello, ans.Type(), "Answer should be a hello")
+	assert.Equal(message.Protocol{Version: message.MAX_PROTOCOL_VERSION, Features: message.FeatureAcks}, ans.Protocol(), "Protocol should be negotiated")
+	s.SetProtocol(ans.Protocol())
+
+	//features not negotiated are refused
+	s.Send(message.NewSubscribeRequest("news"))
+	s.Read(ans)
+	assert.Equal(message.Error, ans.Type(), "Topics were not negotiated")
+	assert.Equal(message.CodeUnsupported, ans.ErrorCode(), "Error should tell the feature is not supported")
+
+	s.Send(message.NewRequest(message.Identity))
+	s.Read(ans)
+	assert.Equal(message.Identity, ans.Type(), "Other requests should work in the new protocol")
+	s.Close()
+
+	//a client with no version in common is dropped
+	s = dial(t, helloPort)
+
+	s.Send(&message.Request{MexType: message.Hello, Body: []byte{9, 9, 0, 0, 0, 0}})
+	s.Read(ans)
+	assert.Equal(message.CodeUnsupported, ans.ErrorCode(), "Unknown versions should be refused")
+	_, err = s.Read(ans)
+	assert.NotNil(err, "Connection should be closed")
+	s.Close()
+}
+
+func TestCompression(t *testing.T){
+	assert := assert.New(t)
+
+	_, compressionPort := startHub(t, hub.DefaultOptions())
+
+	packed, plain := dialHub(t, compressionPort, message.FeatureCompression), dialHub(t, compressionPort, 0)
+	assert.True(packed.Protocol().Has(message.FeatureCompression), "Compression should be negotiated")
+
+	//the same relay reaches one receiver compressed and the other plain
+	body := bytes.Repeat([]byte("compressible "), 1000)
+	packed.Send(message.NewRelayRequest([]uint64{packed.Id, plain.Id}, body))
+
+	for _, s := range []*mexsocket.MexSocket{packed, plain} {
+		b, n, err := s.ReadBytes()
+		assert.Nil(err, "Relay should be read")
+
+		ans := new(message.Answer)
+		assert.Nil(ans.FromByteArray(b), "Relay should decode")
+		assert.Equal(body, ans.Body(), "Body should be preserved")
+		assert.Equal(s == packed, n < len(body), "Only the negotiating client should get it compressed")
+	}
+
+	packed.Close()
+	plain.Close()
+
+	//one relay reaches several clients, one of them still queueing the replay of its mailbox:
+	//the frame is compressed once for all of them. The replay can't be compressed and doesn't
+	//fit in the connection buffers, so it waits for the client to read it
+	const stored, relays = 20, 5
+	opts := hub.DefaultOptions()
+	opts.SessionTTL = 5 * time.Second
+	opts.Mailbox = hub.MailboxOptions{MaxMessages: stored}
+	h, sessionPort := startHub(t, opts)
+
+	sender := dialHub(t, sessionPort, message.FeatureCompression)
+	slow := dial(t, sessionPort)
+	first := ask(slow, message.NewRequest(message.Identity))
+	disconnect(t, h, slow)
+
+	noise := testutils.GenPayload(message.MAX_PAYLOAD)
+	for i := 0; i < stored; i++ {
+		sender.Send(message.NewRelayRequest([]uint64{first.Id()}, noise))
+	}
+	assert.Eventually(func() bool {
+		return h.Stats().StoredMessages.Get() == stored
+	}, time.Second * 5, time.Millisecond * 5, "Relays should be stored")
+
+	slow = dial(t, sessionPort)
+	slow.SetProtocol(ask(slow, message.NewHelloRequest(message.FeatureCompression)).Protocol())
+	assert.Equal(first.Id(), ask(slow, message.NewResumeRequest(first.Token())).Id(), "Session should be resumed")
+
+	receivers := []*mexsocket.MexSocket{slow}
+	ids := []uint64{first.Id()}
+	for i := 0; i < 3; i++ {
+		s := dialHub(t, sessionPort, message.FeatureCompression)
+		receivers = append(receivers, s)
+		ids = append(ids, s.Id)
+	}
+
+	for i := 0; i < relays; i++ {
+		sender.Send(message.NewRelayRequest(ids, body))
+	}
+
+	for _, s := range receivers {
+		if s == slow {
+			for i := 0; i < stored; i++ {
+				s.ReadBytes()
+			}
+		}
+
+		for i := 0; i < relays; i++ {
+			b, n, err := s.ReadBytes()
+			assert.Nil(err, "Relay should be read")
+
+			ans := new(message.Answer)
+			assert.Nil(ans.FromByteArray(b), "Relay should decode")
+			assert.Equal(body, ans.Body(), "Body should be preserved")
+			assert.True(n < len(body), "Relay should be compressed")
+		}
+		s.Close()
+	}
+	sender.Close()
+}
+
+func TestStream(t *testing.T){
+	assert := assert.New(t)
+
+	_, streamPort := startHub(t, hub.DefaultOptions())
+
+	sender, receiver := dialHub(t, streamPort, 0), dialHub(t, streamPort, 0)
+
+	//only the first chunk names the receivers, the others follow it in order
+	chunks := []*message.Request{
+		message.NewChunkRequest(1, message.CHUNK_FIRST, []uint64{receiver.Id}, testBody),
+		message.NewChunkRequest(1, 0, nil, []byte("second")),
+		message.NewChunkRequest(1, message.CHUNK_LAST, nil, []byte("third")),
+	}
+	for _, req := range chunks {
+		sender.Send(req)
+	}
+
+	ans := new(message.Answer)
+	for _, req := range chunks {
+		_, err := receiver.Read(ans)
+		assert.Nil(err, "Chunk should be forwarded")
+		assert.Equal(message.Chunk, ans.Type(), "Answer should be a chunk")
+		assert.Equal(sender.Id, ans.Sender(), "Sender should be stamped")
+		assert.Equal(uint32(1), ans.Stream(), "Stream should be preserved")
+		assert.Equal(req.Flags, ans.ChunkFlags(), "Flags should be preserved")
+		assert.Equal(req.Body, ans.Body(), "Chunks should arrive in order")
+	}
+
+	//the stream is closed after the last chunk
+	req := message.NewChunkRequest(1, 0, nil, []byte("late"))
+	req.Corr = 5
+	sender.Send(req)
+	sender.Read(ans)
+	assert.Equal(message.Error, ans.Type(), "Closed stream should be refused")
+	assert.Equal(message.CodeUnknownStream, ans.ErrorCode(), "Error should tell the stream is unknown")
+	assert.Equal(uint32(5), ans.Corr, "Correlation id should be echoed")
+
+	//a sender leaving in the middle of a stream aborts it
+	sender.Send(message.NewChunkRequest(2, message.CHUNK_FIRST, []uint64{receiver.Id}, testBody))
+	receiver.Read(ans)
+	assert.Equal(message.CHUNK_FIRST, ans.ChunkFlags(), "Stream should be opened")
+	sender.Close()
+
+	_, err := receiver.Read(ans)
+	assert.Nil(err, "Receiver should be told")
+	assert.Equal(uint32(2), ans.Stream(), "Open stream should be aborted")
+	assert.Equal(message.CHUNK_ABORT, ans.ChunkFlags(), "Stream should be aborted")
+
+	//the hub limits the streams open at the same time
+	sender = dialHub(t, streamPort, 0)
+	for i := uint32(0); i < hub.MAX_OPEN_STREAMS; i++ {
+		sender.Send(message.NewChunkRequest(i, message.CHUNK_FIRST, nil, nil))
+	}
+	req = message.NewChunkRequest(hub.MAX_OPEN_STREAMS, message.CHUNK_FIRST, nil, nil)
+	req.Corr = 6
+	sender.Send(req)
+	sender.Read(ans)
+	assert.Equal(message.CodeTooManyStreams, ans.ErrorCode(), "Error should tell the limit is reached")
+	assert.Equal(uint32(6), ans.Corr, "Correlation id should be echoed")
+
+	sender.Close()
+	receiver.Close()
+}
+
+func TestPresence(t *testing.T){
+	assert := assert.New(t)
+
+	_, presencePort := startHub(t, hub.DefaultOptions())
+
+	connect := func(features uint32) *mexsocket.MexSocket {
+		return dialHub(t, presencePort, features)
+	}
+
+	watcher, other := connect(message.FeaturePresence), connect(0)
+
+	//the answer to the opt-in is the list of the other clients
+	req := message.NewRequest(message.WatchPresence)
+	req.Corr = 4
+	watcher.Send(req)
+
+	ans := new(message.Answer)
+	watcher.Read(ans)
+	assert.Equal(message.List, ans.Type(), "Watcher should get the connected clients")
+	assert.Equal(uint32(4), ans.Corr, "Correlation id should be echoed")
+	assert.Equal([]uint64{other.Id}, ans.List(), "List should not include the watcher")
+
+	joined := connect(0)
+	watcher.Read(ans)
+	assert.Equal(message.PeerJoined, ans.Type(), "Watcher should be told about new clients")
+	assert.Equal(joined.Id, ans.Peer(), "Event should carry the new id")
+
+	joined.Close()
+	watcher.Read(ans)
+	assert.Equal(message.PeerLeft, ans.Type(), "Watcher should be told about leaving clients")
+	assert.Equal(joined.Id, ans.Peer(), "Event should carry the old id")
+
+	//clients not watching get no event, and can't watch without negotiating it
+	other.Send(message.NewRequest(message.WatchPresence))
+	other.Read(ans)
+	assert.Equal(message.Error, ans.Type(), "Presence was not negotiated")
+	assert.Equal(message.CodeUnsupported, ans.ErrorCode(), "Error should tell the feature is not supported")
+
+	//after opting out the watcher gets only what it asks for
+	watcher.Send(message.NewRequest(message.UnwatchPresence))
+	watcher.Read(ans)
+	assert.Equal(message.Ok, ans.Type(), "Opt-out should be confirmed")
+
+	connect(0).Close()
+	watcher.Send(message.NewRequest(message.List))
+	watcher.Read(ans)
+	assert.Equal(message.List, ans.Type(), "No event should arrive after opting out")
+
+	watcher.Close()
+	other.Close()
+}
+
+func TestDirectory(t *testing.T){
+	assert := assert.New(t)
+
+	_, directoryPort := startHub(t, hub.DefaultOptions())
+
+	connect := func() *mexsocket.MexSocket {
+		return dialHub(t, directoryPort, message.FeatureTags)
+	}
+
+	pricing, billing, asker := connect(), connect(), connect()
+	legacy := dialHub(t, directoryPort, 0)
+
+	worker := map[string]string{"name": "pricing", "role": "worker", "version": "1.4"}
+	assert.Equal(message.Ok, ask(pricing, message.NewRegisterRequest(worker)).Type(), "Tags should be registered")
+	assert.Equal(message.Ok, ask(billing, message.NewRegisterRequest(map[string]string{"name": "billing", "role": "worker"})).Type(), "Tags should be registered")
+
+	ans := ask(asker, message.NewDirectoryRequest("role=worker version=1.*"))
+	assert.Equal(message.Directory, ans.Type(), "Answer should be a directory")
+	assert.Equal([]message.PeerInfo{{Id: pricing.Id, Tags: worker}}, ans.Directory(), "Only the matching client should be listed")
+
+	//an empty filter lists every other client, with or without tags
+	ans = ask(asker, message.NewDirectoryRequest(""))
+	assert.Len(ans.Directory(), 3, "Every other client should be listed")
+
+	//registering again replaces the tags
+	ask(pricing, message.NewRegisterRequest(map[string]string{"name": "pricing"}))
+	ans = ask(asker, message.NewDirectoryRequest("role=worker"))
+	assert.Equal([]message.PeerInfo{{Id: billing.Id, Tags: map[string]string{"name": "billing", "role": "worker"}}}, ans.Directory(), "Old tags should be forgotten")
+
+	ans = ask(asker, message.NewDirectoryRequest("role=wo*rk"))
+	assert.Equal(message.CodeInvalidTags, ans.ErrorCode(), "Malformed filter should be refused")
+
+	ans = ask(pricing, message.NewRegisterRequest(map[string]string{"name": "two words"}))
+	assert.Equal(message.CodeInvalidTags, ans.ErrorCode(), "Invalid tags should be refused")
+
+	ans = ask(legacy, message.NewDirectoryRequest(""))
+	assert.Equal(message.CodeUnsupported, ans.ErrorCode(), "Tags were not negotiated")
+
+	pricing.Close()
+	billing.Close()
+	asker.Close()
+	legacy.Close()
+}
+
+func TestGroups(t *testing.T){
+	assert := assert.New(t)
+
+	h, groupPort := startHub(t, hub.DefaultOptions())
+
+	connect := func() *mexsocket.MexSocket {
+		return dialHub(t, groupPort, message.FeatureGroups)
+	}
+
+	owner, member, outsider := connect(), connect(), connect()
+
+	assert.Equal(message.Ok, ask(owner, message.NewCreateGroupRequest("room", 2, true)).Type(), "Group should be created")
+	assert.Equal(message.CodeGroupExists, ask(member, message.NewCreateGroupRequest("room", 0, false)).ErrorCode(), "Names are unique")
+	assert.Equal(message.Ok, ask(member, message.NewGroupRequest(message.JoinGroup, "room")).Type(), "Group should be joined")
+	assert.Equal(message.CodeGroupFull, ask(outsider, message.NewGroupRequest(message.JoinGroup, "room")).ErrorCode(), "Limit should be enforced")
+
+	members, ok := h.GroupMembers("room")
+	assert.True(ok, "Group should exist")
+	assert.Equal([]uint64{owner.Id, member.Id}, members, "Members should be listed")
+	assert.Equal(members, ask(outsider, message.NewGroupRequest(message.GroupMembers, "room")).List(), "Anyone can list the members")
+
+	//the group relay reaches the other members only
+	owner.Send(message.NewGroupRelayRequest("room", testBody))
+	ans := new(message.Answer)
+	member.Read(ans)
+	assert.Equal(message.GroupRelay, ans.Type(), "Member should get the message")
+	assert.Equal("room", ans.Group(), "Group should be preserved")
+	assert.Equal(owner.Id, ans.Sender(), "Sender should be stamped")
+	assert.Equal(testBody, ans.Body(), "Body should be preserved")
+
+	req := message.NewGroupRelayRequest("room", testBody)
+	req.Corr = 6
+	ans = ask(outsider, req)
+	assert.Equal(message.CodeNotMember, ans.ErrorCode(), "Only members can send to the group")
+	assert.Equal(uint32(6), ans.Corr, "Correlation id should be echoed")
+
+	//the group closes when the owner leaves
+	assert.Equal(message.Ok, ask(owner, message.NewGroupRequest(message.LeaveGroup, "room")).Type(), "Owner should leave")
+	_, ok = h.GroupMembers("room")
+	assert.False(ok, "Owned group should be closed")
+	assert.Equal(message.CodeUnknownGroup, ask(member, message.NewGroupRequest(message.LeaveGroup, "room")).ErrorCode(), "Group should not exist")
+
+	//an unowned group lives until its last member disconnects
+	ask(member, message.NewCreateGroupRequest("lobby", 0, false))
+	ask(outsider, message.NewGroupRequest(message.JoinGroup, "lobby"))
+	assert.Equal(message.Ok, ask(member, message.NewGroupRequest(message.LeaveGroup, "lobby")).Type(), "Creator should leave")
+	assert.Equal(message.CodeNotMember, ask(member, message.NewGroupRequest(message.LeaveGroup, "lobby")).ErrorCode(), "Leaving twice")
+
+	outsider.Close()
+	assert.Eventually(func() bool {
+		_, ok := h.GroupMembers("lobby")
+		return !ok
+	}, time.Second * 5, time.Millisecond * 5, "Empty group should be closed")
+
+	owner.Close()
+	member.Close()
+}
+
+func TestRateLimit(t *testing.T){
+	assert := assert.New(t)
+
+	start := func(limits hub.RateLimitOptions) (*hub.Hub, *mexsocket.MexSocket) {
+		opts := hub.DefaultOptions()
+		opts.RateLimit = limits
+		h, port := startHub(t, opts)
+		return h, dial(t, port)
+	}
+
+	//over the budget, requests are refused
+	h, s := start(hub.RateLimitOptions{Messages: 5, Policy: hub.RatePolicyReject})
+	for i := 0; i < 8; i++ {
+		s.Send(message.NewRequest(message.Identity))
+	}
+
+	refused := 0
+	ans := new(message.Answer)
+	for i := 0; i < 8; i++ {
+		s.Read(ans)
+		if ans.Type() == message.Error {
+			assert.Equal(message.CodeRateLimited, ans.ErrorCode(), "Error should tell the rate is exceeded")
+			refused++
+		}
+	}
+	assert.Equal(3, refused, "Requests over the burst should be refused")
+	assert.Equal(uint64(3), h.Stats().RateLimited.Get(), "Limit hits should be counted")
+	s.Close()
+	h.Stop()
+
+	//or delayed, at the rate of the budget
+	h, s = start(hub.RateLimitOptions{Messages: 20, Burst: 100 * time.Millisecond})
+	begin := time.Now()
+	for i := 0; i < 6; i++ {
+		s.Send(message.NewRequest(message.Identity))
+	}
+	for i := 0; i < 6; i++ {
+		s.Read(ans)
+		assert.Equal(message.Identity, ans.Type(), "Delayed requests should be processed")
+	}
+	assert.True(time.Since(begin) >= 150 * time.Millisecond, "Requests over the burst should be delayed")
+	assert.True(h.Stats().RateLimited.Get() > 0, "Limit hits should be counted")
+	s.Close()
+	h.Stop()
+
+	//or the client is dropped. A full budget lets a single large request through
+	h, s = start(hub.RateLimitOptions{Receivers: 10, Policy: hub.RatePolicyDisconnect})
+	var wide []uint64
+	for id := uint64(1000); id < 1020; id++ {
+		wide = append(wide, id)
+	}
+	s.Send(message.NewRelayRequest(wide, testBody))
+	s.Send(message.NewRelayRequest(wide, testBody))
+
+	_, err := s.Read(ans)
+	assert.NotNil(err, "Client over the fan-out limit should be disconnected")
+	s.Close()
+	h.Stop()
+}
+
+func TestACL(t *testing.T){
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "acl")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	//the guest can't relay to anyone, the scheduler sends to workers, and anyone
+	//to the lobby and to the topics outside admin
+	path := filepath.Join(dir, "policy.json")
+	assert.Nil(ioutil.WriteFile(path, []byte(`{
+		"rules": [
+			{"action": "deny",  "from": {"principal": "guest"}, "to": {}},
+			{"action": "allow", "from": {"principal": "scheduler"}, "to": {"filter": "role=worker"}},
+			{"action": "allow", "from": {}, "group": "lobby"},
+			{"action": "deny",  "from": {}, "topic": "admin/#"},
+			{"action": "allow", "from": {}, "topic": "#"}
+		]
+	}`), 0600))
+
+	opts := hub.DefaultOptions()
+	opts.ACLFile = filepath.Join(dir, "missing.json")
+	_, err = hub.NewHubWithOptions(0, opts)
+	assert.NotNil(err, "Hub should not start without its policy")
+
+	opts.ACLFile = path
+	opts.Authenticator = hub.NewTokenAuthenticator(map[string]string{
+		"scheduler-token": "scheduler",
+		"worker-token": 	"worker",
+		"guest-token": 		"guest",
+	})
+	h, aclPort := startHub(t, opts)
+
+	//authenticate as the principal, with a tag telling its role
+	connect := func(principal string) *mexsocket.MexSocket {
+		s := dial(t, aclPort)
+		s.Read(new(message.Answer))
+		s.SetProtocol(ask(s, message.NewHelloRequest(message.FeatureAcks | message.FeatureTags | message.FeatureTopics | message.FeatureGroups)).Protocol())
+		s.Id = ask(s, message.NewAuthRequest([]byte(principal + "-token"))).Id()
+		assert.Equal(message.Ok, ask(s, message.NewRegisterRequest(map[string]string{"role": principal})).Type(), "Tags should be registered")
+		return s
+	}
+
+	scheduler, worker, guest := connect("scheduler"), connect("worker"), connect("guest")
+
+	//the denied receivers are in the report, the others get the relay
+	req := message.NewRelayRequest([]uint64{guest.Id, worker.Id}, testBody)
+	req.Ack = true
+	ans := ask(scheduler, req)
+	assert.Equal(message.Report, ans.Type(), "Sender should get a report")
+	assert.Equal([]message.Delivery{
+		{Id: guest.Id, Status: message.StatusDenied},
+		{Id: worker.Id, Status: message.StatusDelivered},
+	}, ans.Report(), "Guest should be denied, in the order of the request")
+
+	worker.Read(ans)
+	assert.Equal(message.Relay, ans.Type(), "Worker should get the relay")
+	assert.Equal(scheduler.Id, ans.Sender(), "Sender should be stamped")
+
+	//without a report the sender gets an error
+	req = message.NewRelayRequest([]uint64{scheduler.Id}, testBody)
+	req.Corr = 4
+	ans = ask(guest, req)
+	assert.Equal(message.CodeDenied, ans.ErrorCode(), "Guest can't send to the scheduler")
+	assert.Equal(uint32(4), ans.Corr, "Correlation id should be echoed")
+
+	assert.Equal(message.CodeDenied, ask(guest, message.NewBroadcastRequest(testBody, true)).ErrorCode(), "Guest can't broadcast to anyone")
+
+	//the tags are the client's own, they don't change who the sender is
+	assert.Equal(message.Ok, ask(guest, message.NewRegisterRequest(map[string]string{"role": "scheduler"})).Type(), "Tags should be registered")
+	retagged := message.NewRelayRequest([]uint64{worker.Id}, testBody)
+	assert.Equal(message.CodeDenied, ask(guest, retagged).ErrorCode(), "Guest claiming a role should still be denied")
+
+	assert.Equal(message.CodeDenied, ask(worker, message.NewPublishRequest("admin/reset", testBody)).ErrorCode(), "Admin topics are denied")
+
+	assert.Equal(message.Ok, ask(scheduler, message.NewCreateGroupRequest("ops", 0, false)).Type(), "Group should be created")
+	assert.Equal(message.CodeDenied, ask(scheduler, message.NewGroupRelayRequest("ops", testBody)).ErrorCode(), "Only the lobby is allowed")
+	assert.Equal(uint64(7), h.Stats().Denied.Get(), "Denials should be counted")
+
+	//a broken policy is not loaded, a valid one replaces the current policy
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"default": "sometimes"}`), 0600))
+	assert.NotNil(h.ReloadACL(), "Invalid policy should be refused")
+	assert.Equal(message.CodeDenied, ask(guest, req).ErrorCode(), "Old policy should be kept")
+
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"default": "allow"}`), 0600))
+	assert.Nil(h.ReloadACL(), "Policy should be reloaded")
+	guest.Send(req)
+	scheduler.Read(ans)
+	assert.Equal(message.Relay, ans.Type(), "Everything should be allowed")
+	assert.Equal(guest.Id, ans.Sender(), "Sender should be stamped")
+
+	//policies can also be set directly, nil allows everything
+	denyAll, err := acl.Parse([]byte(`{}`))
+	assert.Nil(err)
+	h.SetACL(denyAll)
+	assert.Equal(message.CodeDenied, ask(guest, req).ErrorCode(), "Everything should be denied")
+
+	h.SetACL(nil)
+	guest.Send(req)
+	scheduler.Read(ans)
+	assert.Equal(message.Relay, ans.Type(), "Everything should be allowed")
+
+	scheduler.Close()
+	worker.Close()
+	guest.Close()
+}
@@ -2,6 +2,7 @@ package idpool
 
 import (
 	"sync"
+	"time"
 	"github.com/oleiade/lane"
 )
 
@@ -22,24 +23,39 @@ type IncrementalIdPool struct {
 	lock 		sync.RWMutex
 }
 
-/* Thread safe pool that gives incremental IDs, but reuses the dismissed IDs in a FIFO */
+/* Thread safe pool that gives incremental IDs, but reuses the dismissed IDs in a FIFO.
+ * A dismissed ID is given out again only after the quarantine period has passed
+ */
 type ReusableIdPool struct {
 	lastId 		uint64
 	freeIds 	*lane.Queue
+	quarantine 	time.Duration
 	lock 		sync.RWMutex
 }
 
+//an id waiting in the free queue
+type releasedId struct {
+	id 		uint64
+	since 	time.Time
+}
+
 //Incremental pool constructor.
 func NewIncrementalPool() *IncrementalIdPool{
 	return new (IncrementalIdPool)
 }
 
-//Reusable pool constructor.
+//Reusable pool constructor. Released ids are available immediately
 func NewReusableIdPool() *ReusableIdPool{
+	return NewQuarantinedIdPool(0)
+}
+
+//Reusable pool constructor. Released ids are available after the quarantine
+func NewQuarantinedIdPool(quarantine time.Duration) *ReusableIdPool{
 
 	pool := &ReusableIdPool{
 		lastId: 0, 
 		freeIds: lane.NewQueue(), 
+		quarantine: quarantine,
 	}
 
 	return pool
@@ -59,16 +75,17 @@ func (pool *IncrementalIdPool) ReleaseId(id uint64) {}
 
 func (pool *ReusableIdPool) GetId() uint64 {
 
-	//if available get a free id from the pool
-	id := pool.freeIds.Dequeue()
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
 
-	if id != nil {
-		return id.(uint64)
+	//if available get a free id from the pool. The head is the oldest released
+	head := pool.freeIds.Head()
+
+	if head != nil && time.Since(head.(releasedId).since) >= pool.quarantine {
+		return pool.freeIds.Dequeue().(releasedId).id
 	}
 
 	//if not, return a new sequential id
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
 	pool.lastId += 1
 
 	return pool.lastId
@@ -77,10 +94,10 @@ func (pool *ReusableIdPool) GetId() uint64 {
 
 //reuse id only if queue length does not grow excessively
 func (pool *ReusableIdPool) ReleaseId(id uint64) {
-	pool.lock.RLock()
-	defer pool.lock.RUnlock()
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
 
 	if pool.freeIds.Size() < MAX_QUEUE_LEN && id <= pool.lastId {
-		pool.freeIds.Enqueue(id)
+		pool.freeIds.Enqueue(releasedId{id, time.Now()})
 	}
 }
\ No newline at end of file
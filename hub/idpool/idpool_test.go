@@ -1,6 +1,7 @@
 package idpool_test
 
 import(
+	"time"
 	"testing"
 	"github.com/stretchr/testify/assert"
 	"github.com/sech90/go-message-hub/hub/idpool"
@@ -59,3 +60,19 @@ func TestReusablePool(t *testing.T) {
 	assert.Equal(uint64(5), pool.GetId(), "IdPool should reuse ids in a FIFO")
 }
 
+
+func TestQuarantinedPool(t *testing.T) {
+	assert := assert.New(t)
+	pool := idpool.NewQuarantinedIdPool(time.Millisecond * 50)
+
+	assert.Equal(uint64(1), pool.GetId(), "Id should start by 1")
+	assert.Equal(uint64(2), pool.GetId(), "IdPool should give incremental ids")
+
+	pool.ReleaseId(1)
+	assert.Equal(uint64(3), pool.GetId(), "Released id should be in quarantine")
+
+	time.Sleep(time.Millisecond * 60)
+	pool.ReleaseId(2)
+	assert.Equal(uint64(1), pool.GetId(), "IdPool should reuse id after the quarantine")
+	assert.Equal(uint64(4), pool.GetId(), "Released id should be in quarantine")
+}
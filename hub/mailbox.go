@@ -0,0 +1,97 @@
+package hub
+
+import(
+	"time"
+)
+
+/* Limits of the mailbox holding the relays for a disconnected client.
+ * The zero value disables the mailboxes
+ */
+type MailboxOptions struct {
+	//relays held for each client, the oldest are dropped first
+	MaxMessages int
+
+	//bytes held for each client, 0 for no limit
+	MaxBytes 	int
+
+	//time a relay is held, 0 to hold it as long as the session
+	TTL 		time.Duration
+}
+
+//a relay waiting for its receiver
+type storedFrame struct {
+	frame 	[]byte
+	stored 	time.Time
+}
+
+/* Relays addressed to a detached session, in arrival order. Not thread safe,
+ * it is guarded by the session store
+ */
+type mailbox struct {
+	opts 	MailboxOptions
+	frames 	[]storedFrame
+	bytes 	int
+}
+
+func newMailbox(opts MailboxOptions) *mailbox {
+	return &mailbox{opts: opts}
+}
+
+/* Store a frame, dropping the oldest ones to respect the limits.
+ * Returns false if the frame alone exceeds them, and the number of dropped frames
+ */
+func (box *mailbox) push(frame []byte) (bool, int) {
+
+	if box.opts.MaxBytes > 0 && len(frame) > box.opts.MaxBytes {
+		return false, 0
+	}
+
+	dropped := box.expire()
+	box.frames = append(box.frames, storedFrame{frame, time.Now()})
+	box.bytes += len(frame)
+
+	for len(box.frames) > box.opts.MaxMessages || (box.opts.MaxBytes > 0 && box.bytes > box.opts.MaxBytes) {
+		box.pop()
+		dropped++
+	}
+	return true, dropped
+}
+
+//remove all the frames still valid, in arrival order
+func (box *mailbox) take() [][]byte {
+
+	box.expire()
+
+	out := make([][]byte, len(box.frames))
+	for i, stored := range box.frames {
+		out[i] = stored.frame
+	}
+
+	box.frames = nil
+	box.bytes = 0
+	return out
+}
+
+func (box *mailbox) len() int {
+	return len(box.frames)
+}
+
+//drop the frames older than the ttl, returns how many
+func (box *mailbox) expire() int {
+
+	if box.opts.TTL <= 0 {
+		return 0
+	}
+
+	var dropped int
+	for len(box.frames) > 0 && time.Since(box.frames[0].stored) > box.opts.TTL {
+		box.pop()
+		dropped++
+	}
+	return dropped
+}
+
+func (box *mailbox) pop() {
+	box.bytes -= len(box.frames[0].frame)
+	box.frames = box.frames[1:]
+}
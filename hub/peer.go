@@ -0,0 +1,250 @@
+package hub
+
+import(
+	"sync"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/mexsocket"
+)
+
+/* Hub side state of a connected client */
+type peer struct {
+	socket 		*mexsocket.MexSocket
+
+	//id of the client, changed when it resumes a session. Read it with Id(),
+	//the socket keeps the one given on connection
+	id 			uint64
+
+	//identity proven by the client, empty if anonymous
+	principal 	string
+
+	//session token, nil if sessions are disabled
+	token 		[]byte
+
+	//receivers of the streams opened by the client, by stream id
+	streams 	map[uint32][]uint64
+
+	//the client wants PeerJoined and PeerLeft events
+	presence 	bool
+
+	//registered by the client, replaced as a whole and never modified
+	tags 		map[string]string
+
+	//nil if rate limiting is disabled. Used only by the connection loop
+	limiter 	*rateLimiter
+
+	//frames posted to the client and not yet queued on the socket, see post
+	outbox 		[]posted
+	flushing 	bool
+
+	//requests of the client stamped with a sequence number, not yet processed. See Hub.order
+	relays 		[]*message.Request
+	relaying 	bool
+	lock 		sync.RWMutex
+}
+
+//a frame waiting in the outbox of a client
+type posted struct {
+	frame 	*mexsocket.SharedFrame
+
+	//the frame must not be dropped by the queue policy, see mexsocket.EnqueueWait
+	wait 	bool
+}
+
+func newPeer(socket *mexsocket.MexSocket, principal string) *peer {
+	return &peer{
+		socket: 	socket,
+		id: 		socket.Id,
+		principal: 	principal,
+		streams: 	make(map[uint32][]uint64),
+	}
+}
+
+func (p *peer) Id() uint64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.id
+}
+
+func (p *peer) setId(id uint64) {
+	p.lock.Lock()
+	p.id = id
+	p.lock.Unlock()
+}
+
+func (p *peer) Token() []byte {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.token
+}
+
+func (p *peer) setToken(token []byte) {
+	p.lock.Lock()
+	p.token = token
+	p.lock.Unlock()
+}
+
+func (p *peer) Tags() map[string]string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.tags
+}
+
+func (p *peer) setTags(tags map[string]string) {
+	p.lock.Lock()
+	p.tags = tags
+	p.lock.Unlock()
+}
+
+func (p *peer) watchesPresence() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.presence
+}
+
+func (p *peer) setPresence(watch bool) {
+	p.lock.Lock()
+	p.presence = watch
+	p.lock.Unlock()
+}
+
+//start a stream, returns false if the client has too many open streams
+func (p *peer) openStream(stream uint32, receivers []uint64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, open := p.streams[stream]; !open && len(p.streams) >= MAX_OPEN_STREAMS {
+		return false
+	}
+
+	p.streams[stream] = receivers
+	return true
+}
+
+func (p *peer) streamReceivers(stream uint32) ([]uint64, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	receivers, ok := p.streams[stream]
+	return receivers, ok
+}
+
+func (p *peer) closeStream(stream uint32) {
+	p.lock.Lock()
+	delete(p.streams, stream)
+	p.lock.Unlock()
+}
+
+//remove all the open streams, returning them
+func (p *peer) closeStreams() map[uint32][]uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	streams := p.streams
+	p.streams = make(map[uint32][]uint64)
+	return streams
+}
+
+//get a connected client from the map
+func (hub *Hub) getPeer(id uint64) (*peer, bool) {
+
+	val, ok := hub.peerMap.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return val.(*peer), true
+}
+
+//all the connected clients
+func (hub *Hub) peers() []*peer {
+
+	ids := hub.peerMap.GetKeys()
+	out := make([]*peer, 0, len(ids))
+
+	for _, id := range ids {
+		if p, ok := hub.getPeer(id); ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+//ids of all the connected clients, without the sender if excluded
+func (hub *Hub) connectedIds(sender uint64, excludeSender bool) []uint64 {
+
+	ids := hub.peerMap.GetKeys()
+	if !excludeSender {
+		return ids
+	}
+
+	out := ids[:0]
+	for _, id := range ids {
+		if id != sender {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+/* Queue the frame on the socket after the frames posted before it, without blocking.
+ * Frames are posted with the hub locks held, to fix their order, and queued by a
+ * goroutine of the client, so a slow client can't stall the hub
+ */
+func (p *peer) post(frame *mexsocket.SharedFrame, wait bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.outbox = append(p.outbox, posted{frame: frame, wait: wait})
+	if !p.flushing {
+		p.flushing = true
+		go p.flush()
+	}
+}
+
+//queue the posted frames, until the outbox is empty
+func (p *peer) flush() {
+	for {
+		p.lock.Lock()
+		frames := p.outbox
+		p.outbox = nil
+		if len(frames) == 0 {
+			p.flushing = false
+		}
+		p.lock.Unlock()
+
+		if len(frames) == 0 {
+			return
+		}
+
+		for _, f := range frames {
+			if f.wait {
+				p.socket.EnqueueWait(f.frame)
+			} else {
+				p.socket.EnqueueShared(f.frame)
+			}
+		}
+	}
+}
+
+/* Queue the frame on the socket, behind the posted frames if there are any.
+ * Returns the delivery status: the queue policy may drop the frame, and a frame
+ * posted behind others is only known to be queued once they are
+ */
+func (p *peer) send(frame *mexsocket.SharedFrame) byte {
+
+	p.lock.Lock()
+	if p.flushing {
+		p.outbox = append(p.outbox, posted{frame: frame})
+		p.lock.Unlock()
+		return message.StatusQueued
+	}
+	p.lock.Unlock()
+
+	if p.socket.EnqueueShared(frame) {
+		return message.StatusDelivered
+	}
+	return message.StatusDropped
+}
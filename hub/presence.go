@@ -0,0 +1,64 @@
+package hub
+
+import(
+	"gopkg.in/fatih/set.v0"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/mexsocket"
+)
+
+/* Clients watching presence get a snapshot of the connected clients, then a
+ * PeerJoined or PeerLeft event on every change. Snapshots and events are posted
+ * with bindLock held, so a client applying them in order always has the current list,
+ * and queued on the sockets once it's released, so a slow watcher doesn't stall the hub
+ */
+
+//start sending the events to the client, the list of connected clients is the answer
+func (hub *Hub) watchPresence(p *peer, corr uint32) {
+
+	hub.bindLock.Lock()
+	defer hub.bindLock.Unlock()
+
+	p.setPresence(true)
+	hub.queueList(p, corr)
+}
+
+func (hub *Hub) unwatchPresence(p *peer, corr uint32) {
+
+	p.setPresence(false)
+
+	answer := message.NewAnswerOk()
+	answer.Corr = corr
+	p.socket.Send(answer)
+}
+
+/* Send the clients connected besides p. Must be called with bindLock held.
+ * The client is waiting for the answer, so it is never dropped
+ */
+func (hub *Hub) queueList(p *peer, corr uint32) {
+
+	//the resulting list is []interface{}
+	list := set.Difference(hub.idSet, set.New(p.Id())).List()
+
+	//create new answer
+	answer := new(message.Answer)
+	answer.MexType = message.List
+	answer.Corr = corr
+	answer.Payload = convertSetList(list)
+	p.post(mexsocket.NewSharedFrame(answer.ToByteArray()), true)
+}
+
+//tell the watching clients, but the one concerned, about a change. Must be called with bindLock held
+func (hub *Hub) announce(id uint64, event *message.Answer) {
+
+	var frame *mexsocket.SharedFrame
+	for _, p := range hub.peers() {
+		if p.Id() != id && p.watchesPresence() {
+
+			//converted once, and only if someone is watching
+			if frame == nil {
+				frame = mexsocket.NewSharedFrame(event.ToByteArray())
+			}
+			p.post(frame, false)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package hub
+
+import(
+	"log"
+	"time"
+	"errors"
+	"github.com/sech90/go-message-hub/message"
+)
+
+/* What the hub does with a client exceeding its rate limits */
+const(
+	//stop reading from the client until it is within its budget again
+	RatePolicyDelay = 0
+	//refuse the request with an error answer
+	RatePolicyReject = 1
+	//close the connection
+	RatePolicyDisconnect = 2
+
+	DEFAULT_RATE_BURST = time.Second
+)
+
+var ErrRateLimited = errors.New("Rate limit exceeded")
+
+/* Token bucket limits applied to each client. A rate of 0 is not limited,
+ * the zero value disables rate limiting
+ */
+type RateLimitOptions struct {
+	//requests per second
+	Messages 	float64
+
+	//bytes per second of the requests, counting bodies, topics and receivers
+	Bytes 		float64
+
+	//receivers per second of relays, broadcasts, publications, group relays and chunks
+	Receivers 	float64
+
+	//traffic a client can send at once, as time at the full rate. DEFAULT_RATE_BURST if 0
+	Burst 		time.Duration
+
+	//one of the RatePolicy constants
+	Policy 		int
+}
+
+func (opts RateLimitOptions) enabled() bool {
+	return opts.Messages > 0 || opts.Bytes > 0 || opts.Receivers > 0
+}
+
+/* Tokens are refilled at rate per second, up to capacity. Not thread safe */
+type tokenBucket struct {
+	rate 		float64
+	capacity 	float64
+	tokens 		float64
+	last 		time.Time
+}
+
+//nil if the rate is not limited
+func newTokenBucket(rate float64, burst time.Duration, now time.Time) *tokenBucket {
+
+	if rate <= 0 {
+		return nil
+	}
+
+	capacity := rate * burst.Seconds()
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+
+	b.tokens += b.rate * now.Sub(b.last).Seconds()
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+/* Time to wait before n tokens are available, 0 if they are. A full bucket
+ * always grants the tokens, so a cost larger than the burst is still possible
+ */
+func (b *tokenBucket) wait(n float64) time.Duration {
+
+	if b == nil || b.tokens >= n || b.tokens >= b.capacity {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+//the tokens can go below 0, delaying the next requests
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+/* Budgets of a client, used only by its connection loop */
+type rateLimiter struct {
+	messages 	*tokenBucket
+	bytes 		*tokenBucket
+	receivers 	*tokenBucket
+}
+
+//nil if rate limiting is disabled
+func newRateLimiter(opts RateLimitOptions) *rateLimiter {
+
+	if !opts.enabled() {
+		return nil
+	}
+
+	burst := opts.Burst
+	if burst <= 0 {
+		burst = DEFAULT_RATE_BURST
+	}
+
+	now := time.Now()
+	return &rateLimiter{
+		messages: 	newTokenBucket(opts.Messages, burst, now),
+		bytes: 		newTokenBucket(opts.Bytes, burst, now),
+		receivers: 	newTokenBucket(opts.Receivers, burst, now),
+	}
+}
+
+/* Charge a request to the budgets. Returns how long the client should have waited
+ * for it, 0 if it was within budget. Over budget, the cost is charged only if force
+ * is set, so a refused request doesn't count
+ */
+func (l *rateLimiter) charge(bytes, receivers int, force bool) time.Duration {
+
+	now  := time.Now()
+	cost := []struct{
+		bucket 	*tokenBucket
+		n 		float64
+	}{
+		{l.messages, 1},
+		{l.bytes, float64(bytes)},
+		{l.receivers, float64(receivers)},
+	}
+
+	var wait time.Duration
+	for _, c := range cost {
+		if c.bucket != nil {
+			c.bucket.refill(now)
+			if w := c.bucket.wait(c.n); w > wait {
+				wait = w
+			}
+		}
+	}
+
+	if wait == 0 || force {
+		for _, c := range cost {
+			c.bucket.take(c.n)
+		}
+	}
+	return wait
+}
+
+/* Apply the rate limits to a request, returns false if it must not be processed.
+ * Runs in the connection loop, so a delay stops reading from the client
+ */
+func (hub *Hub) admit(p *peer, req *message.Request) bool {
+
+	if p.limiter == nil {
+		return true
+	}
+
+	//finding the receivers of a publication or a group relay is not free
+	receivers := 0
+	if p.limiter.receivers != nil {
+		receivers = hub.fanOut(p, req)
+	}
+
+	policy := hub.opts.RateLimit.Policy
+	wait := p.limiter.charge(requestSize(req), receivers, policy == RatePolicyDelay)
+	if wait == 0 {
+		return true
+	}
+
+	hub.stats.RateLimited.Increase(1)
+
+	switch policy {
+	case RatePolicyReject:
+		hub.refuse(p.socket, req, message.CodeRateLimited, ErrRateLimited)
+		return false
+
+	case RatePolicyDisconnect:
+		log.Println("Client", p.Id(), "exceeded its rate limits, disconnecting")
+		p.socket.Close()
+		return false
+	}
+
+	select{
+	case <- time.After(wait):
+		return true
+	case <- p.socket.QuitChan():
+		return false
+	}
+}
+
+//bytes of a request counted against the budget
+func requestSize(req *message.Request) int {
+	return len(req.Body) + len(req.Topic) + len(req.Receivers) * 8
+}
+
+//number of clients a request is delivered to
+func (hub *Hub) fanOut(p *peer, req *message.Request) int {
+
+	switch req.MexType {
+	case message.Relay:
+		return len(req.Receivers)
+	case message.Broadcast:
+		return hub.idSet.Size()
+	case message.Publish:
+		return len(hub.topics.subscribers(req.Topic))
+	case message.GroupRelay:
+		members, _ := hub.groups.members(req.Topic)
+		return len(members)
+	case message.Chunk:
+		if req.Flags & message.CHUNK_FIRST != 0 {
+			return len(req.Receivers)
+		}
+		receivers, _ := p.streamReceivers(req.Stream)
+		return len(receivers)
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+package hub
+
+import(
+	"sync"
+	"time"
+	"crypto/rand"
+	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/mexsocket"
+	"github.com/sech90/go-message-hub/statbucket"
+)
+
+//bytes of the random token identifying a session
+const TOKEN_SIZE = 16
+
+/* A session binds an id to the client that received it. When the client
+ * disconnects the id is held for the session ttl, so the client can claim it
+ * back by presenting the token
+ */
+type session struct {
+	id 			uint64
+	token 		string
+	principal 	string
+
+	//connected client owning the session, nil while detached
+	peer 		*peer
+
+	//fires when a detached session expires
+	expiry 		*time.Timer
+
+	//relays received while detached, nil if mailboxes are disabled
+	mailbox 	*mailbox
+}
+
+/* Thread safe store of the open sessions */
+type sessionStore struct {
+	ttl 		time.Duration
+	mailbox 	MailboxOptions
+	byToken 	map[string]*session
+	byId 		map[uint64]*session
+	stats 		*statbucket.StatBucket
+	lock 		sync.Mutex
+}
+
+func newSessionStore(ttl time.Duration, mailbox MailboxOptions, stats *statbucket.StatBucket) *sessionStore {
+	return &sessionStore{
+		ttl: 		ttl,
+		mailbox: 	mailbox,
+		byToken: 	make(map[string]*session),
+		byId: 		make(map[uint64]*session),
+		stats: 		stats,
+	}
+}
+
+//open a session for a new client and returns its token
+func (store *sessionStore) open(p *peer) ([]byte, error) {
+
+	token := make([]byte, TOKEN_SIZE)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	sess := &session{
+		id: 		p.Id(),
+		token: 		string(token),
+		principal: 	p.principal,
+		peer: 		p,
+	}
+
+	if store.mailbox.MaxMessages > 0 {
+		sess.mailbox = newMailbox(store.mailbox)
+	}
+
+	store.lock.Lock()
+	store.byToken[sess.token] = sess
+	store.byId[sess.id] = sess
+	store.lock.Unlock()
+
+	return token, nil
+}
+
+/* Give the session of the token to a new client. Fails if the token is unknown
+ * or expired, or if the client proved a different identity than the owner.
+ * The relays stored for the session are passed to deliver, which runs before
+ * any other relay can reach the session. It holds the lock, so it must only post them
+ */
+func (store *sessionStore) claim(token []byte, p *peer, deliver func(sess *session, stored [][]byte)) (*session, bool) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	sess, ok := store.byToken[string(token)]
+	if !ok || sess.principal != p.principal {
+		return nil, false
+	}
+
+	if sess.expiry != nil {
+		sess.expiry.Stop()
+		sess.expiry = nil
+	}
+
+	var stored [][]byte
+	if sess.mailbox != nil {
+		stored = sess.mailbox.take()
+	}
+
+	sess.peer = p
+	deliver(sess, stored)
+	return sess, true
+}
+
+/* Deliver a relay to a client missing from the hub map. The client may be resuming
+ * its session, or be disconnected: then the relay is stored in the mailbox.
+ * Returns the delivery status, see message.StatusDelivered
+ */
+func (store *sessionStore) store(id uint64, frame []byte) byte {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	sess, ok := store.byId[id]
+	if !ok {
+		return message.StatusUnknown
+	}
+
+	//not yet in the map, or closed and about to be detached. Posted behind the
+	//stored relays, without blocking under the lock
+	if sess.peer != nil && !sess.peer.socket.IsClosed() {
+		sess.peer.post(mexsocket.NewSharedFrame(frame), false)
+		return message.StatusQueued
+	}
+
+	if sess.mailbox == nil {
+		return message.StatusDropped
+	}
+
+	stored, dropped := sess.mailbox.push(frame)
+	store.stats.DroppedMessages.Increase(uint64(dropped))
+	if !stored {
+		return message.StatusDropped
+	}
+
+	store.stats.StoredMessages.Increase(1)
+	return message.StatusStored
+}
+
+/* Detach the client from its session and start the expiry timer. Returns false
+ * if the client doesn't own a session, in which case its id can be released now
+ */
+func (store *sessionStore) detach(p *peer, expired func(sess *session)) bool {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	sess, ok := store.byId[p.Id()]
+	if !ok || sess.peer != p {
+		return false
+	}
+
+	sess.peer = nil
+	sess.expiry = time.AfterFunc(store.ttl, func(){
+		if store.expire(sess) {
+			expired(sess)
+		}
+	})
+	return true
+}
+
+//remove a session still detached. Returns false if it was claimed meanwhile
+func (store *sessionStore) expire(sess *session) bool {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if sess.peer != nil || store.byId[sess.id] != sess {
+		return false
+	}
+
+	store.remove(sess)
+
+	//nobody will read the stored relays
+	if sess.mailbox != nil {
+		store.stats.DroppedMessages.Increase(uint64(sess.mailbox.len()))
+	}
+	return true
+}
+
+//close the session of an id, if any
+func (store *sessionStore) close(id uint64) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if sess, ok := store.byId[id]; ok {
+		if sess.expiry != nil {
+			sess.expiry.Stop()
+		}
+		store.remove(sess)
+	}
+}
+
+//must hold the lock
+func (store *sessionStore) remove(sess *session) {
+	delete(store.byToken, sess.token)
+	delete(store.byId, sess.id)
+}
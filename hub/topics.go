@@ -0,0 +1,76 @@
+package hub
+
+import(
+	"sync"
+	"github.com/sech90/go-message-hub/topic"
+)
+
+/* Thread safe registry of the clients subscribed to each topic filter */
+type topicRegistry struct {
+	//filter --> subscribed ids
+	subs 	*topic.Trie
+
+	//id --> set of filters, to clean up on disconnection
+	byId 	map[uint64]map[string]bool
+
+	lock 	sync.RWMutex
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{
+		subs: 	topic.NewTrie(),
+		byId: 	make(map[uint64]map[string]bool),
+	}
+}
+
+func (reg *topicRegistry) subscribe(filter string, id uint64) {
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if reg.byId[id] == nil {
+		reg.byId[id] = make(map[string]bool)
+	}
+
+	reg.subs.Add(filter, id)
+	reg.byId[id][filter] = true
+}
+
+func (reg *topicRegistry) unsubscribe(filter string, id uint64) {
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	reg.remove(filter, id)
+}
+
+//remove all the subscriptions of a client
+func (reg *topicRegistry) unsubscribeAll(id uint64) {
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	for filter := range reg.byId[id] {
+		reg.remove(filter, id)
+	}
+}
+
+//ids of the clients with a filter matching the topic, each listed once
+func (reg *topicRegistry) subscribers(name string) []uint64 {
+
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+
+	return reg.subs.Match(name)
+}
+
+//must hold the lock
+func (reg *topicRegistry) remove(filter string, id uint64) {
+
+	reg.subs.Remove(filter, id)
+
+	delete(reg.byId[id], filter)
+	if len(reg.byId[id]) == 0 {
+		delete(reg.byId, id)
+	}
+}
@@ -0,0 +1,128 @@
+package message
+
+import(
+	"encoding/binary"
+)
+
+/* Payloads of any size are streamed as a sequence of chunks of up to CHUNK_LEN bytes.
+ * A chunk request is [hdr][stream:4][flags:1][receivers][data], the receivers are
+ * present only in the first chunk as [n:uvarint][ids:n*8].
+ * A chunk answer is [sender:8][stream:4][flags:1][data]
+ */
+const(
+	STREAM_ID_SIZE 	  = 4
+	CHUNK_HEADER_SIZE = 8 + STREAM_ID_SIZE + 1
+
+	//chunk flags
+	CHUNK_FIRST = byte(1)	//opens the stream, carries the receivers
+	CHUNK_LAST 	= byte(2)	//closes the stream
+	CHUNK_ABORT = byte(4)	//the stream is broken, the data received is incomplete
+
+	chunkFlags = CHUNK_FIRST | CHUNK_LAST | CHUNK_ABORT
+)
+
+/* A chunk of the stream, stream ids are chosen by the sender. Only the first chunk
+ * lists the receivers. Returns nil if the data exceeds CHUNK_LEN
+ */
+func NewChunkRequest(stream uint32, flags byte, receivers []uint64, data []byte) *Request {
+
+	if len(data) > CHUNK_LEN || len(receivers) > MAX_RECEIVERS || flags &^ chunkFlags != 0 {
+		return nil
+	}
+
+	if flags & CHUNK_FIRST == 0 && len(receivers) > 0 {
+		return nil
+	}
+
+	return &Request{MexType: Chunk, Stream: stream, Flags: flags, Receivers: receivers, Body: data}
+}
+
+func (r *Request) appendChunk(arr []byte) []byte {
+
+	var stream [STREAM_ID_SIZE]byte
+	Uint32ToByteArray(stream[:], r.Stream)
+
+	arr = append(arr, stream[:]...)
+	arr = append(arr, r.Flags)
+
+	if r.Flags & CHUNK_FIRST != 0 {
+		arr = binary.AppendUvarint(arr, uint64(len(r.Receivers)))
+		arr = append(arr, Uint64ArrayToByteArray(r.Receivers)...)
+	}
+	return append(arr, r.Body...)
+}
+
+//data is what follows the header
+func (r *Request) decodeChunk(data []byte) error {
+
+	if len(data) < STREAM_ID_SIZE + 1 {
+		return ErrTruncated
+	}
+
+	stream := ByteArrayToUint32(data[:STREAM_ID_SIZE])
+	flags  := data[STREAM_ID_SIZE]
+	rest   := data[STREAM_ID_SIZE+1:]
+
+	if flags &^ chunkFlags != 0 {
+		return ErrUnknownType
+	}
+
+	var receivers []uint64
+	if flags & CHUNK_FIRST != 0 {
+
+		count, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return ErrTruncated
+		}
+		if count > uint64(MAX_RECEIVERS) {
+			return ErrTooManyReceivers
+		}
+
+		end := n + int(count)*8
+		if len(rest) < end {
+			return ErrTruncated
+		}
+
+		receivers = ByteArrayToUint64Array(rest[n:end])
+		rest = rest[end:]
+	}
+
+	if len(rest) > CHUNK_LEN {
+		return ErrPayloadTooLarge
+	}
+
+	r.Stream 	= stream
+	r.Flags 	= flags
+	r.Receivers = receivers
+	if len(rest) > 0 {
+		r.Body = rest
+	}
+	return nil
+}
+
+//a chunk forwarded by the hub, stamped with the sender identity
+func NewAnswerChunk(sender uint64, stream uint32, flags byte, data []byte) *Answer {
+
+	payload := make([]byte, CHUNK_HEADER_SIZE, CHUNK_HEADER_SIZE+len(data))
+
+	Uint64ToByteArray(payload[:8], sender)
+	Uint32ToByteArray(payload[8:8+STREAM_ID_SIZE], stream)
+	payload[CHUNK_HEADER_SIZE-1] = flags
+
+	return &Answer{MexType: Chunk, Payload: append(payload, data...)}
+}
+
+//stream of a chunk answer, unique among the streams of the same sender
+func (a *Answer) Stream() uint32 {
+	if a.MexType == Chunk && len(a.Payload) >= CHUNK_HEADER_SIZE {
+		return ByteArrayToUint32(a.Payload[8:8+STREAM_ID_SIZE])
+	}
+	return 0
+}
+
+func (a *Answer) ChunkFlags() byte {
+	if a.MexType == Chunk && len(a.Payload) >= CHUNK_HEADER_SIZE {
+		return a.Payload[CHUNK_HEADER_SIZE-1]
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package message
+
+import(
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+/* An HMAC credential proves the knowledge of a principal's key without sending it.
+ * Format is [principal length:1][principal][HMAC-SHA256(key, nonce)]
+ */
+func NewHMACCredential(principal string, key []byte, nonce []byte) []byte {
+
+	if len(principal) > 255 {
+		return nil
+	}
+
+	out := make([]byte, 0, 1+len(principal)+sha256.Size)
+	out = append(out, byte(len(principal)))
+	out = append(out, principal...)
+
+	return append(out, SignNonce(key, nonce)...)
+}
+
+//split an HMAC credential in principal and signature
+func ParseHMACCredential(cred []byte) (string, []byte, error) {
+
+	if len(cred) < 1 {
+		return "", nil, ErrTruncated
+	}
+
+	end := 1 + int(cred[0])
+	if len(cred) != end+sha256.Size {
+		return "", nil, ErrTruncated
+	}
+
+	return string(cred[1:end]), cred[end:], nil
+}
+
+func SignNonce(key []byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,190 @@
+package message
+
+import(
+	"sort"
+	"encoding/binary"
+)
+
+/* Clients register tags describing themselves, and find each other with a filter
+ * on the tags (see package metadata).
+ * Tags are encoded as [n:uvarint] followed by n [key length:uvarint][key][value length:uvarint][value].
+ * A Register request is [hdr][tags], a Directory request is [hdr][filter] and its
+ * answer lists the matching clients as [id:8][tags] each
+ */
+const(
+	MAX_TAGS_SIZE 	= 4096
+	MAX_FILTER_LEN 	= 1024
+)
+
+/* A client found in the directory */
+type PeerInfo struct {
+	Id 		uint64
+	Tags 	map[string]string
+}
+
+//returns nil if the encoded tags exceed MAX_TAGS_SIZE
+func NewRegisterRequest(tags map[string]string) *Request {
+
+	if TagsSize(tags) > MAX_TAGS_SIZE {
+		return nil
+	}
+	return &Request{MexType: Register, Body: appendTags(nil, tags)}
+}
+
+//the clients whose tags match the filter, an empty filter matches all of them
+func NewDirectoryRequest(filter string) *Request {
+
+	if len(filter) > MAX_FILTER_LEN {
+		return nil
+	}
+	return &Request{MexType: Directory, Body: []byte(filter)}
+}
+
+//tags of a Register request
+func (r *Request) Tags() map[string]string {
+
+	if r.MexType != Register {
+		return nil
+	}
+
+	tags, _, err := decodeTags(r.Body)
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+//filter of a Directory request
+func (r *Request) Filter() string {
+
+	if r.MexType != Directory {
+		return ""
+	}
+	return string(r.Body)
+}
+
+func NewAnswerDirectory(peers []PeerInfo) *Answer {
+
+	var payload []byte
+	for _, peer := range peers {
+		var id [8]byte
+		Uint64ToByteArray(id[:], peer.Id)
+		payload = appendTags(append(payload, id[:]...), peer.Tags)
+	}
+	return &Answer{MexType: Directory, Payload: payload}
+}
+
+//clients listed by a Directory answer
+func (a *Answer) Directory() []PeerInfo {
+
+	if a.MexType != Directory {
+		return nil
+	}
+
+	peers, err := decodeDirectory(a.Payload)
+	if err != nil {
+		return nil
+	}
+	return peers
+}
+
+func decodeDirectory(data []byte) ([]PeerInfo, error) {
+
+	peers := make([]PeerInfo, 0)
+	for len(data) > 0 {
+
+		if len(data) < 8 {
+			return nil, ErrTruncated
+		}
+
+		tags, n, err := decodeTags(data[8:])
+		if err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, PeerInfo{Id: ByteArrayToUint64(data[:8]), Tags: tags})
+		data = data[8+n:]
+	}
+	return peers, nil
+}
+
+//bytes taken by the tags once encoded
+func TagsSize(tags map[string]string) int {
+
+	size := uvarintSize(uint64(len(tags)))
+	for key, value := range tags {
+		size += uvarintSize(uint64(len(key))) + len(key) + uvarintSize(uint64(len(value))) + len(value)
+	}
+	return size
+}
+
+func uvarintSize(n uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], n)
+}
+
+//keys are sorted, so the same tags are always encoded the same way
+func appendTags(arr []byte, tags map[string]string) []byte {
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	arr = binary.AppendUvarint(arr, uint64(len(keys)))
+	for _, key := range keys {
+		arr = appendString(arr, key)
+		arr = appendString(arr, tags[key])
+	}
+	return arr
+}
+
+func appendString(arr []byte, s string) []byte {
+	arr = binary.AppendUvarint(arr, uint64(len(s)))
+	return append(arr, s...)
+}
+
+//decode the tags at the start of data, returns the bytes they take
+func decodeTags(data []byte) (map[string]string, int, error) {
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, 0, ErrTruncated
+	}
+
+	//every tag takes at least two bytes
+	if count > uint64(len(data) - n) / 2 {
+		return nil, 0, ErrTruncated
+	}
+
+	tags := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+
+		key, kn, err := decodeString(data[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		n += kn
+
+		value, vn, err := decodeString(data[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		n += vn
+
+		tags[key] = value
+	}
+	return tags, n, nil
+}
+
+func decodeString(data []byte) (string, int, error) {
+
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data) - n) {
+		return "", 0, ErrTruncated
+	}
+
+	end := n + int(length)
+	return string(data[n:end]), end, nil
+}
@@ -0,0 +1,106 @@
+package message
+
+/* Named groups of clients. Group requests carry the name like topic requests,
+ * as [hdr][length:2][name], followed by the options for CreateGroup and by the
+ * body for GroupRelay. The GroupRelay answer is [sender:8][seq:8][length:2][name][body],
+ * the GroupMembers answer lists the ids like a List answer
+ */
+const(
+	//CreateGroup options are [owned:1][limit:4]
+	GROUP_OPTIONS_SIZE = 5
+)
+
+/* Create a group and join it. An owned group is closed when the owner leaves,
+ * the others are closed when their last member leaves. A limit of 0 means no limit
+ */
+func NewCreateGroupRequest(name string, limit uint32, owned bool) *Request {
+
+	if !validTopic(name) {
+		return nil
+	}
+
+	options := make([]byte, GROUP_OPTIONS_SIZE)
+	if owned {
+		options[0] = 1
+	}
+	Uint32ToByteArray(options[1:], limit)
+
+	return &Request{MexType: CreateGroup, Topic: name, Body: options}
+}
+
+//JoinGroup, LeaveGroup or GroupMembers
+func NewGroupRequest(mexType byte, name string) *Request {
+
+	if !validTopic(name) {
+		return nil
+	}
+	return &Request{MexType: mexType, Topic: name}
+}
+
+//send the body to the other members of the group
+func NewGroupRelayRequest(name string, body []byte) *Request {
+
+	if !validTopic(name) || len(body) > MAX_PAYLOAD {
+		return nil
+	}
+	return &Request{MexType: GroupRelay, Topic: name, Body: body}
+}
+
+func (r *Request) GroupOwned() bool {
+	return r.MexType == CreateGroup && len(r.Body) == GROUP_OPTIONS_SIZE && r.Body[0] == 1
+}
+
+//maximum number of members, 0 if unlimited
+func (r *Request) GroupLimit() uint32 {
+	if r.MexType == CreateGroup && len(r.Body) == GROUP_OPTIONS_SIZE {
+		return ByteArrayToUint32(r.Body[1:])
+	}
+	return 0
+}
+
+//check what follows the name of a group request
+func decodeGroupBody(mexType byte, body []byte) error {
+
+	switch mexType {
+	case CreateGroup:
+		if len(body) < GROUP_OPTIONS_SIZE {
+			return ErrTruncated
+		}
+		if len(body) > GROUP_OPTIONS_SIZE || body[0] > 1 {
+			return ErrUnknownType
+		}
+	case GroupRelay:
+		if len(body) > MAX_PAYLOAD {
+			return ErrPayloadTooLarge
+		}
+	default:
+		if len(body) > 0 {
+			return ErrUnknownType
+		}
+	}
+	return nil
+}
+
+/* Same as a publish answer, with the name of the group instead of the topic */
+func NewAnswerGroupRelay(sender uint64, seq uint64, name string, p []byte) *Answer {
+	answer := NewAnswerPublish(sender, seq, name, p)
+	answer.MexType = GroupRelay
+	return answer
+}
+
+func NewAnswerGroupMembers(ids []uint64) *Answer {
+	return &Answer{MexType: GroupMembers, Payload: Uint64ArrayToByteArray(ids)}
+}
+
+//group of a group relay
+func (a *Answer) Group() string {
+	if a.MexType == GroupRelay && len(a.Payload) >= RELAY_HEADER_SIZE {
+		name, _, _ := decodeTopic(a.Payload[RELAY_HEADER_SIZE:])
+		return name
+	}
+	return ""
+}
+
+func isGroupRequest(mexType byte) bool {
+	return mexType >= CreateGroup && mexType <= GroupMembers
+}
@@ -7,15 +7,118 @@ import(
 
 const(
 	MAX_PAYLOAD   = int(1024 * 1000)
-	MAX_RECEIVERS = int(255)
+	MAX_RECEIVERS = int(1 << 16)
 	CHUNK_LEN 	= 1024 * 2
 	HEADER_SIZE = 4
 
+	//relay answers carry sender id and sequence number before the body
+	RELAY_HEADER_SIZE = 16
+
 	Empty 		= byte(0)
 	Identity 	= byte(1)
 	List 		= byte(2)
 	Relay 		= byte(3)
 	Stat 		= byte(4)
+	Shutdown 	= byte(5)
+	Auth 		= byte(6)
+	Error 		= byte(7)
+	Resume 		= byte(8)
+	Report 		= byte(9)
+	Subscribe 	= byte(10)
+	Unsubscribe = byte(11)
+	Publish 	= byte(12)
+	Ok 			= byte(13)
+	Broadcast 	= byte(14)
+
+	/* relay request in the varint format: [hdr][encoding:1][n:uvarint][receivers][body].
+	 * It decodes to a Relay. Relays with up to LEGACY_MAX_RECEIVERS use the old format
+	 * [hdr][n:1][receivers:n*8][body], so they are still understood by older hubs
+	 */
+	RelayVarint = byte(15)
+
+	//negotiation of the protocol version, see protocol.go
+	Hello 		= byte(16)
+
+	//part of a streamed payload, see chunk.go
+	Chunk 		= byte(17)
+
+	//presence events, the payload is the id of the peer
+	PeerJoined 	= byte(18)
+	PeerLeft 	= byte(19)
+
+	//opt in and out of the presence events
+	WatchPresence 	= byte(20)
+	UnwatchPresence = byte(21)
+
+	//tags of the clients, see directory.go
+	Register 	= byte(22)
+	Directory 	= byte(23)
+
+	//named groups of clients, see group.go
+	CreateGroup 	= byte(24)
+	JoinGroup 		= byte(25)
+	LeaveGroup 		= byte(26)
+	GroupRelay 		= byte(27)
+	GroupMembers 	= byte(28)
+
+	//codes carried by Error answers
+	CodeUnknown 	= byte(0)
+	CodeAuthFailed 	= byte(1)
+	CodeInvalidTopic= byte(2)
+	CodeUnsupported = byte(3)
+	CodeUnknownStream = byte(4)
+	CodeInvalidTags = byte(5)
+	CodeUnknownGroup= byte(6)
+	CodeGroupExists = byte(7)
+	CodeGroupFull 	= byte(8)
+	CodeNotMember 	= byte(9)
+	CodeRateLimited = byte(10)
+	CodeDenied 		= byte(11)
+	CodeTooManyStreams = byte(12)
+
+	//bytes of the nonce sent by the hub to challenge a client
+	NONCE_SIZE = 32
+
+	//topics are prefixed by their length on 2 bytes
+	TOPIC_LEN_SIZE = 2
+	MAX_TOPIC_LEN  = 1024
+
+	/* set on the type byte when a correlation id follows it. The hub copies
+	 * the correlation id of a request into its answer
+	 */
+	FLAG_CORRELATED = byte(0x80)
+	CORR_SIZE 		= 4
+
+	//set on the type byte of a relay request to get a delivery report
+	FLAG_ACK = byte(0x40)
+
+	//receivers of a relay in the old format
+	LEGACY_MAX_RECEIVERS = 255
+
+	//encoding of the receivers in the varint format
+	RECEIVERS_FIXED = byte(0)	//8 bytes each, big endian
+	RECEIVERS_DELTA = byte(1)	//difference from the previous id, as a signed varint
+
+	//bytes of each receiver in a delivery report: [id:8][status:1]
+	DELIVERY_SIZE = 9
+
+	//delivery status of a relay, per receiver
+	StatusDelivered = byte(1)	//queued for the connected receiver
+	StatusUnknown 	= byte(2)	//no client with the id
+	StatusDropped 	= byte(3)	//discarded because the receiver is too slow
+	StatusStored 	= byte(4)	//held in the mailbox of a disconnected receiver
+	StatusDenied 	= byte(5)	//not allowed by the access policy of the hub
+	StatusQueued 	= byte(6)	//waiting behind frames not yet queued for the receiver, it may still be dropped
+)
+
+/* Decoding errors */
+var (
+	ErrTruncated 		= errors.New("Buffer is too short for the message")
+	ErrUnknownType 		= errors.New("Unknown message type")
+	ErrTooManyReceivers = errors.New("Too many receivers")
+	ErrPayloadTooLarge 	= errors.New("Payload exceeds the maximum size")
+	ErrInvalidTopic 	= errors.New("Topic is empty or too long")
+	ErrInvalidTags 		= errors.New("Malformed tags")
 )
 
 type Message interface {
@@ -28,6 +131,20 @@ type Message interface {
 /* Requests are always CLIENT --> SERVER */
 type Request struct {
 	MexType byte
+	Corr 	uint32
+
+	//relay only: ask the hub for a delivery report
+	Ack 	bool
+
+	//subscribe, unsubscribe and publish only, or the name for group requests
+	Topic 	string
+
+	//broadcast only: don't deliver the message back to the sender
+	Exclude bool
+
+	//chunk only: stream of the chunk and CHUNK flags
+	Stream 	uint32
+	Flags 	byte
 
 	Receivers []uint64
 	Body []byte
@@ -36,11 +153,18 @@ type Request struct {
 /* Answers are always SERVER --> CLIENT*/
 type Answer struct{
 	MexType byte
+	Corr 	uint32
 	Payload []byte
 
 	cachedList []uint64
 }
 
+/* Outcome of a relay for one receiver */
+type Delivery struct {
+	Id 		uint64
+	Status 	byte
+}
+
 /****
 * Answer related methods
 ****/
@@ -58,18 +182,108 @@ func NewAnswerIdentity(id uint64) *Answer {
 
 	//convert id in payload 
 	Uint64ToByteArray(payload,id)
-	return &Answer{Identity, payload, nil}
+	return &Answer{MexType: Identity, Payload: payload}
+}
+
+/* Identity answer of a hub with resumable sessions. Payload is [id:8][token],
+ * the token lets the client claim the same id after a reconnection
+ */
+func NewAnswerSession(id uint64, token []byte) *Answer {
+
+	a := NewAnswerIdentity(id)
+	a.Payload = append(a.Payload, token...)
+	return a
 }
 
 func NewAnswerList(ids []uint64) *Answer {
 
 	//convert ids in payload 
 	payload := Uint64ArrayToByteArray(ids)
-	return &Answer{List, payload, nil}
+	return &Answer{MexType: List, Payload: payload}
+}
+
+//the hub is going away, no more answers will follow
+func NewAnswerShutdown() *Answer {
+	return &Answer{MexType: Shutdown}
+}
+
+//challenge sent by the hub, the client must answer with an Auth request
+func NewAnswerChallenge(nonce []byte) *Answer {
+	return &Answer{MexType: Auth, Payload: nonce}
+}
+
+//payload is [code:1][description]
+func NewAnswerError(code byte, text string) *Answer {
+	return &Answer{MexType: Error, Payload: append([]byte{code}, text...)}
+}
+
+/* Report answer payload is [seq:8] followed by [id:8][status:1] for every receiver.
+ * The seq is the one stamped on the relay delivered to the receivers
+ */
+func NewAnswerReport(seq uint64, report []Delivery) *Answer {
+
+	payload := make([]byte, 8, 8+len(report)*DELIVERY_SIZE)
+	Uint64ToByteArray(payload, seq)
+
+	entry := make([]byte, DELIVERY_SIZE)
+	for _, d := range report {
+		Uint64ToByteArray(entry, d.Id)
+		entry[8] = d.Status
+		payload = append(payload, entry...)
+	}
+
+	return &Answer{MexType: Report, Payload: payload}
+}
+
+/* Publish answer payload is [sender:8][seq:8][topic length:2][topic][body].
+ * Sender and seq are the same as for relays
+ */
+func NewAnswerPublish(sender uint64, seq uint64, topic string, p []byte) *Answer {
+
+	payload := make([]byte, RELAY_HEADER_SIZE, RELAY_HEADER_SIZE+TOPIC_LEN_SIZE+len(topic)+len(p))
+
+	Uint64ToByteArray(payload[:8], sender)
+	Uint64ToByteArray(payload[8:RELAY_HEADER_SIZE], seq)
+
+	payload = appendTopic(payload, topic)
+	return &Answer{MexType: Publish, Payload: append(payload, p...)}
+}
+
+//confirms a request that has no other answer, like Subscribe
+func NewAnswerOk() *Answer {
+	return &Answer{MexType: Ok}
+}
+
+//a client connected, sent to the clients watching presence
+func NewAnswerPeerJoined(id uint64) *Answer {
+	return newAnswerPresence(PeerJoined, id)
+}
+
+//a client disconnected, or its id was taken back by a resumed session
+func NewAnswerPeerLeft(id uint64) *Answer {
+	return newAnswerPresence(PeerLeft, id)
+}
+
+func newAnswerPresence(mexType byte, id uint64) *Answer {
+	payload := make([]byte, 8)
+	Uint64ToByteArray(payload, id)
+	return &Answer{MexType: mexType, Payload: payload}
+}
+
+//payload is a serialized StatBucket
+func NewAnswerStat(stats []byte) *Answer {
+	return &Answer{MexType: Stat, Payload: stats}
 }
 
-func NewAnswerRelay(p []byte) *Answer {
-	return &Answer{Relay, p, nil}
+/* Relay answer payload is [sender:8][seq:8][body] */
+func NewAnswerRelay(sender uint64, seq uint64, p []byte) *Answer {
+
+	payload := make([]byte, RELAY_HEADER_SIZE, RELAY_HEADER_SIZE+len(p))
+
+	Uint64ToByteArray(payload[:8], sender)
+	Uint64ToByteArray(payload[8:RELAY_HEADER_SIZE], seq)
+
+	return &Answer{MexType: Relay, Payload: append(payload, p...)}
 }
 
 func (a *Answer) Type() byte {
@@ -78,19 +292,36 @@ func (a *Answer) Type() byte {
 
 func (a *Answer) Id() uint64 {
 
-	if a.MexType == Identity && a.Payload != nil && len(a.Payload) > 0 {
+	if a.MexType == Identity && len(a.Payload) >= 8 {
+		return ByteArrayToUint64(a.Payload[:8])
+	}
+	return 0
+}
+
+//peer of a presence event
+func (a *Answer) Peer() uint64 {
+
+	if (a.MexType == PeerJoined || a.MexType == PeerLeft) && len(a.Payload) == 8 {
 		return ByteArrayToUint64(a.Payload)
 	}
 	return 0
 }
 
+//session token following the id, nil if the hub doesn't resume sessions
+func (a *Answer) Token() []byte {
+	if a.MexType == Identity && len(a.Payload) > 8 {
+		return a.Payload[8:]
+	}
+	return nil
+}
+
 func (a *Answer) List() []uint64 {
 
 	if a.cachedList != nil {
 		return a.cachedList
 	}
 
-	if a.MexType == List && a.Payload != nil && len(a.Payload) > 0 {
+	if (a.MexType == List || a.MexType == GroupMembers) && len(a.Payload) > 0 {
 		return ByteArrayToUint64Array(a.Payload)
 	}
 	return nil
@@ -102,7 +333,89 @@ func (a *Answer) ListAndCache() []uint64 {
 }
 
 func (a *Answer) Body() []byte {
-	if a.MexType == Relay && a.Payload != nil && len(a.Payload) > 0 {
+	if a.MexType == Relay && len(a.Payload) > RELAY_HEADER_SIZE {
+		return a.Payload[RELAY_HEADER_SIZE:]
+	}
+	if (a.MexType == Publish || a.MexType == GroupRelay) && len(a.Payload) >= RELAY_HEADER_SIZE {
+		if _, body, err := decodeTopic(a.Payload[RELAY_HEADER_SIZE:]); err == nil && len(body) > 0 {
+			return body
+		}
+	}
+	if a.MexType == Chunk && len(a.Payload) > CHUNK_HEADER_SIZE {
+		return a.Payload[CHUNK_HEADER_SIZE:]
+	}
+	return nil
+}
+
+//topic of a published message
+func (a *Answer) Topic() string {
+	if a.MexType == Publish && len(a.Payload) >= RELAY_HEADER_SIZE {
+		topic, _, _ := decodeTopic(a.Payload[RELAY_HEADER_SIZE:])
+		return topic
+	}
+	return ""
+}
+
+//id of the client that sent the relay or published the message
+func (a *Answer) Sender() uint64 {
+	if (a.MexType == Relay || a.MexType == Publish || a.MexType == GroupRelay || a.MexType == Chunk) && len(a.Payload) >= 8 {
+		return ByteArrayToUint64(a.Payload[:8])
+	}
+	return 0
+}
+
+//sequence number of the relay among the ones sent by the same client
+func (a *Answer) Seq() uint64 {
+	if (a.MexType == Relay || a.MexType == Publish || a.MexType == GroupRelay) && len(a.Payload) >= RELAY_HEADER_SIZE {
+		return ByteArrayToUint64(a.Payload[8:RELAY_HEADER_SIZE])
+	}
+	if a.MexType == Report && len(a.Payload) >= 8 {
+		return ByteArrayToUint64(a.Payload[:8])
+	}
+	return 0
+}
+
+//delivery status of a relay for each receiver, in the order of the request
+func (a *Answer) Report() []Delivery {
+
+	if a.MexType != Report || len(a.Payload) < 8 {
+		return nil
+	}
+
+	entries := a.Payload[8:]
+	out := make([]Delivery, len(entries) / DELIVERY_SIZE)
+
+	for i := range out {
+		entry := entries[i*DELIVERY_SIZE:(i+1)*DELIVERY_SIZE]
+		out[i] = Delivery{ByteArrayToUint64(entry[:8]), entry[8]}
+	}
+	return out
+}
+
+func (a *Answer) Nonce() []byte {
+	if a.MexType == Auth && len(a.Payload) > 0 {
+		return a.Payload
+	}
+	return nil
+}
+
+func (a *Answer) ErrorCode() byte {
+	if a.MexType == Error && len(a.Payload) > 0 {
+		return a.Payload[0]
+	}
+	return CodeUnknown
+}
+
+func (a *Answer) ErrorText() string {
+	if a.MexType == Error && len(a.Payload) > 0 {
+		return string(a.Payload[1:])
+	}
+	return ""
+}
+
+//serialized statistics, to be decoded by a StatBucket
+func (a *Answer) Stats() []byte {
+	if a.MexType == Stat && len(a.Payload) > 0 {
 		return a.Payload
 	}
 	return nil
@@ -110,23 +423,87 @@ func (a *Answer) Body() []byte {
 
 func (a *Answer) Clear() {
 	a.MexType 	= Empty
+	a.Corr 		= 0
 	a.Payload 	= nil
 	a.cachedList = nil
 }
 
 func (a *Answer) ToByteArray() []byte {
-	return append([]byte{a.MexType}, a.Payload...)
+	return append(encodeHeader(a.MexType, a.Corr), a.Payload...)
 }
 
 func (a *Answer) FromByteArray(arr []byte) error {
-	
-	//error if null or empty data
-	if arr == nil || len(arr) == 0 {
-		return errors.New("Buffer cannot be empty")
+
+	a.Clear()
+
+	mexType, corr, payload, err := decodeHeader(arr)
+	if err != nil {
+		return err
+	}
+
+	//check that the payload can be interpreted by the accessors
+	switch mexType {
+	case Identity:
+		if len(payload) < 8 {
+			return ErrTruncated
+		}
+	case List, Stat, GroupMembers:
+		if len(payload) % 8 != 0 {
+			return ErrTruncated
+		}
+	case PeerJoined, PeerLeft:
+		if len(payload) != 8 {
+			return ErrTruncated
+		}
+	case Relay:
+		if len(payload) < RELAY_HEADER_SIZE {
+			return ErrTruncated
+		}
+		if len(payload) - RELAY_HEADER_SIZE > MAX_PAYLOAD {
+			return ErrPayloadTooLarge
+		}
+	case Auth, Error:
+		if len(payload) == 0 {
+			return ErrTruncated
+		}
+	case Report:
+		if len(payload) < 8 || (len(payload) - 8) % DELIVERY_SIZE != 0 {
+			return ErrTruncated
+		}
+	case Publish, GroupRelay:
+		if len(payload) < RELAY_HEADER_SIZE {
+			return ErrTruncated
+		}
+		_, body, err := decodeTopic(payload[RELAY_HEADER_SIZE:])
+		if err != nil {
+			return err
+		}
+		if len(body) > MAX_PAYLOAD {
+			return ErrPayloadTooLarge
+		}
+	case Hello:
+		if len(payload) < HELLO_ANSWER_SIZE {
+			return ErrTruncated
+		}
+	case Chunk:
+		if len(payload) < CHUNK_HEADER_SIZE {
+			return ErrTruncated
+		}
+		if len(payload) - CHUNK_HEADER_SIZE > CHUNK_LEN {
+			return ErrPayloadTooLarge
+		}
+	case Directory:
+		if _, err := decodeDirectory(payload); err != nil {
+			return err
+		}
+	case Shutdown, Ok:
+	default:
+		return ErrUnknownType
 	}
 
-	a.MexType = arr[0]
-	a.Payload = arr[1:]
+	a.MexType = mexType
+	a.Corr 	  = corr
+	a.Payload = payload
 
 	return nil
 }
@@ -135,12 +512,56 @@ func (a *Answer) FromByteArray(arr []byte) error {
 * Request related methods
 ****/
 func NewRequest(reqType byte) *Request {
-	return &Request{reqType, nil, nil}
+	return &Request{MexType: reqType}
+}
+
+//answer to the hub challenge, the body is the credential
+func NewAuthRequest(credential []byte) *Request {
+	return &Request{MexType: Auth, Body: credential}
+}
+
+//claim the id of a previous session, the body is the session token
+func NewResumeRequest(token []byte) *Request {
+	return &Request{MexType: Resume, Body: token}
+}
+
+func NewSubscribeRequest(topic string) *Request {
+
+	if !validTopic(topic) {
+		return nil
+	}
+	return &Request{MexType: Subscribe, Topic: topic}
+}
+
+func NewUnsubscribeRequest(topic string) *Request {
+
+	if !validTopic(topic) {
+		return nil
+	}
+	return &Request{MexType: Unsubscribe, Topic: topic}
+}
+
+//send the body to all the clients subscribed to the topic
+func NewPublishRequest(topic string, body []byte) *Request {
+
+	if !validTopic(topic) || len(body) > MAX_PAYLOAD {
+		return nil
+	}
+	return &Request{MexType: Publish, Topic: topic, Body: body}
+}
+
+//send the body to all the connected clients, without listing them
+func NewBroadcastRequest(body []byte, excludeSelf bool) *Request {
+
+	if len(body) > MAX_PAYLOAD {
+		return nil
+	}
+	return &Request{MexType: Broadcast, Exclude: excludeSelf, Body: body}
 }
 
 func NewRelayRequest(rec []uint64, body []byte) *Request {
 
-	if(len(rec) > 255){
+	if(len(rec) > MAX_RECEIVERS){
 		return nil
 	}
 
@@ -148,7 +569,7 @@ func NewRelayRequest(rec []uint64, body []byte) *Request {
 		return nil
 	}
 
-	return &Request{Relay, rec, body}
+	return &Request{MexType: Relay, Receivers: rec, Body: body}
 }
 
 func (r *Request) Type() byte {
@@ -157,26 +578,72 @@ func (r *Request) Type() byte {
 
 func (r *Request) Clear() {
 	r.MexType 	= Empty
+	r.Corr 		= 0
+	r.Ack 		= false
+	r.Topic 	= ""
+	r.Exclude 	= false
+	r.Stream 	= 0
+	r.Flags 	= 0
 	r.Receivers = nil
 	r.Body 		= nil
 }
 
 func (r *Request) ToByteArray() []byte {
+
+	mexType := r.MexType
+	if r.Ack {
+		mexType |= FLAG_ACK
+	}
+
+	//wide relays need the varint format
+	if r.MexType == Relay && len(r.Receivers) > LEGACY_MAX_RECEIVERS {
+		mexType += RelayVarint - Relay
+	}
+
+	header := encodeHeader(mexType, r.Corr)
 	
-	//for simple messages, only one byte is necessary
+	//credential, token, versions, tags or filter follow the type
+	if r.MexType == Auth || r.MexType == Resume || r.MexType == Hello || r.MexType == Register || r.MexType == Directory {
+		return append(header, r.Body...)
+	}
+
+	//topic or group, followed by the body for publish, group relay and create group
+	if r.MexType == Subscribe || r.MexType == Unsubscribe || r.MexType == Publish || isGroupRequest(r.MexType) {
+		return append(appendTopic(header, r.Topic), r.Body...)
+	}
+
+	if r.MexType == Chunk {
+		return r.appendChunk(header)
+	}
+
+	//exclude flag, followed by the body
+	if r.MexType == Broadcast {
+		var exclude byte
+		if r.Exclude {
+			exclude = 1
+		}
+		return append(append(header, exclude), r.Body...)
+	}
+
+	//for simple messages, only the header is necessary
 	if r.MexType != Relay {
-		return []byte{r.MexType}
+		return header
 	}
 	
 	//calculate total length of output bytearray
 	receiversLength := len(r.Receivers)
-	dimension 		:= 2 + ( receiversLength * 8 ) + len(r.Body)
+	if receiversLength > LEGACY_MAX_RECEIVERS {
+		return r.appendVarintRelay(header)
+	}
+
+	dimension := len(header) + 1 + ( receiversLength * 8 ) + len(r.Body)
 
 	//create array that fits the data exactly 
 	arr := make([]byte, 0, dimension)
 
 	//append message type and receivers length (max 255)
-	arr = append(arr, r.MexType, byte(receiversLength))
+	arr = append(arr, header...)
+	arr = append(arr, byte(receiversLength))
 	
 	//convert and append list of receivers
 	arr = append(arr, Uint64ArrayToByteArray(r.Receivers)...)
@@ -185,34 +652,308 @@ func (r *Request) ToByteArray() []byte {
 	return append(arr, r.Body...)
 }
 
+//encode a relay in the varint format, with deltas if they are shorter than the ids
+func (r *Request) appendVarintRelay(header []byte) []byte {
+
+	deltas := appendDeltas(make([]byte, 0, len(r.Receivers)*2), r.Receivers)
+
+	encoding, receivers := RECEIVERS_DELTA, deltas
+	if len(deltas) >= len(r.Receivers)*8 {
+		encoding, receivers = RECEIVERS_FIXED, Uint64ArrayToByteArray(r.Receivers)
+	}
+
+	arr := make([]byte, 0, len(header) + 1 + binary.MaxVarintLen64 + len(receivers) + len(r.Body))
+	arr = append(arr, header...)
+	arr = append(arr, encoding)
+	arr = binary.AppendUvarint(arr, uint64(len(r.Receivers)))
+	arr = append(arr, receivers...)
+
+	return append(arr, r.Body...)
+}
+
 func (r *Request) FromByteArray(arr []byte) error {
 
-	//error if null or empty data
-	if arr == nil || len(arr) == 0 {
-		return errors.New("Buffer cannot be empty")
+	r.Clear()
+
+	mexType, corr, data, err := decodeHeader(arr)
+	if err != nil {
+		return err
 	}
 
-	//assign message type
-	r.MexType = arr[0]
+	//both relay formats decode to a Relay
+	varint := mexType &^ FLAG_ACK == RelayVarint
+	if varint {
+		mexType -= RelayVarint - Relay
+	}
 
-	//if the message is not Relay, we're done 
-	if(r.MexType != Relay){
-		return nil
+	//only relays can ask for a report
+	ack := mexType & FLAG_ACK != 0
+	mexType &^= FLAG_ACK
+	if ack && mexType != Relay {
+		return ErrUnknownType
+	}
+
+	switch mexType {
+	case Identity, List, Stat, WatchPresence, UnwatchPresence:
+		//simple messages, we're done
+	case Auth, Resume:
+		if len(data) == 0 {
+			return ErrTruncated
+		}
+		r.Body = data
+	case Hello:
+		if len(data) < HELLO_REQUEST_SIZE {
+			return ErrTruncated
+		}
+		r.Body = data
+	case Register:
+		if len(data) > MAX_TAGS_SIZE {
+			return ErrPayloadTooLarge
+		}
+		if _, n, err := decodeTags(data); err != nil {
+			return err
+		} else if n != len(data) {
+			return ErrInvalidTags
+		}
+		r.Body = data
+	case Directory:
+		if len(data) > MAX_FILTER_LEN {
+			return ErrPayloadTooLarge
+		}
+		if len(data) > 0 {
+			r.Body = data
+		}
+	case Relay:
+		decode := r.decodeRelay
+		if varint {
+			decode = r.decodeVarintRelay
+		}
+		if err := decode(data); err != nil {
+			return err
+		}
+	case Broadcast:
+		if len(data) < 1 {
+			return ErrTruncated
+		}
+		if data[0] > 1 {
+			return ErrUnknownType
+		}
+		if len(data) - 1 > MAX_PAYLOAD {
+			return ErrPayloadTooLarge
+		}
+		r.Exclude = data[0] == 1
+		if len(data) > 1 {
+			r.Body = data[1:]
+		}
+	case Chunk:
+		if err := r.decodeChunk(data); err != nil {
+			return err
+		}
+	case CreateGroup, JoinGroup, LeaveGroup, GroupRelay, GroupMembers:
+		name, body, err := decodeTopic(data)
+		if err != nil {
+			return err
+		}
+		if err := decodeGroupBody(mexType, body); err != nil {
+			return err
+		}
+		r.Topic = name
+		if len(body) > 0 {
+			r.Body = body
+		}
+	case Subscribe, Unsubscribe, Publish:
+		topic, body, err := decodeTopic(data)
+		if err != nil {
+			return err
+		}
+		if mexType != Publish && len(body) > 0 {
+			return ErrUnknownType
+		}
+		if len(body) > MAX_PAYLOAD {
+			return ErrPayloadTooLarge
+		}
+		r.Topic = topic
+		if len(body) > 0 {
+			r.Body = body
+		}
+	default:
+		return ErrUnknownType
+	}
+
+	r.MexType 	= mexType
+	r.Corr 		= corr
+	r.Ack 		= ack
+
+	return nil	
+}
+
+//data is what follows the header: [n:1][receivers:n*8][body]
+func (r *Request) decodeRelay(data []byte) error {
+
+	//need at least the number of receivers
+	if len(data) < 1 {
+		return ErrTruncated
 	}
 
 	//get number of receivers
-	receiversLength := int(arr[1])
+	receiversLength := int(data[0])
 	
 	//index from where the body starts
-	startBody := (receiversLength*8)+2
+	startBody := (receiversLength*8)+1
+
+	if len(data) < startBody {
+		return ErrTruncated
+	}
+
+	if len(data) - startBody > MAX_PAYLOAD {
+		return ErrPayloadTooLarge
+	}
 
 	//create slice for containing receivers
-	r.Receivers = ByteArrayToUint64Array(arr[2:startBody])
+	r.Receivers = ByteArrayToUint64Array(data[1:startBody])
 
 	//slice the body
-	r.Body = arr[startBody:]
+	r.Body = data[startBody:]
 
-	return nil	
+	return nil
+}
+
+//data is what follows the header: [encoding:1][n:uvarint][receivers][body]
+func (r *Request) decodeVarintRelay(data []byte) error {
+
+	if len(data) < 1 {
+		return ErrTruncated
+	}
+
+	encoding := data[0]
+	count, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return ErrTruncated
+	}
+
+	if count > uint64(MAX_RECEIVERS) {
+		return ErrTooManyReceivers
+	}
+
+	rest := data[1+n:]
+	receiversLength := int(count)
+
+	var receivers []uint64
+
+	switch encoding {
+	case RECEIVERS_FIXED:
+		if len(rest) < receiversLength*8 {
+			return ErrTruncated
+		}
+		receivers = ByteArrayToUint64Array(rest[:receiversLength*8])
+		rest = rest[receiversLength*8:]
+
+	case RECEIVERS_DELTA:
+		//every delta takes at least one byte
+		if len(rest) < receiversLength {
+			return ErrTruncated
+		}
+
+		receivers = make([]uint64, receiversLength)
+
+		var prev uint64
+		for i := range receivers {
+			delta, n := binary.Varint(rest)
+			if n <= 0 {
+				return ErrTruncated
+			}
+			prev += uint64(delta)
+			receivers[i] = prev
+			rest = rest[n:]
+		}
+
+	default:
+		return ErrUnknownType
+	}
+
+	if len(rest) > MAX_PAYLOAD {
+		return ErrPayloadTooLarge
+	}
+
+	r.Receivers = receivers
+	r.Body = rest
+	return nil
+}
+
+//append each id as the signed difference from the previous one, sorted ids take 1 or 2 bytes
+func appendDeltas(arr []byte, ids []uint64) []byte {
+
+	var prev uint64
+	for _, id := range ids {
+		arr = binary.AppendVarint(arr, int64(id - prev))
+		prev = id
+	}
+	return arr
+}
+
+func validTopic(topic string) bool {
+	return len(topic) > 0 && len(topic) <= MAX_TOPIC_LEN
+}
+
+//append [length:2][topic]
+func appendTopic(arr []byte, topic string) []byte {
+
+	length := make([]byte, TOPIC_LEN_SIZE)
+	binary.BigEndian.PutUint16(length, uint16(len(topic)))
+
+	arr = append(arr, length...)
+	return append(arr, topic...)
+}
+
+//split [length:2][topic][rest] in topic and rest
+func decodeTopic(data []byte) (string, []byte, error) {
+
+	if len(data) < TOPIC_LEN_SIZE {
+		return "", nil, ErrTruncated
+	}
+
+	end := TOPIC_LEN_SIZE + int(binary.BigEndian.Uint16(data))
+	if len(data) < end {
+		return "", nil, ErrTruncated
+	}
+
+	topic := string(data[TOPIC_LEN_SIZE:end])
+	if !validTopic(topic) {
+		return "", nil, ErrInvalidTopic
+	}
+	return topic, data[end:], nil
+}
+
+//type byte, followed by the correlation id only when it is set
+func encodeHeader(mexType byte, corr uint32) []byte {
+
+	if corr == 0 {
+		return []byte{mexType}
+	}
+
+	header := make([]byte, 1+CORR_SIZE)
+	header[0] = mexType | FLAG_CORRELATED
+	Uint32ToByteArray(header[1:], corr)
+	return header
+}
+
+//split a message in type, correlation id and the rest of the data
+func decodeHeader(arr []byte) (byte, uint32, []byte, error) {
+
+	//error if null or empty data
+	if len(arr) == 0 {
+		return Empty, 0, nil, ErrTruncated
+	}
+
+	if arr[0] & FLAG_CORRELATED == 0 {
+		return arr[0], 0, arr[1:], nil
+	}
+
+	if len(arr) < 1+CORR_SIZE {
+		return Empty, 0, nil, ErrTruncated
+	}
+
+	return arr[0] &^ FLAG_CORRELATED, ByteArrayToUint32(arr[1:1+CORR_SIZE]), arr[1+CORR_SIZE:], nil
 }
 
 func Uint64ToByteArray(out []byte, n uint64) {
@@ -9,6 +9,7 @@ import(
 
 
 var testId   = uint64(12345)
+var testSeq  = uint64(42)
 var testNum  = uint32(12345)
 var testList = testutils.GenList(255)
 var testBody = testutils.GenPayload(1024 * 1000)
@@ -16,7 +17,7 @@ var testListByte = message.Uint64ArrayToByteArray(testList)
 
 var tAns 	 = new(message.Answer)
 var tAnsList = message.NewAnswerList(testList)
-var tAnsBody = message.NewAnswerRelay(testBody)
+var tAnsBody = message.NewAnswerRelay(testId, testSeq, testBody)
 var tAnsListBytes = tAnsList.ToByteArray()
 var tAnsBodyBytes = tAnsBody.ToByteArray()
 
@@ -25,6 +26,8 @@ var tReqList = message.NewRequest(message.List)
 var tReqBody = message.NewRelayRequest(testList, testBody)
 var tReqListBytes = tReqList.ToByteArray()
 var tReqBodyBytes = tReqBody.ToByteArray()
+var tReqWide 	  = message.NewRelayRequest(testutils.GenList(10000), testBody)
+var tReqWideBytes = tReqWide.ToByteArray()
 
 var mockRW = testutils.NewMockRW(nil, true)
 
@@ -92,6 +95,18 @@ func Benchmark_RequestRelay_ToByteArray(b *testing.B) {
     }
 }
 
+func Benchmark_RequestWideRelay_FromByteArray(b *testing.B) {
+    for n := 0; n < b.N; n++ {
+        tReq.FromByteArray(tReqWideBytes)
+    }
+}
+
+func Benchmark_RequestWideRelay_ToByteArray(b *testing.B) {
+    for n := 0; n < b.N; n++ {
+        tReqWide.ToByteArray()
+    }
+}
+
 
 func TestConversion(t *testing.T){
 	buf := make([]byte,8)
@@ -189,7 +204,7 @@ func TestCreateList(t *testing.T) {
 func TestCreateRelay(t *testing.T) {
 
 	req := message.NewRelayRequest(testList, testBody)
-	ans := message.NewAnswerRelay(testBody)
+	ans := message.NewAnswerRelay(testId, testSeq, testBody)
 
 	if assert.NotNil(t, req, "Relay Request should not be nil") {
 		assert.Equal(t, req.Type(), message.Relay, "MessageType should be Relay" )
@@ -207,16 +222,21 @@ func TestCreateRelay(t *testing.T) {
 
 	
 	assert.Nil(t, testutils.CompareBytes(testBody, ans.Body()), "Body should be the same of the one provided")
+	assert.Equal(t, testId, ans.Sender(), "Sender not encoded correctly")
+	assert.Equal(t, testSeq, ans.Seq(), "Sequence number not encoded correctly")
 	assert.Equal(t, uint64(0), ans.Id(), "ID should return invalid value")
 	assert.Nil(t, ans.List(), "List should return invalid value")
-	
+
+	empty := message.NewAnswerRelay(testId, testSeq, nil)
+	assert.Nil(t, empty.Body(), "Empty relay should have no body")
+	assert.Equal(t, testId, empty.Sender(), "Sender should be encoded without body")
 }
 
 func TestAnswerConversion(t *testing.T){
 	
 	a1 := message.NewAnswerIdentity(testId)
 	a2 := message.NewAnswerList(testList)
-	a3 := message.NewAnswerRelay(testBody)
+	a3 := message.NewAnswerRelay(testId, testSeq, testBody)
 	
 	b1 := a1.ToByteArray()
 	b2 := a2.ToByteArray()
@@ -240,6 +260,8 @@ func TestAnswerConversion(t *testing.T){
 	assert.Nil(t, testutils.CompareAnswer(a1, c1), "Identity answer conversion wrong")
 	assert.Nil(t, testutils.CompareAnswer(a2, c2), "List answer conversion wrong")
 	assert.Nil(t, testutils.CompareAnswer(a3, c3), "Relay answer conversion wrong")
+	assert.Equal(t, testId, c3.Sender(), "Sender should survive conversion")
+	assert.Equal(t, testSeq, c3.Seq(), "Sequence number should survive conversion")
 
 }
 
@@ -284,9 +306,51 @@ func TestRequestConversion(t *testing.T){
 	assert.Nil(testutils.CompareRequests(m3, c3), "Relay request conversion wrong")	
 }
 
+func TestVarintRelay(t *testing.T){
+	assert := assert.New(t)
+
+	decoded := new(message.Request)
+
+	//up to 255 receivers the old format is kept
+	legacy := message.NewRelayRequest(testList, nil).ToByteArray()
+	assert.Equal(message.Relay, legacy[0], "Small relays should use the old format")
+	assert.Equal(2 + len(testList)*8, len(legacy), "Old format should have 8 bytes per receiver")
+
+	//consecutive ids take one byte each
+	sorted := message.NewRelayRequest(testutils.GenList(10000), testBody)
+	arr := sorted.ToByteArray()
+	assert.Equal(message.RelayVarint, arr[0], "Wide relays should use the varint format")
+	assert.Equal(message.RECEIVERS_DELTA, arr[1], "Sorted ids should be delta encoded")
+	assert.True(len(arr) < 10000*2 + len(testBody), "Delta encoding should be compact")
+	assert.Nil(decoded.FromByteArray(arr), "Delta encoded relay should decode")
+	assert.Nil(testutils.CompareRequests(sorted, decoded), "Delta encoded relay conversion wrong")
+
+	//scattered ids are cheaper as they are
+	scattered := make([]uint64, 1000)
+	for i := range scattered {
+		scattered[i] = uint64(i) << 60 | uint64(i)
+	}
+	wide := message.NewRelayRequest(scattered, testBody)
+	wide.Ack = true
+	wide.Corr = 3
+	arr = wide.ToByteArray()
+	assert.Equal(message.RelayVarint | message.FLAG_ACK | message.FLAG_CORRELATED, arr[0], "Flags should be combined")
+	assert.Equal(message.RECEIVERS_FIXED, arr[1+message.CORR_SIZE], "Scattered ids should not be delta encoded")
+	assert.Nil(decoded.FromByteArray(arr), "Fixed encoded relay should decode")
+	assert.Nil(testutils.CompareRequests(wide, decoded), "Fixed encoded relay conversion wrong")
+
+	//[varint relay][encoding][count][receivers]
+	assert.Nil(decoded.FromByteArray([]byte{message.RelayVarint, message.RECEIVERS_DELTA, 2, 2, 1}), "Handmade relay should decode")
+	assert.Equal([]uint64{1, 0}, decoded.Receivers, "Negative deltas should decode")
+	assert.Equal(message.ErrTruncated, decoded.FromByteArray([]byte{message.RelayVarint, message.RECEIVERS_DELTA, 3, 2}), "Missing receivers")
+	assert.Equal(message.ErrTruncated, decoded.FromByteArray([]byte{message.RelayVarint, message.RECEIVERS_FIXED}), "Missing count")
+	assert.Equal(message.ErrTooManyReceivers, decoded.FromByteArray([]byte{message.RelayVarint, message.RECEIVERS_FIXED, 0xff, 0xff, 0xff, 0xff, 0x0f}), "Count too large")
+	assert.Equal(message.ErrUnknownType, decoded.FromByteArray([]byte{message.RelayVarint, 9, 0}), "Unknown encoding")
+}
+
 func TestClearAnswer(t *testing.T){
 
-	a := message.NewAnswerRelay(testBody)
+	a := message.NewAnswerRelay(testId, testSeq, testBody)
 	a.Clear()
 
 	assert.Equal(t, message.Empty, a.Type(), "Cleared message type should be Empty")
@@ -301,4 +365,471 @@ func TestClearRequest(t *testing.T){
 	assert.Equal(t, m.Type(), message.Empty, "Cleared message type should be Empty")
 	assert.Nil(t, m.Receivers, "Cleared Receivers should be Nil")
 	assert.Nil(t, m.Body, "Cleared Body should be Nil")
-}
\ No newline at end of file
+}
+
+func TestDecodingErrors(t *testing.T){
+	assert := assert.New(t)
+
+	req := new(message.Request)
+	ans := new(message.Answer)
+
+	assert.Equal(message.ErrTruncated, req.FromByteArray(nil), "Empty request")
+	assert.Equal(message.ErrUnknownType, req.FromByteArray([]byte{99}), "Unknown request type")
+	assert.Equal(message.ErrUnknownType, req.FromByteArray([]byte{message.Empty}), "Empty is not a valid request")
+	assert.Equal(message.ErrTruncated, req.FromByteArray([]byte{message.Relay}), "Relay without receivers length")
+	assert.Equal(message.ErrTruncated, req.FromByteArray(tReqBodyBytes[:100]), "Relay with truncated receivers")
+	assert.Equal(message.Empty, req.Type(), "Failed decoding should leave the request empty")
+	assert.Nil(req.Receivers, "Failed decoding should leave the request empty")
+
+	assert.Equal(message.ErrTruncated, ans.FromByteArray(nil), "Empty answer")
+	assert.Equal(message.ErrUnknownType, ans.FromByteArray([]byte{99}), "Unknown answer type")
+	assert.Equal(message.ErrTruncated, ans.FromByteArray([]byte{message.Identity, 1, 2}), "Truncated identity")
+	assert.Equal(message.ErrTruncated, ans.FromByteArray(tAnsListBytes[:10]), "Truncated list")
+	assert.Equal(message.ErrTruncated, ans.FromByteArray(tAnsBodyBytes[:10]), "Truncated relay header")
+	assert.Equal(message.Empty, ans.Type(), "Failed decoding should leave the answer empty")
+}
+
+func TestCorrelation(t *testing.T){
+	assert := assert.New(t)
+
+	req := message.NewRelayRequest(testList, testBody)
+	req.Corr = 42
+
+	decodedReq := new(message.Request)
+	assert.Nil(decodedReq.FromByteArray(req.ToByteArray()), "Correlated request should decode")
+	assert.Equal(uint32(42), decodedReq.Corr, "Correlation id should be preserved")
+	assert.Equal(message.Relay, decodedReq.Type(), "Flag should not leak in the type")
+	assert.Nil(testutils.CompareRequests(req, decodedReq))
+
+	ans := message.NewAnswerList(testList)
+	ans.Corr = 7
+
+	decodedAns := new(message.Answer)
+	assert.Nil(decodedAns.FromByteArray(ans.ToByteArray()), "Correlated answer should decode")
+	assert.Equal(uint32(7), decodedAns.Corr, "Correlation id should be preserved")
+	assert.Nil(testutils.CompareList(testList, decodedAns.List()))
+
+	//uncorrelated messages keep the old encoding
+	assert.Len(message.NewRequest(message.List).ToByteArray(), 1, "Uncorrelated request has no correlation id")
+	assert.Equal(message.ErrTruncated, decodedReq.FromByteArray([]byte{message.List | message.FLAG_CORRELATED, 1}), "Truncated correlation id")
+}
+
+func TestSessionMessages(t *testing.T){
+	assert := assert.New(t)
+
+	token := testutils.GenPayload(16)
+
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerSession(testId, token).ToByteArray()), "Session answer should decode")
+	assert.Equal(message.Identity, ans.Type(), "Session answer is an Identity")
+	assert.Equal(testId, ans.Id(), "Id should be preserved")
+	assert.Equal(token, ans.Token(), "Token should be preserved")
+
+	assert.Nil(ans.FromByteArray(message.NewAnswerIdentity(testId).ToByteArray()), "Identity should decode")
+	assert.Nil(ans.Token(), "Plain identity has no token")
+
+	req := new(message.Request)
+	assert.Nil(req.FromByteArray(message.NewResumeRequest(token).ToByteArray()), "Resume request should decode")
+	assert.Equal(token, req.Body, "Token should be preserved")
+	assert.Equal(message.ErrTruncated, req.FromByteArray([]byte{message.Resume}), "Resume without token")
+}
+
+func TestReport(t *testing.T){
+	assert := assert.New(t)
+
+	report := []message.Delivery{
+		{Id: 1, Status: message.StatusDelivered},
+		{Id: 2, Status: message.StatusUnknown},
+		{Id: 3, Status: message.StatusStored},
+	}
+
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerReport(testSeq, report).ToByteArray()), "Report should decode")
+	assert.Equal(testSeq, ans.Seq(), "Seq should be preserved")
+	assert.Equal(report, ans.Report(), "Report should be preserved")
+	assert.Equal(message.ErrTruncated, ans.FromByteArray([]byte{message.Report, 0, 0, 0, 0, 0, 0, 0, 1, 5}), "Truncated report")
+
+	req := message.NewRelayRequest(testList, testBody)
+	req.Ack = true
+
+	decoded := new(message.Request)
+	assert.Nil(decoded.FromByteArray(req.ToByteArray()), "Ack relay should decode")
+	assert.True(decoded.Ack, "Ack should be preserved")
+	assert.Equal(message.Relay, decoded.Type(), "Flag should not leak in the type")
+	assert.Equal(message.ErrUnknownType, decoded.FromByteArray([]byte{message.List | message.FLAG_ACK}), "Only relays can be acknowledged")
+}
+
+func TestTopics(t *testing.T){
+	assert := assert.New(t)
+
+	decoded := new(message.Request)
+	for _, req := range []*message.Request{
+		message.NewSubscribeRequest("news"),
+		message.NewUnsubscribeRequest("news"),
+		message.NewPublishRequest("news", testBody),
+	}{
+		assert.Nil(decoded.FromByteArray(req.ToByteArray()), "Topic request should decode")
+		assert.Nil(testutils.CompareRequests(req, decoded))
+	}
+
+	assert.Nil(message.NewSubscribeRequest(""), "Empty topic is not valid")
+	assert.Nil(message.NewPublishRequest(string(testutils.GenPayload(message.MAX_TOPIC_LEN+1)), nil), "Topic too long")
+	assert.Equal(message.ErrTruncated, decoded.FromByteArray([]byte{message.Subscribe, 0, 9, 'a'}), "Truncated topic")
+	assert.Equal(message.ErrInvalidTopic, decoded.FromByteArray([]byte{message.Subscribe, 0, 0}), "Empty topic")
+
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerPublish(testId, testSeq, "news", testBody).ToByteArray()), "Publish answer should decode")
+	assert.Equal("news", ans.Topic(), "Topic should be preserved")
+	assert.Equal(testId, ans.Sender(), "Sender should be preserved")
+	assert.Equal(testSeq, ans.Seq(), "Seq should be preserved")
+	assert.Equal(testBody, ans.Body(), "Body should be preserved")
+
+	assert.Nil(ans.FromByteArray(message.NewAnswerOk().ToByteArray()), "Ok answer should decode")
+
+	//a payload shorter than the relay header has no topic and no body
+	for _, mexType := range []byte{message.Publish, message.GroupRelay} {
+		for _, payload := range [][]byte{nil, make([]byte, 10)} {
+			short := &message.Answer{MexType: mexType, Payload: payload}
+			assert.Nil(short.Body(), "Truncated answer has no body")
+			assert.Equal("", short.Topic(), "Truncated answer has no topic")
+		}
+	}
+}
+
+func TestBroadcast(t *testing.T){
+	assert := assert.New(t)
+
+	decoded := new(message.Request)
+	for _, req := range []*message.Request{
+		message.NewBroadcastRequest(testBody, true),
+		message.NewBroadcastRequest(testBody, false),
+		message.NewBroadcastRequest(nil, true),
+	}{
+		assert.Nil(decoded.FromByteArray(req.ToByteArray()), "Broadcast should decode")
+		assert.Nil(testutils.CompareRequests(req, decoded))
+		assert.Equal(req.Exclude, decoded.Exclude, "Exclude flag should be preserved")
+	}
+
+	assert.Nil(message.NewBroadcastRequest(testutils.GenPayload(message.MAX_PAYLOAD+1), false), "Body too large")
+	assert.Equal(message.ErrTruncated, decoded.FromByteArray([]byte{message.Broadcast}), "Missing exclude flag")
+	assert.Equal(message.ErrUnknownType, decoded.FromByteArray([]byte{message.Broadcast, 2}), "Invalid exclude flag")
+}
+
+func TestProtocol(t *testing.T){
+	assert := assert.New(t)
+
+	all := message.FeatureCompression | message.FeatureAcks | message.FeatureTopics
+
+	p, err := message.NegotiateProtocol(message.PROTOCOL_V1, 9, all, message.FeatureAcks)
+	assert.Nil(err, "Ranges should overlap")
+	assert.Equal(message.MAX_PROTOCOL_VERSION, p.Version, "Highest common version should be picked")
+	assert.True(p.Has(message.FeatureAcks), "Common feature should be agreed")
+	assert.False(p.Has(message.FeatureTopics), "Feature not supported by the hub should be refused")
+
+	p, err = message.NegotiateProtocol(message.PROTOCOL_V1, message.PROTOCOL_V1, all, all)
+	assert.Nil(err, "Old clients should be accepted")
+	assert.Equal(message.PROTOCOL_V1, p.Version, "Version should not exceed the client's")
+
+	_, err = message.NegotiateProtocol(9, 10, all, all)
+	assert.Equal(message.ErrUnsupportedVersion, err, "Newer clients should be refused")
+	_, err = message.NegotiateProtocol(0, 0, all, all)
+	assert.Equal(message.ErrUnsupportedVersion, err, "Version 0 does not exist")
+
+	req := new(message.Request)
+	assert.Nil(req.FromByteArray(message.NewHelloRequest(message.FeatureTopics).ToByteArray()), "Hello request should decode")
+	min, max := req.Versions()
+	assert.Equal(message.MIN_PROTOCOL_VERSION, min, "Min version should be preserved")
+	assert.Equal(message.MAX_PROTOCOL_VERSION, max, "Max version should be preserved")
+	assert.Equal(message.FeatureTopics, req.Features(), "Features should be preserved")
+	assert.Equal(message.ErrTruncated, req.FromByteArray([]byte{message.Hello, 1, 2}), "Truncated hello")
+
+	ans := new(message.Answer)
+	p = message.Protocol{Version: message.PROTOCOL_V2, Features: message.FeatureAcks}
+	assert.Nil(ans.FromByteArray(message.NewAnswerHello(p).ToByteArray()), "Hello answer should decode")
+	assert.Equal(p, ans.Protocol(), "Protocol should be preserved")
+	assert.Equal(message.ErrTruncated, ans.FromByteArray([]byte{message.Hello, 2}), "Truncated hello")
+}
+
+func TestChunk(t *testing.T){
+	assert := assert.New(t)
+
+	data := testutils.GenPayload(message.CHUNK_LEN)
+
+	decoded := new(message.Request)
+	for _, req := range []*message.Request{
+		message.NewChunkRequest(7, message.CHUNK_FIRST, testutils.GenList(300), data),
+		message.NewChunkRequest(7, message.CHUNK_FIRST | message.CHUNK_LAST, testList, nil),
+		message.NewChunkRequest(7, 0, nil, data),
+		message.NewChunkRequest(7, message.CHUNK_ABORT, nil, nil),
+	}{
+		assert.Nil(decoded.FromByteArray(req.ToByteArray()), "Chunk should decode")
+		assert.Nil(testutils.CompareRequests(req, decoded))
+	}
+
+	assert.Nil(message.NewChunkRequest(7, 0, nil, testutils.GenPayload(message.CHUNK_LEN+1)), "Chunk too large")
+	assert.Nil(message.NewChunkRequest(7, 0, testList, data), "Receivers only in the first chunk")
+	assert.Nil(message.NewChunkRequest(7, 8, nil, data), "Unknown flag")
+	assert.Equal(message.ErrTruncated, decoded.FromByteArray([]byte{message.Chunk, 0, 0, 0, 7}), "Missing flags")
+	assert.Equal(message.ErrTruncated, decoded.FromByteArray([]byte{message.Chunk, 0, 0, 0, 7, message.CHUNK_FIRST, 2, 1}), "Missing receivers")
+	assert.Equal(message.ErrUnknownType, decoded.FromByteArray([]byte{message.Chunk, 0, 0, 0, 7, 8}), "Unknown flag")
+
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerChunk(testId, 7, message.CHUNK_LAST, data).ToByteArray()), "Chunk answer should decode")
+	assert.Equal(testId, ans.Sender(), "Sender should be preserved")
+	assert.Equal(uint32(7), ans.Stream(), "Stream should be preserved")
+	assert.Equal(message.CHUNK_LAST, ans.ChunkFlags(), "Flags should be preserved")
+	assert.Equal(data, ans.Body(), "Data should be preserved")
+	assert.Equal(message.ErrTruncated, ans.FromByteArray([]byte{message.Chunk, 1, 2}), "Truncated chunk")
+}
+
+func TestPresence(t *testing.T){
+	assert := assert.New(t)
+
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerPeerJoined(testId).ToByteArray()), "Joined event should decode")
+	assert.Equal(message.PeerJoined, ans.Type(), "Type should be preserved")
+	assert.Equal(testId, ans.Peer(), "Peer should be preserved")
+
+	assert.Nil(ans.FromByteArray(message.NewAnswerPeerLeft(testId).ToByteArray()), "Left event should decode")
+	assert.Equal(message.PeerLeft, ans.Type(), "Type should be preserved")
+	assert.Equal(testId, ans.Peer(), "Peer should be preserved")
+	assert.Equal(uint64(0), ans.Id(), "Event is not an identity")
+
+	assert.Equal(message.ErrTruncated, ans.FromByteArray([]byte{message.PeerLeft, 1, 2}), "Truncated event")
+	assert.Equal(uint64(0), message.NewAnswerIdentity(testId).Peer(), "Identity is not an event")
+
+	req := new(message.Request)
+	for _, mexType := range []byte{message.WatchPresence, message.UnwatchPresence} {
+		assert.Nil(req.FromByteArray(message.NewRequest(mexType).ToByteArray()), "Presence request should decode")
+		assert.Equal(mexType, req.Type(), "Type should be preserved")
+	}
+}
+
+func TestDirectory(t *testing.T){
+	assert := assert.New(t)
+
+	tags := map[string]string{"name": "pricing", "role": "worker", "gpu": ""}
+
+	req := new(message.Request)
+	assert.Nil(req.FromByteArray(message.NewRegisterRequest(tags).ToByteArray()), "Register should decode")
+	assert.Equal(tags, req.Tags(), "Tags should be preserved")
+	assert.Equal(message.NewRegisterRequest(tags).Body, message.NewRegisterRequest(tags).Body, "Encoding should not depend on the map order")
+
+	assert.Nil(req.FromByteArray(message.NewDirectoryRequest("role=worker").ToByteArray()), "Directory request should decode")
+	assert.Equal("role=worker", req.Filter(), "Filter should be preserved")
+	assert.Nil(req.FromByteArray(message.NewDirectoryRequest("").ToByteArray()), "Empty filter should decode")
+	assert.Equal("", req.Filter(), "Empty filter should be preserved")
+
+	big := map[string]string{"blob": string(testutils.GenPayload(message.MAX_TAGS_SIZE))}
+	assert.Nil(message.NewRegisterRequest(big), "Tags too large")
+	assert.Nil(message.NewDirectoryRequest(string(testutils.GenPayload(message.MAX_FILTER_LEN+1))), "Filter too long")
+	assert.Equal(message.ErrTruncated, req.FromByteArray([]byte{message.Register, 1, 4, 'n'}), "Truncated tags")
+	assert.Equal(message.ErrInvalidTags, req.FromByteArray([]byte{message.Register, 0, 9}), "Trailing bytes")
+
+	peers := []message.PeerInfo{{Id: 1, Tags: tags}, {Id: 2, Tags: map[string]string{}}}
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerDirectory(peers).ToByteArray()), "Directory answer should decode")
+	assert.Equal(peers, ans.Directory(), "Peers should be preserved")
+
+	assert.Nil(ans.FromByteArray(message.NewAnswerDirectory(nil).ToByteArray()), "Empty directory should decode")
+	assert.Len(ans.Directory(), 0, "Directory should be empty")
+	assert.Equal(message.ErrTruncated, ans.FromByteArray([]byte{message.Directory, 0, 0, 0, 1}), "Truncated id")
+}
+
+func TestGroups(t *testing.T){
+	assert := assert.New(t)
+
+	decoded := new(message.Request)
+	for _, req := range []*message.Request{
+		message.NewCreateGroupRequest("room", 10, true),
+		message.NewCreateGroupRequest("room", 0, false),
+		message.NewGroupRequest(message.JoinGroup, "room"),
+		message.NewGroupRequest(message.LeaveGroup, "room"),
+		message.NewGroupRequest(message.GroupMembers, "room"),
+		message.NewGroupRelayRequest("room", testBody),
+	}{
+		assert.Nil(decoded.FromByteArray(req.ToByteArray()), "Group request should decode")
+		assert.Nil(testutils.CompareRequests(req, decoded))
+	}
+
+	decoded.FromByteArray(message.NewCreateGroupRequest("room", 10, true).ToByteArray())
+	assert.True(decoded.GroupOwned(), "Owner flag should be preserved")
+	assert.Equal(uint32(10), decoded.GroupLimit(), "Limit should be preserved")
+
+	assert.Nil(message.NewGroupRequest(message.JoinGroup, ""), "Empty name")
+	assert.Nil(message.NewGroupRelayRequest("room", testutils.GenPayload(message.MAX_PAYLOAD+1)), "Body too large")
+	assert.Equal(message.ErrTruncated, decoded.FromByteArray([]byte{message.CreateGroup, 0, 1, 'r', 1}), "Missing options")
+	assert.Equal(message.ErrUnknownType, decoded.FromByteArray([]byte{message.CreateGroup, 0, 1, 'r', 2, 0, 0, 0, 0}), "Invalid owner flag")
+	assert.Equal(message.ErrUnknownType, decoded.FromByteArray([]byte{message.JoinGroup, 0, 1, 'r', 9}), "Join has no body")
+
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerGroupRelay(testId, testSeq, "room", testBody).ToByteArray()), "Group relay should decode")
+	assert.Equal(message.GroupRelay, ans.Type(), "Type should be preserved")
+	assert.Equal("room", ans.Group(), "Group should be preserved")
+	assert.Equal("", ans.Topic(), "Group relay has no topic")
+	assert.Equal(testId, ans.Sender(), "Sender should be preserved")
+	assert.Equal(testSeq, ans.Seq(), "Seq should be preserved")
+	assert.Equal(testBody, ans.Body(), "Body should be preserved")
+
+	assert.Nil(ans.FromByteArray(message.NewAnswerGroupMembers(testList).ToByteArray()), "Members should decode")
+	assert.Nil(testutils.CompareList(testList, ans.List()), "Members should be preserved")
+}
+
+func TestAuthMessages(t *testing.T){
+	assert := assert.New(t)
+
+	nonce := testutils.GenPayload(message.NONCE_SIZE)
+	key := []byte("secret key")
+
+	ans := new(message.Answer)
+	assert.Nil(ans.FromByteArray(message.NewAnswerChallenge(nonce).ToByteArray()), "Challenge should decode")
+	assert.Equal(nonce, ans.Nonce(), "Nonce should be preserved")
+
+	assert.Nil(ans.FromByteArray(message.NewAnswerError(message.CodeAuthFailed, "denied").ToByteArray()), "Error should decode")
+	assert.Equal(message.CodeAuthFailed, ans.ErrorCode(), "Error code should be preserved")
+	assert.Equal("denied", ans.ErrorText(), "Error text should be preserved")
+
+	cred := message.NewHMACCredential("worker", key, nonce)
+	req := new(message.Request)
+	assert.Nil(req.FromByteArray(message.NewAuthRequest(cred).ToByteArray()), "Auth request should decode")
+	assert.Equal(cred, req.Body, "Credential should be preserved")
+
+	principal, sig, err := message.ParseHMACCredential(req.Body)
+	assert.Nil(err, "Credential should parse")
+	assert.Equal("worker", principal, "Principal should be preserved")
+	assert.Equal(message.SignNonce(key, nonce), sig, "Signature should match the nonce")
+
+	_, _, err = message.ParseHMACCredential(cred[:10])
+	assert.Equal(message.ErrTruncated, err, "Truncated credential")
+}
+
+//seeds cover every message type, both well formed and truncated
+func FuzzRequestFromByteArray(f *testing.F) {
+
+	seeds := [][]byte{
+		message.NewRequest(message.Identity).ToByteArray(),
+		message.NewRequest(message.List).ToByteArray(),
+		message.NewRequest(message.Stat).ToByteArray(),
+		message.NewRelayRequest(testutils.GenList(3), []byte("hello")).ToByteArray(),
+		message.NewRelayRequest([]uint64{}, nil).ToByteArray(),
+		{message.Relay},
+		{message.Relay, 200, 1, 2, 3},
+		message.NewAuthRequest([]byte("token")).ToByteArray(),
+		{message.Auth},
+		message.NewResumeRequest([]byte("token")).ToByteArray(),
+		{message.Relay | message.FLAG_CORRELATED, 0, 0, 0, 1, 0},
+		{message.List | message.FLAG_CORRELATED, 0},
+		{message.Relay | message.FLAG_ACK, 1, 0, 0, 0, 0, 0, 0, 0, 1, 9},
+		message.NewRelayRequest(testutils.GenList(300), []byte("hello")).ToByteArray(),
+		{message.RelayVarint, message.RECEIVERS_DELTA, 2, 2, 1, 9},
+		{message.RelayVarint, message.RECEIVERS_FIXED, 1, 0, 0, 0, 0, 0, 0, 0, 7},
+		message.NewSubscribeRequest("a/b").ToByteArray(),
+		message.NewUnsubscribeRequest("a/b").ToByteArray(),
+		message.NewPublishRequest("a/b", []byte("hello")).ToByteArray(),
+		{message.Publish, 0, 5, 'a'},
+		message.NewBroadcastRequest([]byte("hello"), true).ToByteArray(),
+		{message.Broadcast, 3},
+		message.NewHelloRequest(message.FeatureAcks).ToByteArray(),
+		{message.Hello, 1},
+		message.NewChunkRequest(7, message.CHUNK_FIRST, testutils.GenList(3), []byte("hello")).ToByteArray(),
+		message.NewChunkRequest(7, message.CHUNK_LAST, nil, []byte("hello")).ToByteArray(),
+		{message.Chunk, 0, 0, 0, 7, message.CHUNK_FIRST, 200},
+		message.NewRequest(message.WatchPresence).ToByteArray(),
+		message.NewRequest(message.UnwatchPresence).ToByteArray(),
+		message.NewRegisterRequest(map[string]string{"role": "worker"}).ToByteArray(),
+		message.NewDirectoryRequest("role=worker !gpu").ToByteArray(),
+		{message.Register, 2, 1, 'a'},
+		message.NewCreateGroupRequest("room", 3, true).ToByteArray(),
+		message.NewGroupRequest(message.JoinGroup, "room").ToByteArray(),
+		message.NewGroupRelayRequest("room", []byte("hello")).ToByteArray(),
+		{message.CreateGroup, 0, 1, 'r', 1, 0},
+		{message.Empty},
+		{},
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req := new(message.Request)
+		if req.FromByteArray(data) != nil {
+			return
+		}
+
+		//whatever is accepted must survive a round trip
+		again := new(message.Request)
+		if err := again.FromByteArray(req.ToByteArray()); err != nil {
+			t.Fatalf("re-encoded request not valid: %v", err)
+		}
+		if err := testutils.CompareRequests(req, again); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzAnswerFromByteArray(f *testing.F) {
+
+	seeds := [][]byte{
+		message.NewAnswerIdentity(testId).ToByteArray(),
+		message.NewAnswerList(testutils.GenList(3)).ToByteArray(),
+		message.NewAnswerList([]uint64{}).ToByteArray(),
+		message.NewAnswerRelay(testId, testSeq, []byte("hello")).ToByteArray(),
+		message.NewAnswerStat(make([]byte, 8*7)).ToByteArray(),
+		{message.Identity, 1},
+		{message.Relay, 1, 2},
+		message.NewAnswerChallenge([]byte("nonce")).ToByteArray(),
+		message.NewAnswerError(message.CodeAuthFailed, "denied").ToByteArray(),
+		message.NewAnswerShutdown().ToByteArray(),
+		message.NewAnswerSession(testId, []byte("token")).ToByteArray(),
+		message.NewAnswerReport(testSeq, []message.Delivery{{Id: testId, Status: message.StatusDropped}}).ToByteArray(),
+		message.NewAnswerPublish(testId, testSeq, "a/b", []byte("hello")).ToByteArray(),
+		message.NewAnswerOk().ToByteArray(),
+		message.NewAnswerHello(message.LegacyProtocol).ToByteArray(),
+		message.NewAnswerChunk(testId, 7, message.CHUNK_FIRST, []byte("hello")).ToByteArray(),
+		{message.Chunk, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0},
+		message.NewAnswerPeerJoined(testId).ToByteArray(),
+		message.NewAnswerPeerLeft(testId).ToByteArray(),
+		message.NewAnswerDirectory([]message.PeerInfo{{Id: testId, Tags: map[string]string{"role": "worker"}}}).ToByteArray(),
+		{message.Directory, 0, 0, 0, 0, 0, 0, 0, 1, 3},
+		message.NewAnswerGroupRelay(testId, testSeq, "room", []byte("hello")).ToByteArray(),
+		message.NewAnswerGroupMembers(testutils.GenList(3)).ToByteArray(),
+		{message.Identity | message.FLAG_CORRELATED, 0, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0, 1},
+		{message.Empty},
+		{},
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ans := new(message.Answer)
+		if ans.FromByteArray(data) != nil {
+			return
+		}
+
+		//accessors must not panic on accepted input
+		ans.Id()
+		ans.List()
+		ans.Body()
+		ans.Sender()
+		ans.Seq()
+		ans.Stats()
+		ans.Protocol()
+		ans.Stream()
+		ans.ChunkFlags()
+		ans.Peer()
+		ans.Directory()
+		ans.Group()
+		ans.Topic()
+
+		again := new(message.Answer)
+		if err := again.FromByteArray(ans.ToByteArray()); err != nil {
+			t.Fatalf("re-encoded answer not valid: %v", err)
+		}
+		if err := testutils.CompareAnswer(ans, again); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
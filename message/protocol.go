@@ -0,0 +1,111 @@
+package message
+
+import(
+	"errors"
+	"encoding/binary"
+)
+
+/* Protocol versions. A client that doesn't say Hello speaks PROTOCOL_V1 */
+const(
+	//the frame header is the length of the frame
+	PROTOCOL_V1 = byte(1)
+
+	//the top bits of the frame header are reserved for frame flags
+	PROTOCOL_V2 = byte(2)
+
+	MIN_PROTOCOL_VERSION = PROTOCOL_V1
+	MAX_PROTOCOL_VERSION = PROTOCOL_V2
+
+	//optional features, negotiated together with the version
+	FeatureCompression 	= uint32(1)
+	FeatureAcks 		= uint32(2)
+	FeatureTopics 		= uint32(4)
+	FeaturePresence 	= uint32(8)
+	FeatureTags 		= uint32(16)
+	FeatureGroups 		= uint32(32)
+
+	//Hello request is [min version:1][max version:1][features:4]
+	HELLO_REQUEST_SIZE = 6
+
+	//Hello answer is [version:1][features:4]
+	HELLO_ANSWER_SIZE = 5
+)
+
+var ErrUnsupportedVersion = errors.New("No protocol version in common")
+
+/* Version and features agreed by the two ends of a connection */
+type Protocol struct {
+	Version 	byte
+	Features 	uint32
+}
+
+//what a client is assumed to speak when it doesn't negotiate
+var LegacyProtocol = Protocol{Version: PROTOCOL_V1, Features: FeatureAcks | FeatureTopics}
+
+func (p Protocol) Has(feature uint32) bool {
+	return p.Features & feature == feature
+}
+
+/* Pick the highest version in both ranges, and the features both ends support.
+ * Used by the hub on the client's Hello
+ */
+func NegotiateProtocol(min byte, max byte, offered uint32, supported uint32) (Protocol, error) {
+
+	version := max
+	if version > MAX_PROTOCOL_VERSION {
+		version = MAX_PROTOCOL_VERSION
+	}
+
+	if version < min || version < MIN_PROTOCOL_VERSION {
+		return Protocol{}, ErrUnsupportedVersion
+	}
+
+	return Protocol{Version: version, Features: offered & supported}, nil
+}
+
+//advertise all the versions this package speaks and the features wanted
+func NewHelloRequest(features uint32) *Request {
+
+	body := make([]byte, HELLO_REQUEST_SIZE)
+	body[0] = MIN_PROTOCOL_VERSION
+	body[1] = MAX_PROTOCOL_VERSION
+	binary.BigEndian.PutUint32(body[2:], features)
+
+	return &Request{MexType: Hello, Body: body}
+}
+
+//range of versions advertised by a Hello request
+func (r *Request) Versions() (byte, byte) {
+	if r.MexType == Hello && len(r.Body) >= HELLO_REQUEST_SIZE {
+		return r.Body[0], r.Body[1]
+	}
+	return 0, 0
+}
+
+//features advertised by a Hello request
+func (r *Request) Features() uint32 {
+	if r.MexType == Hello && len(r.Body) >= HELLO_REQUEST_SIZE {
+		return binary.BigEndian.Uint32(r.Body[2:HELLO_REQUEST_SIZE])
+	}
+	return 0
+}
+
+//the protocol chosen by the hub
+func NewAnswerHello(p Protocol) *Answer {
+
+	payload := make([]byte, HELLO_ANSWER_SIZE)
+	payload[0] = p.Version
+	binary.BigEndian.PutUint32(payload[1:], p.Features)
+
+	return &Answer{MexType: Hello, Payload: payload}
+}
+
+func (a *Answer) Protocol() Protocol {
+	if a.MexType == Hello && len(a.Payload) >= HELLO_ANSWER_SIZE {
+		return Protocol{
+			Version: 	a.Payload[0],
+			Features: 	binary.BigEndian.Uint32(a.Payload[1:HELLO_ANSWER_SIZE]),
+		}
+	}
+	return Protocol{}
+}
@@ -0,0 +1,131 @@
+package metadata
+
+import(
+	"errors"
+	"strings"
+	"unicode"
+)
+
+/* Clients describe themselves with a map of tags, some of them with a well known
+ * meaning. Peers are found with a filter on the tags, made of terms separated by
+ * spaces, all of which must match:
+ * "key=value" the tag has the value, a value ending with WILDCARD matches by prefix
+ * "key!=value" the tag is missing or has another value
+ * "key" the tag is present, "!key" the tag is missing
+ * An empty filter matches every client. Keys and values can't contain spaces
+ */
+const(
+	NAME 	= "name"
+	ROLE 	= "role"
+	VERSION = "version"
+
+	EQUAL 	 = "="
+	NOT 	 = "!"
+	WILDCARD = "*"
+
+	MAX_TAGS 		= 32
+	MAX_KEY_LEN 	= 64
+	MAX_VALUE_LEN 	= 256
+)
+
+var(
+	ErrTooManyTags 	= errors.New("Too many tags")
+	ErrKey 			= errors.New("Tag keys must be non empty, without spaces or operators")
+	ErrValue 		= errors.New("Tag values must be short and without spaces")
+	ErrFilter 		= errors.New("Malformed filter term")
+)
+
+//one term of a filter
+type term struct {
+	key 	string
+	value 	string
+
+	//true for key=value and key!=value, otherwise only the presence is checked
+	compare bool
+	prefix 	bool
+	negate 	bool
+}
+
+/* Parsed filter, safe to use from several goroutines */
+type Filter struct {
+	terms []term
+}
+
+//check that the tags can be registered and matched by a filter
+func Validate(tags map[string]string) error {
+
+	if len(tags) > MAX_TAGS {
+		return ErrTooManyTags
+	}
+
+	for key, value := range tags {
+		if !validKey(key) {
+			return ErrKey
+		}
+		if len(value) > MAX_VALUE_LEN || strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+			return ErrValue
+		}
+	}
+	return nil
+}
+
+func validKey(key string) bool {
+	return key != "" && len(key) <= MAX_KEY_LEN &&
+		!strings.ContainsAny(key, EQUAL + NOT + WILDCARD) &&
+		strings.IndexFunc(key, unicode.IsSpace) < 0
+}
+
+func ParseFilter(expr string) (*Filter, error) {
+
+	f := new(Filter)
+	for _, field := range strings.Fields(expr) {
+
+		var t term
+		key, value, compare := strings.Cut(field, EQUAL)
+
+		if compare {
+			t.compare = true
+			t.negate  = strings.HasSuffix(key, NOT)
+			t.key 	  = strings.TrimSuffix(key, NOT)
+			t.prefix  = strings.HasSuffix(value, WILDCARD)
+			t.value   = strings.TrimSuffix(value, WILDCARD)
+
+			if strings.Contains(t.value, WILDCARD) || len(t.value) > MAX_VALUE_LEN {
+				return nil, ErrFilter
+			}
+		} else {
+			t.negate = strings.HasPrefix(key, NOT)
+			t.key 	 = strings.TrimPrefix(key, NOT)
+		}
+
+		if !validKey(t.key) {
+			return nil, ErrFilter
+		}
+		f.terms = append(f.terms, t)
+	}
+	return f, nil
+}
+
+//true if the tags satisfy every term
+func (f *Filter) Match(tags map[string]string) bool {
+
+	for _, t := range f.terms {
+		if t.match(tags) == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (t term) match(tags map[string]string) bool {
+
+	value, ok := tags[t.key]
+	switch {
+	case !ok || !t.compare:
+		return ok
+	case t.prefix:
+		return strings.HasPrefix(value, t.value)
+	default:
+		return value == t.value
+	}
+}
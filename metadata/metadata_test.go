@@ -0,0 +1,72 @@
+package metadata_test
+
+import(
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/sech90/go-message-hub/metadata"
+)
+
+var worker = map[string]string{
+	metadata.NAME: 		"pricing",
+	metadata.ROLE: 		"worker",
+	metadata.VERSION: 	"1.4.2",
+	"gpu": 				"",
+}
+
+//filter, expected match against worker
+var filterCases = []struct{
+	filter 	string
+	match 	bool
+}{
+	{"", true},
+	{"name=pricing", true},
+	{"name=billing", false},
+	{"role=worker name=pricing", true},
+	{"role=worker name=billing", false},
+	{"version=1.4*", true},
+	{"version=1.5*", false},
+	{"version=*", true},
+	{"role!=frontend", true},
+	{"role!=worker", false},
+	{"region!=eu", true},
+	{"gpu", true},
+	{"gpu=", true},
+	{"region", false},
+	{"!region", true},
+	{"!gpu", false},
+	{"  role=worker   gpu ", true},
+}
+
+func TestValidate(t *testing.T){
+	assert := assert.New(t)
+
+	assert.Nil(metadata.Validate(worker), "Tags should be valid")
+	assert.Nil(metadata.Validate(nil), "No tags is valid")
+	assert.Equal(metadata.ErrKey, metadata.Validate(map[string]string{"": "x"}), "Empty key")
+	assert.Equal(metadata.ErrKey, metadata.Validate(map[string]string{"a=b": "x"}), "Operator in key")
+	assert.Equal(metadata.ErrKey, metadata.Validate(map[string]string{"a b": "x"}), "Space in key")
+	assert.Equal(metadata.ErrValue, metadata.Validate(map[string]string{"a": "x y"}), "Space in value")
+	assert.Equal(metadata.ErrValue, metadata.Validate(map[string]string{"a": strings.Repeat("x", metadata.MAX_VALUE_LEN+1)}), "Long value")
+
+	many := make(map[string]string)
+	for i := 0; i <= metadata.MAX_TAGS; i++ {
+		many[strings.Repeat("k", i+1)] = ""
+	}
+	assert.Equal(metadata.ErrTooManyTags, metadata.Validate(many), "Too many tags")
+}
+
+func TestFilter(t *testing.T){
+	assert := assert.New(t)
+
+	for _, c := range filterCases {
+		f, err := metadata.ParseFilter(c.filter)
+		assert.Nil(err, "Filter should parse: " + c.filter)
+		assert.Equal(c.match, f.Match(worker), "Filter: " + c.filter)
+	}
+
+	for _, bad := range []string{"=worker", "!=worker", "!", "role=wo*rk", "ro*le"} {
+		_, err := metadata.ParseFilter(bad)
+		assert.Equal(metadata.ErrFilter, err, "Filter should be refused: " + bad)
+	}
+}
@@ -0,0 +1,96 @@
+package mexsocket
+
+import(
+	"io"
+	"sync"
+	"bytes"
+	"compress/flate"
+	"github.com/sech90/go-message-hub/message"
+)
+
+const(
+	//set in the frame header, from message.PROTOCOL_V2, when the frame is compressed with flate
+	FRAME_COMPRESSED = uint32(0x80000000)
+
+	//shorter frames are not worth compressing
+	DEFAULT_COMPRESS_THRESHOLD = 1024
+)
+
+//compressors are expensive to create, so they are reused
+var writers = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+/* A frame sent to many sockets, like a relay. It is compressed at most once,
+ * the first time a socket that negotiated compression takes it. Thread safe
+ */
+type SharedFrame struct {
+	data 	[]byte
+	packed 	[]byte
+	once 	sync.Once
+}
+
+func NewSharedFrame(data []byte) *SharedFrame {
+	return &SharedFrame{data: data}
+}
+
+//the frame uncompressed
+func (f *SharedFrame) Bytes() []byte {
+	return f.data
+}
+
+//the frame compressed, nil if compression doesn't make it smaller
+func (f *SharedFrame) compressed() []byte {
+	f.once.Do(func(){
+		f.packed = Compress(f.data)
+	})
+	return f.packed
+}
+
+//compress the data with flate, returns nil if it doesn't get smaller
+func Compress(data []byte) []byte {
+
+	var buf bytes.Buffer
+
+	w := writers.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	writers.Put(w)
+
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+//decompress a frame, refusing to inflate it beyond max bytes
+func decompress(data []byte, max int) ([]byte, error) {
+
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > max {
+		return nil, ErrFrameTooLarge
+	}
+	return out, nil
+}
+
+//true if a frame of the given size should be compressed before writing it
+func (s *MexSocket) compresses(size int) bool {
+
+	if s.opts.CompressThreshold < 0 || size <= s.opts.CompressThreshold {
+		return false
+	}
+
+	p := s.Protocol()
+	return p.Version >= message.PROTOCOL_V2 && p.Has(message.FeatureCompression)
+}
@@ -6,6 +6,7 @@ import(
 	"sync"
 	"errors"
 	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/statbucket"
 )
 
 const (
@@ -13,6 +14,17 @@ const (
 
 	ModeServer = 1
 	ModeClient = 2
+
+	//from message.PROTOCOL_V2, bits of the frame header carrying flags instead of the length
+	FRAME_FLAGS = uint32(0xf0000000)
+)
+
+var(
+	//the peer announced a frame bigger than the maximum allowed. The stream can't be recovered
+	ErrFrameTooLarge = errors.New("Frame exceeds the maximum size")
+
+	//the frame has flags this socket doesn't understand
+	ErrFrameFlags 	 = errors.New("Unknown frame flags")
 )
 
 /* A socket for messages and binary data.
@@ -32,14 +44,51 @@ type MexSocket struct {
 	incoming 	chan message.Message
 	outgoing 	chan message.Message
 
+	//bounded queue of frames, see Enqueue()
+	opts 		Options
+	queue 		chan queuedFrame
+	dropped 	uint64
+	pending 	int
+
+	//counter for the relays sent by this socket's peer
+	relaySeq 	uint64
+
+	//optional bucket collecting traffic statistics. May be shared between sockets
+	stats 		*statbucket.StatBucket
+
+	//protocol agreed with the peer, message.LegacyProtocol until it says Hello.
+	//The frames are read with readProtocol, which may switch first, see SetReadProtocol
+	protocol 	message.Protocol
+	readProtocol message.Protocol
+
 	lock 	 	sync.RWMutex
 }
 
 func New(id uint64, conn net.Conn) *MexSocket {
+	return NewWithOptions(id, conn, DefaultOptions())
+}
+
+func NewWithOptions(id uint64, conn net.Conn, opts Options) *MexSocket {
+
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+
+	if opts.MaxFrameSize <= 0 {
+		opts.MaxFrameSize = DEFAULT_MAX_FRAME_SIZE
+	}
+
+	if opts.CompressThreshold == 0 {
+		opts.CompressThreshold = DEFAULT_COMPRESS_THRESHOLD
+	}
 
 	cli := &MexSocket{
 		Id: id,
 		conn: conn,
+		opts: opts,
+		queue: make(chan queuedFrame, opts.QueueSize),
+		protocol: message.LegacyProtocol,
+		readProtocol: message.LegacyProtocol,
 
 		isClosed: false,
 		quitChan: 	 make(chan bool),
@@ -53,6 +102,39 @@ func New(id uint64, conn net.Conn) *MexSocket {
 	return cli
 }
 
+//enable traffic statistics. Must be called before the socket is used
+func (s *MexSocket) SetStatBucket(bucket *statbucket.StatBucket) {
+	s.stats = bucket
+}
+
+/* Switch to the protocol agreed with the peer. The frames read after the call
+ * are decoded with the new protocol, so the peer must not send any frame in the
+ * new protocol before the Hello exchange is complete
+ */
+func (s *MexSocket) SetProtocol(p message.Protocol) {
+	s.lock.Lock()
+	s.protocol = p
+	s.readProtocol = p
+	s.lock.Unlock()
+}
+
+/* Read the next frames with the protocol, still writing with the previous one.
+ * The side answering Hello switches its reads before sending the answer, since
+ * the peer speaks the new protocol as soon as it reads it, then calls SetProtocol
+ */
+func (s *MexSocket) SetReadProtocol(p message.Protocol) {
+	s.lock.Lock()
+	s.readProtocol = p
+	s.lock.Unlock()
+}
+
+func (s *MexSocket) Protocol() message.Protocol {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.protocol
+}
+
 func (s *MexSocket) StartReadService(mode int) {
 
 	var mex message.Message
@@ -78,6 +160,11 @@ func (s *MexSocket) StartReadService(mode int) {
 			} else if lastErr == io.EOF {
 				go s.Close()
 				return
+			} else if lastErr == ErrFrameTooLarge {
+				//the rest of the stream is garbage: report and drop the connection
+				s.queueErr(lastErr)
+				go s.Close()
+				return
 			} else {
 				go s.queueErr(lastErr)
 			}
@@ -96,6 +183,13 @@ func (s *MexSocket) StartWriteService() {
 			_,err = s.Send(mex)
 		case binary := <- s.outgoingBin:
 			_,err = s.WriteBytes(binary)
+		case frame := <- s.queue:
+			if frame.ready {
+				_,err = s.writeFrame(frame.data, frame.flags)
+			} else {
+				_,err = s.WriteBytes(frame.data)
+			}
+			s.addPending(-1)
 		}
 		if err != nil {
 			go s.queueErr(err)
@@ -163,16 +257,38 @@ func (s *MexSocket) Read(mex message.Message) (int, error) {
 	return n, err		
 }
 	
-/* Given a byte array, add a header containing its length */
+/* Given a byte array, add a header containing its length. The array is compressed
+ * if it's long enough and the peer negotiated compression
+ */
 func (s *MexSocket) WriteBytes(byteMex []byte) (int, error) {
 
+	//the other end would refuse it anyway
+	if len(byteMex) > s.opts.MaxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+
+	if s.compresses(len(byteMex)) {
+		if packed := Compress(byteMex); packed != nil {
+			return s.writeFrame(packed, FRAME_COMPRESSED)
+		}
+	}
+	return s.writeFrame(byteMex, 0)
+}
+
+//write the frame as it is, with the flags in the header
+func (s *MexSocket) writeFrame(byteMex []byte, flags uint32) (int, error) {
+
 	if s.IsClosed() {
 		return 0, errors.New("Impossible to write on closed socket")
 	}
 
+	if len(byteMex) > s.opts.MaxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+
 	//convert the size into a byte array
 	mexHeader := make([]byte,HEADER_SIZE)
-	message.Uint32ToByteArray(mexHeader, uint32(len(byteMex)))
+	message.Uint32ToByteArray(mexHeader, uint32(len(byteMex)) | flags)
 
 	//compose the full arra to write
 	toWrite := append(mexHeader, byteMex...)
@@ -189,6 +305,13 @@ func (s *MexSocket) WriteBytes(byteMex []byte) (int, error) {
 		n, err = s.conn.Write(toWrite[totalWritten:])
 		totalWritten += n
 	}
+
+	if s.stats != nil {
+		s.stats.ByteWritten.Increase(uint64(totalWritten))
+		if err == nil {
+			s.stats.OutgoingMessages.Increase(1)
+		}
+	}
 	
 	// Return the bytes written, any error
 	return totalWritten, err
@@ -221,8 +344,24 @@ func (s *MexSocket) ReadBytes() ([]byte, int, error) {
 	//return if error
 	if err != nil { return nil, totalReadHeader, err}
 	
-	//convert in integer
-	mexSize := int(message.ByteArrayToUint32(mexBuffer))
+	//convert in integer, the top bits may be flags
+	header := message.ByteArrayToUint32(mexBuffer)
+
+	s.lock.RLock()
+	version := s.readProtocol.Version
+	s.lock.RUnlock()
+
+	var flags uint32
+	if version >= message.PROTOCOL_V2 {
+		flags = header & FRAME_FLAGS
+		header &^= FRAME_FLAGS
+	}
+	mexSize := int(header)
+
+	//don't trust the peer with the allocation size
+	if mexSize > s.opts.MaxFrameSize {
+		return nil, totalReadHeader, ErrFrameTooLarge
+	}
 	
 	mexBuffer = make([]byte, mexSize)
 
@@ -233,13 +372,39 @@ func (s *MexSocket) ReadBytes() ([]byte, int, error) {
 	}
 
 	totalRead = totalReadMessage + totalReadHeader
+
+	if s.stats != nil {
+		s.stats.ByteRead.Increase(uint64(totalRead))
+	}
 	
 	//return if error
 	if err != nil { return nil, totalRead, err}
 
+	if s.stats != nil {
+		s.stats.IncomingMessages.Increase(1)
+	}
+
+	//the frame is consumed, so the stream is still usable
+	if flags &^ FRAME_COMPRESSED != 0 {
+		return nil, totalRead, ErrFrameFlags
+	}
+
+	if flags & FRAME_COMPRESSED != 0 {
+		mexBuffer, err = decompress(mexBuffer, s.opts.MaxFrameSize)
+	}
+
 	return mexBuffer, totalRead, err
 }
 
+//returns the next sequence number for a relay originated by this socket
+func (s *MexSocket) NextSeq() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.relaySeq++
+	return s.relaySeq
+}
+
 func (s *MexSocket) IsClosed() bool {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
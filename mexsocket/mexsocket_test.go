@@ -2,6 +2,7 @@ package mexsocket_test
 
 import (
 	"log"
+	"bytes"
 	"net"
 	"sync"
 	"time"
@@ -29,7 +30,7 @@ var testBody = testutils.GenPayload(PayloadLength)
 
 var tAnsId 	 = message.NewAnswerIdentity(testId)
 var tAnsList = message.NewAnswerList(testList)
-var tAnsBody = message.NewAnswerRelay(testBody)
+var tAnsBody = message.NewAnswerRelay(testId, 1, testBody)
 var emptyAns = new(message.Answer)
 
 var tReqId 	 = message.NewRequest(message.Identity)
@@ -260,6 +261,228 @@ func TestDisconnect(t *testing.T){
 
 }
 
+func TestQueuePolicies(t *testing.T){
+	assert := assert.New(t)
+
+	frames := [][]byte{ []byte{1}, []byte{2}, []byte{3} }
+
+	//nobody reads from the other end of the pipe, so the queue fills up
+	newQueued := func(policy int) *mexsocket.MexSocket {
+		conn, _ := net.Pipe()
+		return mexsocket.NewWithOptions(0, conn, mexsocket.Options{
+			QueueSize: 2,
+			QueuePolicy: policy,
+			QueueTimeout: time.Millisecond * 10,
+		})
+	}
+
+	s := newQueued(mexsocket.PolicyDropNewest)
+	assert.True(s.Enqueue(frames[0]), "Frame should be queued")
+	assert.True(s.Enqueue(frames[1]), "Frame should be queued")
+	assert.False(s.Enqueue(frames[2]), "Newest frame should be dropped")
+	assert.Equal(uint64(1), s.Dropped(), "Dropped frame should be counted")
+	assert.Equal(2, s.Queued(), "Queue should be full")
+	s.Close()
+
+	s = newQueued(mexsocket.PolicyBlock)
+	s.Enqueue(frames[0])
+	s.Enqueue(frames[1])
+	start := time.Now()
+	assert.False(s.Enqueue(frames[2]), "Frame should be dropped after the timeout")
+	assert.True(time.Since(start) >= time.Millisecond * 10, "Enqueue should block until the timeout")
+	assert.Equal(uint64(1), s.Dropped(), "Dropped frame should be counted")
+	s.Close()
+	assert.False(s.Enqueue(frames[0]), "Closed socket should refuse frames")
+
+	s = newQueued(mexsocket.PolicyDisconnect)
+	s.Enqueue(frames[0])
+	s.Enqueue(frames[1])
+	assert.False(s.Enqueue(frames[2]), "Frame should be dropped")
+	<- s.QuitChan()
+	assert.True(s.IsClosed(), "Slow socket should be disconnected")
+
+	//the oldest frame is discarded, the remaining ones are written in order
+	conn1, conn2 := net.Pipe()
+	s = mexsocket.NewWithOptions(0, conn1, mexsocket.Options{QueueSize: 2, QueuePolicy: mexsocket.PolicyDropOldest})
+	for _, f := range frames {
+		assert.True(s.Enqueue(f), "Frame should be queued")
+	}
+	assert.Equal(uint64(1), s.Dropped(), "Dropped frame should be counted")
+
+	reader := mexsocket.New(0, conn2)
+	go s.StartWriteService()
+	for _, f := range frames[1:] {
+		b,_,err := reader.ReadBytes()
+		assert.Nil(err, "Frame should be read")
+		assert.Nil(testutils.CompareBytes(f, b), "Frames should be written in order")
+	}
+	s.Close()
+	reader.Close()
+
+	//waiting frames are never dropped, they get room once the writer catches up
+	conn1, conn2 = net.Pipe()
+	s = mexsocket.NewWithOptions(0, conn1, mexsocket.Options{QueueSize: 2, QueuePolicy: mexsocket.PolicyDisconnect})
+	s.Enqueue(frames[0])
+	s.Enqueue(frames[1])
+
+	queued := make(chan bool)
+	go func(){
+		queued <- s.EnqueueWait(mexsocket.NewSharedFrame(frames[2]))
+	}()
+
+	reader = mexsocket.New(0, conn2)
+	go s.StartWriteService()
+	for _, f := range frames {
+		b,_,err := reader.ReadBytes()
+		assert.Nil(err, "Frame should be read")
+		assert.Nil(testutils.CompareBytes(f, b), "Frames should be written in order")
+	}
+	assert.True(<- queued, "Frame should wait for room")
+	assert.False(s.IsClosed(), "Socket should not be disconnected")
+	assert.Equal(uint64(0), s.Dropped(), "No frame should be dropped")
+	s.Close()
+	reader.Close()
+	assert.False(s.EnqueueWait(mexsocket.NewSharedFrame(frames[0])), "Closed socket should refuse frames")
+}
+
+func TestMaxFrameSize(t *testing.T){
+	assert := assert.New(t)
+
+	conn1, conn2 := net.Pipe()
+	opts := mexsocket.DefaultOptions()
+	opts.MaxFrameSize = 16
+
+	writer := mexsocket.NewWithOptions(0, conn1, opts)
+	reader := mexsocket.NewWithOptions(0, conn2, opts)
+
+	_, err := writer.WriteBytes(make([]byte, 17))
+	assert.Equal(mexsocket.ErrFrameTooLarge, err, "Oversized frames should not be written")
+
+	//announce 4GiB without sending them
+	go conn1.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	_, n, err := reader.ReadBytes()
+	assert.Equal(mexsocket.ErrFrameTooLarge, err, "Oversized frames should be refused")
+	assert.Equal(mexsocket.HEADER_SIZE, n, "Only the header should be read")
+
+	//the read service reports the error and closes the socket
+	go reader.StartReadService(mexsocket.ModeServer)
+	go conn1.Write([]byte{0, 0, 1, 0})
+	assert.Equal(mexsocket.ErrFrameTooLarge, <- reader.ErrorChan(), "Error should be reported")
+	<- reader.QuitChan()
+	assert.True(reader.IsClosed(), "Socket should be closed after an oversized frame")
+
+	writer.Close()
+}
+
+func TestProtocol(t *testing.T){
+	assert := assert.New(t)
+
+	conn1, conn2 := net.Pipe()
+	reader := mexsocket.New(0, conn2)
+	assert.Equal(message.LegacyProtocol, reader.Protocol(), "Sockets start with the legacy protocol")
+
+	//in the legacy protocol the flag bits are part of the length
+	go conn1.Write([]byte{0x80, 0, 0, 1})
+	_, _, err := reader.ReadBytes()
+	assert.Equal(mexsocket.ErrFrameTooLarge, err, "Flags should be read as length")
+
+	//from v2 they are not, and unknown flags are refused after the frame is consumed
+	reader.SetProtocol(message.Protocol{Version: message.PROTOCOL_V2})
+	go conn1.Write([]byte{0x40, 0, 0, 1, 7, 0, 0, 0, 1, 9})
+	_, n, err := reader.ReadBytes()
+	assert.Equal(mexsocket.ErrFrameFlags, err, "Unknown flags should be refused")
+	assert.Equal(mexsocket.HEADER_SIZE + 1, n, "Frame should be consumed")
+
+	b, _, err := reader.ReadBytes()
+	assert.Nil(err, "Stream should still be usable")
+	assert.Equal([]byte{9}, b, "Next frame should be read")
+
+	reader.Close()
+	conn1.Close()
+
+	//the side answering Hello reads the new protocol while its answer is still in the old one
+	negotiated := message.Protocol{Version: message.PROTOCOL_V2, Features: message.FeatureCompression}
+	body := bytes.Repeat([]byte("compressible "), 1000)
+
+	conn1, conn2 = net.Pipe()
+	answering := mexsocket.New(0, conn1)
+	asking := mexsocket.New(0, conn2)
+	answering.SetReadProtocol(negotiated)
+	assert.Equal(message.LegacyProtocol, answering.Protocol(), "Writes should keep the old protocol")
+
+	go answering.WriteBytes(body)
+	_, n, err = asking.ReadBytes()
+	assert.Nil(err, "Answer should be read in the old protocol")
+	assert.Equal(mexsocket.HEADER_SIZE + len(body), n, "Answer should not be compressed")
+
+	asking.SetProtocol(negotiated)
+	go asking.WriteBytes(body)
+	b, n, err = answering.ReadBytes()
+	assert.Nil(err, "Next frame should be read in the new protocol")
+	assert.Equal(body, b, "Compressed frame should be preserved")
+	assert.True(n < len(body), "Next frame should be compressed")
+
+	answering.Close()
+	asking.Close()
+}
+
+func TestCompression(t *testing.T){
+	assert := assert.New(t)
+
+	negotiated := message.Protocol{Version: message.PROTOCOL_V2, Features: message.FeatureCompression}
+	body := bytes.Repeat([]byte("compressible "), 1000)
+
+	conn1, conn2 := net.Pipe()
+	writer := mexsocket.New(0, conn1)
+	reader := mexsocket.New(0, conn2)
+	writer.SetProtocol(negotiated)
+	reader.SetProtocol(negotiated)
+
+	//long frames are compressed, short ones are not
+	for _, frame := range [][]byte{body, body[:10]} {
+		go writer.WriteBytes(frame)
+		b, n, err := reader.ReadBytes()
+		assert.Nil(err, "Frame should be read")
+		assert.Equal(frame, b, "Frame should be preserved")
+		assert.Equal(len(frame) > mexsocket.DEFAULT_COMPRESS_THRESHOLD, n < len(frame), "Only long frames should be compressed")
+	}
+
+	//a shared frame is compressed only for the sockets that negotiated it
+	shared := mexsocket.NewSharedFrame(body)
+	go writer.StartWriteService()
+	assert.True(writer.EnqueueShared(shared), "Shared frame should be queued")
+	b, n, err := reader.ReadBytes()
+	assert.Nil(err, "Shared frame should be read")
+	assert.Equal(body, b, "Shared frame should be preserved")
+	assert.True(n < len(body), "Shared frame should be compressed")
+
+	writer.SetProtocol(message.LegacyProtocol)
+	reader.SetProtocol(message.LegacyProtocol)
+	assert.True(writer.EnqueueShared(shared), "Shared frame should be queued")
+	b, n, err = reader.ReadBytes()
+	assert.Nil(err, "Shared frame should be read")
+	assert.Equal(body, b, "Shared frame should be preserved")
+	assert.Equal(mexsocket.HEADER_SIZE + len(body), n, "Shared frame should not be compressed")
+
+	//a frame inflating beyond the maximum size is refused
+	opts := mexsocket.DefaultOptions()
+	opts.MaxFrameSize = 100
+	small := mexsocket.NewWithOptions(0, conn2, opts)
+	small.SetProtocol(negotiated)
+
+	packed := mexsocket.Compress(body)
+	header := make([]byte, mexsocket.HEADER_SIZE)
+	message.Uint32ToByteArray(header, uint32(len(packed)) | mexsocket.FRAME_COMPRESSED)
+	go conn1.Write(append(header, packed...))
+	_, _, err = small.ReadBytes()
+	assert.Equal(mexsocket.ErrFrameTooLarge, err, "Compressed frame should not inflate beyond the limit")
+
+	assert.Nil(mexsocket.Compress(testutils.GenPayload(100)), "Random data should not be compressed")
+
+	writer.Close()
+	reader.Close()
+}
+
 func loadList(m message.Message, size int) []message.Message {
 	out := make([]message.Message,size)
 	for i:=0; i<size; i++ {
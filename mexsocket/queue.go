@@ -0,0 +1,261 @@
+package mexsocket
+
+import(
+	"time"
+	"errors"
+	"context"
+	"github.com/sech90/go-message-hub/message"
+)
+
+/* Policies applied when a frame is queued on a socket whose outgoing queue is full */
+const (
+	//wait for room in the queue, up to QueueTimeout (forever if 0)
+	PolicyBlock = 1
+	//discard the oldest queued frame to make room for the new one
+	PolicyDropOldest = 2
+	//discard the new frame
+	PolicyDropNewest = 3
+	//discard the new frame and close the slow socket
+	PolicyDisconnect = 4
+
+	DEFAULT_QUEUE_SIZE 	  = 256
+	DEFAULT_QUEUE_TIMEOUT = 5 * time.Second
+
+	FLUSH_POLL_INTERVAL = 5 * time.Millisecond
+
+	//room for message headers on top of receivers and payload
+	FRAME_OVERHEAD 	= 64
+
+	//the largest legitimate frame is a relay with all the receivers and a full payload
+	DEFAULT_MAX_FRAME_SIZE = message.MAX_PAYLOAD + message.MAX_RECEIVERS*8 + FRAME_OVERHEAD
+)
+
+/* Configuration of a MexSocket */
+type Options struct {
+	//capacity of the outgoing frame queue
+	QueueSize 		int
+
+	//one of the Policy constants
+	QueuePolicy 	int
+
+	//used only by PolicyBlock
+	QueueTimeout 	time.Duration
+
+	//frames bigger than this are refused, without being read
+	MaxFrameSize 	int
+
+	/* frames longer than this are compressed, if the peer negotiated it.
+	 * 0 means DEFAULT_COMPRESS_THRESHOLD, a negative value disables compression
+	 */
+	CompressThreshold int
+}
+
+//a frame waiting for the write service
+type queuedFrame struct {
+	data 	[]byte
+
+	//the frame is already compressed, or not worth compressing: write it with these flags
+	ready 	bool
+	flags 	uint32
+}
+
+func DefaultOptions() Options {
+	return Options{
+		QueueSize: 		DEFAULT_QUEUE_SIZE,
+		QueuePolicy: 	PolicyBlock,
+		QueueTimeout: 	DEFAULT_QUEUE_TIMEOUT,
+		MaxFrameSize: 	DEFAULT_MAX_FRAME_SIZE,
+		CompressThreshold: DEFAULT_COMPRESS_THRESHOLD,
+	}
+}
+
+/* Put a frame in the outgoing queue, to be written by the write service.
+ * Returns false if the frame was not queued, either because the socket is closed
+ * or because the queue policy dropped it
+ */
+func (s *MexSocket) Enqueue(frame []byte) bool {
+	return s.push(queuedFrame{data: frame})
+}
+
+/* Like Enqueue, for a frame sent to many sockets: the compression, if negotiated,
+ * is done once for all of them
+ */
+func (s *MexSocket) EnqueueShared(frame *SharedFrame) bool {
+
+	if s.compresses(len(frame.data)) {
+		if packed := frame.compressed(); packed != nil {
+			return s.push(queuedFrame{data: packed, ready: true, flags: FRAME_COMPRESSED})
+		}
+	}
+	return s.push(queuedFrame{data: frame.data, ready: true})
+}
+
+/* Like EnqueueShared, waiting for room in the queue whatever the queue policy.
+ * For frames the peer can't do without, such as the answer to a request it is
+ * waiting for. Returns false only if the socket is closed
+ */
+func (s *MexSocket) EnqueueWait(frame *SharedFrame) bool {
+
+	if s.compresses(len(frame.data)) {
+		if packed := frame.compressed(); packed != nil {
+			return s.pushWait(queuedFrame{data: packed, ready: true, flags: FRAME_COMPRESSED})
+		}
+	}
+	return s.pushWait(queuedFrame{data: frame.data, ready: true})
+}
+
+func (s *MexSocket) push(frame queuedFrame) bool {
+	return s.pushWith(frame, s.enqueue)
+}
+
+func (s *MexSocket) pushWait(frame queuedFrame) bool {
+	return s.pushWith(frame, s.enqueueWait)
+}
+
+func (s *MexSocket) pushWith(frame queuedFrame, enqueue func(queuedFrame) bool) bool {
+
+	if s.IsClosed() {
+		return false
+	}
+
+	//count the frame before the writer can see it, undo if it's not queued
+	s.addPending(1)
+	queued := enqueue(frame)
+	if !queued {
+		s.addPending(-1)
+	}
+	return queued
+}
+
+func (s *MexSocket) enqueue(frame queuedFrame) bool {
+
+	switch s.opts.QueuePolicy {
+
+	case PolicyDropNewest:
+		select{
+		case s.queue <- frame:
+			return true
+		case <- s.quitChan:
+			return false
+		default:
+			s.drop()
+			return false
+		}
+
+	case PolicyDropOldest:
+		for {
+			select{
+			case s.queue <- frame:
+				return true
+			case <- s.quitChan:
+				return false
+			default:
+				//make room by discarding the head of the queue
+				select{
+				case <- s.queue:
+					s.addPending(-1)
+					s.drop()
+				default:
+				}
+			}
+		}
+
+	case PolicyDisconnect:
+		select{
+		case s.queue <- frame:
+			return true
+		case <- s.quitChan:
+			return false
+		default:
+			s.drop()
+			go s.Close()
+			return false
+		}
+
+	default:
+		//nil channel never fires: wait forever if there's no timeout
+		var timeout <- chan time.Time
+		if s.opts.QueueTimeout > 0 {
+			timer := time.NewTimer(s.opts.QueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select{
+		case s.queue <- frame:
+			return true
+		case <- s.quitChan:
+			return false
+		case <- timeout:
+			s.drop()
+			return false
+		}
+	}
+}
+
+//wait for room until the socket is closed
+func (s *MexSocket) enqueueWait(frame queuedFrame) bool {
+	select{
+	case s.queue <- frame:
+		return true
+	case <- s.quitChan:
+		return false
+	}
+}
+
+/* Wait until all the queued frames have been written, or the context is done.
+ * The write service must be running
+ */
+func (s *MexSocket) Flush(ctx context.Context) error {
+
+	ticker := time.NewTicker(FLUSH_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		s.lock.RLock()
+		pending := s.pending
+		s.lock.RUnlock()
+
+		if pending == 0 {
+			return nil
+		}
+
+		select{
+		case <- ticker.C:
+		case <- s.quitChan:
+			return errors.New("Socket closed before flushing")
+		case <- ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//number of frames discarded because the peer was too slow
+func (s *MexSocket) Dropped() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.dropped
+}
+
+//number of frames waiting in the outgoing queue
+func (s *MexSocket) Queued() int {
+	return len(s.queue)
+}
+
+//frames queued or being written
+func (s *MexSocket) addPending(delta int) {
+	s.lock.Lock()
+	s.pending += delta
+	s.lock.Unlock()
+}
+
+func (s *MexSocket) drop() {
+	s.lock.Lock()
+	s.dropped++
+	s.lock.Unlock()
+
+	if s.stats != nil {
+		s.stats.DroppedMessages.Increase(1)
+	}
+}
@@ -4,45 +4,132 @@ import(
 	"os"
 	"log"
 	"flag"
+	"time"
+	"context"
+	"errors"
+	"syscall"
 	"os/signal"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/sech90/go-message-hub/hub"
 	"github.com/sech90/go-message-hub/statbucket"
 )
 
 const(
 	Port = 9999
+
+	//time given to the clients to receive the pending messages
+	ShutdownTimeout = 5 * time.Second
 )
 
+//the CA file given with -ca has no certificate to verify the clients with
+var ErrNoCACert = errors.New("No valid certificate in the CA file")
+
 func main() {
 
 	port := flag.Int("port", Port, "Define port number")
 	showStats := flag.Bool("stat", true, "Show statistics report at termination")
+	certFile := flag.String("cert", "", "Certificate file, enables TLS")
+	keyFile := flag.String("key", "", "Private key file of the certificate")
+	caFile := flag.String("ca", "", "CA file to verify client certificates, enables mutual TLS")
+	sessionTTL := flag.Duration("session", 0, "Time a disconnected client can resume its id, 0 disables it")
+	mailboxSize := flag.Int("mailbox", 0, "Relays held for a disconnected client until it resumes, requires -session")
+	rateMessages := flag.Float64("rate", 0, "Requests per second allowed to each client, 0 for no limit")
+	rateBytes := flag.Float64("rate-bytes", 0, "Bytes per second allowed to each client, 0 for no limit")
+	ratePolicy := flag.Int("rate-policy", hub.RatePolicyDelay, "Over the rate: 0 delays, 1 refuses the request, 2 disconnects")
+	aclFile := flag.String("acl", "", "Access policy file of the relays, reloaded on SIGHUP")
 
 	flag.Parse()
 
-	hub := hub.NewHub(*port)
+	opts := hub.DefaultOptions()
+	opts.SessionTTL = *sessionTTL
+	opts.Mailbox.MaxMessages = *mailboxSize
+	opts.RateLimit.Messages = *rateMessages
+	opts.RateLimit.Bytes = *rateBytes
+	opts.RateLimit.Policy = *ratePolicy
+	opts.ACLFile = *aclFile
+
+	if *certFile != "" {
+		config, err := LoadTLSConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts.TLSConfig = config
+	}
+
+	hub, err := hub.NewHubWithOptions(*port, opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	ServerConnect(hub, *showStats)
 
 }
 
-func ServerConnect(hub *hub.Hub, showStats bool){
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrNoCACert
+		}
+
+		config.ClientCAs  = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func ServerConnect(server *hub.Hub, showStats bool){
 	
 	systemSignals := make(chan os.Signal, 1)
 
+	//reload the access policy on SIGHUP, keeping the old one if the file is broken
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func(){
+		for range reloadSignals {
+			if err := server.ReloadACL(); err != nil {
+				log.Println("Access policy not reloaded:", err)
+			}
+		}
+	}()
+
 	//intercept external interreupt signals so we can turn off the server correctly
 	signal.Notify(systemSignals, os.Interrupt)
 	go func(){
 	     <- systemSignals
+
+	    ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	    defer cancel()
 	    
-	    hub.Stop()
+	    if err := server.Shutdown(ctx); err != nil {
+	    	log.Println("Forced shutdown:", err)
+	    }
 	    log.Println("Server stopped")
+
+	    if showStats {
+	    	printStats(server.Stats())
+	    }
 	    
 	    os.Exit(2)
 	}()
 
-	err := hub.Run()
+	err := server.Run(context.Background())
 
-	if err != nil {
+	if err != nil && err != hub.ErrHubClosed {
 		log.Println(err);
 	}
 }
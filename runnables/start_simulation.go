@@ -9,6 +9,7 @@ import(
 	"os/signal"
 	"github.com/sech90/go-message-hub/client"
 	"github.com/sech90/go-message-hub/message"
+	"github.com/sech90/go-message-hub/mexsocket"
 	"github.com/sech90/go-message-hub/syncmap"
 	"github.com/sech90/go-message-hub/statbucket"
 	"github.com/sech90/go-message-hub/testutils"
@@ -21,6 +22,9 @@ const(
 	numClients = 100
 	numMessages = 100
 	sendInterval = 1
+
+	//every client relays to all the others
+	maxClients = message.MAX_RECEIVERS + 1
 )
 
 var(
@@ -44,13 +48,13 @@ var quitApp = make(chan bool)
 var startTime time.Time
 var endTime time.Time
 
-var outMex, inMex, inByte, outByte int
+var outMex, inMex, inByte int
 func main() {
 
 	a 	:= flag.String("addr", Address, "address to connect")
 	p 	:= flag.Int("port", Port, "Define port number")
 	s 	:= flag.Int("size", payloadBytes, "Size of the payload to send [0-1024000]")
-	n 	:= flag.Int("ncli", numClients, "Clients number to run the simulation [0-255]")
+	n 	:= flag.Int("ncli", numClients, "Clients number to run the simulation [0-65537]")
 	m	:= flag.Int("nmex", numMessages, "Messages to send per client")
 	i 	:= flag.Int("i", sendInterval, "time interval between messages in milliseconds")
 	ss 	:= flag.Bool("stat", true, "Show statistics report at termination")
@@ -69,8 +73,8 @@ func main() {
 		log.Fatalln("size must be between 0-1024000")
 	}
 
-	if cliNum > 255 || cliNum < 0{
-		log.Fatalln("clients must be between 0-255")
+	if cliNum > maxClients || cliNum < 0{
+		log.Fatalln("clients must be between 0-65537")
 	}
 
 	if *i < 0{
@@ -110,9 +114,9 @@ func Init(){
 	outMex = cliNum * mexNum
 	inMex = (cliNum-1) * mexNum * cliNum
 
-	//HACK: for convenience and semplicity, we can calculate what will be the dimension of a message from here
-	inByte 	= inMex  * (5+pSize)
-	outByte = outMex * (5+1+(cliNum*8)+pSize)
+	//HACK: for convenience and semplicity, we can calculate what will be the dimension of a message from here.
+	//The relays sent depend on the receiver ids, they are counted by each writeLoop
+	inByte 	= inMex  * (5+message.RELAY_HEADER_SIZE+pSize)
 
 	//Needed if the application is forced close by the user
 	CatchExit()
@@ -164,10 +168,10 @@ func readLoop(cli *client.Client, finish *sync.WaitGroup){
 func writeLoop(cli *client.Client, finish *sync.WaitGroup, ready *sync.WaitGroup){
 	
 	list := cli.List()
-	if len(list) > 255{
-		list = list[:255]
-	}
 	binary := message.NewRelayRequest(list, payload).ToByteArray()
+
+	//wide relays encode the receivers as varints, so the size is known only once encoded
+	allStats.ByteWritten.Increase(uint64(mexNum * (mexsocket.HEADER_SIZE + len(binary))))
 	ready.Wait()
 
 	for i:=0; i<mexNum; i++ {
@@ -303,7 +307,6 @@ func PrintStats(){
 	allStats.TimeAlive.Set(uint64(durationTime.Nanoseconds()))
 
 	//add calculated values for byte read and write
-	allStats.ByteWritten.Increase(uint64(outByte))
 	allStats.ByteRead.Increase(uint64(inByte))
 
 	log.Println("\n\n*** Execution statistics ***\n")
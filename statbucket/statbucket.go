@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sync"
 	"bytes"
+	"errors"
 	"github.com/sech90/go-message-hub/message"
 )
 
@@ -31,6 +32,9 @@ func (s *Stat) Get() uint64 {
 	return s.value
 }
 
+//number of fields in the original serialization. Newer fields are appended after these
+const LEGACY_FIELDS = 7
+
 /* convenience object that gather some common parameters */
 type StatBucket struct{
 	TimeAlive			Stat
@@ -40,45 +44,75 @@ type StatBucket struct{
 	OutgoingMessages	Stat
 	ByteRead			Stat
 	ByteWritten			Stat
+	DroppedMessages		Stat
+	OversizedFrames		Stat
+	AuthFailures		Stat
+	SessionsResumed		Stat
+	StoredMessages		Stat
+	RateLimited			Stat
+	Denied				Stat
+}
+
+//all the fields in serialization order. New fields must be appended at the end
+func (bucket *StatBucket) fields() []*Stat {
+	return []*Stat{
+		&bucket.TimeAlive,
+		&bucket.ClientsConnected,
+		&bucket.ClientsDisconnected,
+		&bucket.IncomingMessages,
+		&bucket.OutgoingMessages,
+		&bucket.ByteRead,
+		&bucket.ByteWritten,
+		&bucket.DroppedMessages,
+		&bucket.OversizedFrames,
+		&bucket.AuthFailures,
+		&bucket.SessionsResumed,
+		&bucket.StoredMessages,
+		&bucket.RateLimited,
+		&bucket.Denied,
+	}
 }
 
 //given another StatBucket, increase all the fields by the other's amount 
 func (bucket *StatBucket) Merge(b *StatBucket) {
-	bucket.ClientsConnected.Increase(b.ClientsConnected.Get()) 
-	bucket.ClientsDisconnected.Increase(b.ClientsDisconnected.Get()) 
-	bucket.IncomingMessages.Increase(b.IncomingMessages.Get()) 
-	bucket.OutgoingMessages.Increase(b.OutgoingMessages.Get()) 
-	bucket.ByteRead.Increase(b.ByteRead.Get()) 
-	bucket.ByteWritten.Increase(b.ByteWritten.Get()) 
+	mine, other := bucket.fields(), b.fields()
+
+	//TimeAlive is not additive
+	for i := 1; i < len(mine); i++ {
+		mine[i].Increase(other[i].Get())
+	}
 }
 
 func (bucket *StatBucket) ToByteArray() []byte {
 	
-	arr := []uint64{
-		bucket.TimeAlive.Get(), 
-		bucket.ClientsConnected.Get(), 
-		bucket.ClientsDisconnected.Get(), 
-		bucket.IncomingMessages.Get(), 
-		bucket.OutgoingMessages.Get(), 
-		bucket.ByteRead.Get(), 
-		bucket.ByteWritten.Get(), 
+	fields := bucket.fields()
+	arr := make([]uint64, len(fields))
+
+	for i, f := range fields {
+		arr[i] = f.Get()
 	}
 
 	return message.Uint64ArrayToByteArray(arr)
 }
 
-
-func (bucket *StatBucket) FromByteArray(arr []byte) {
+/* Buffers from older hubs may lack the newest fields, which are then set to 0 */
+func (bucket *StatBucket) FromByteArray(arr []byte) error {
 	
 	values := message.ByteArrayToUint64Array(arr)
 
-	bucket.TimeAlive.Set(values[0])
-	bucket.ClientsConnected.Set(values[1])
-	bucket.ClientsDisconnected.Set(values[2])
-	bucket.IncomingMessages.Set(values[3])
-	bucket.OutgoingMessages.Set(values[4])
-	bucket.ByteRead.Set(values[5])
-	bucket.ByteWritten.Set(values[6])
+	if len(values) < LEGACY_FIELDS {
+		return errors.New("Buffer too short for a StatBucket")
+	}
+
+	for i, f := range bucket.fields() {
+		if i < len(values) {
+			f.Set(values[i])
+		} else {
+			f.Set(0)
+		}
+	}
+
+	return nil
 }
 
 func (bucket *StatBucket) String() string {
@@ -91,6 +125,13 @@ func (bucket *StatBucket) String() string {
 	outgoing 	:= bucket.OutgoingMessages.Get()
 	bytesRead 	:= bucket.ByteRead.Get()
 	bytesWrote 	:= bucket.ByteWritten.Get()		
+	dropped 	:= bucket.DroppedMessages.Get()
+	oversized 	:= bucket.OversizedFrames.Get()
+	authFailed 	:= bucket.AuthFailures.Get()
+	resumed 	:= bucket.SessionsResumed.Get()
+	stored 		:= bucket.StoredMessages.Get()
+	limited 	:= bucket.RateLimited.Get()
+	denied 		:= bucket.Denied.Get()
 	timeInSeconds := float64(bucket.TimeAlive.Get())/1000000000
 
 
@@ -102,6 +143,13 @@ func (bucket *StatBucket) String() string {
     buffer.WriteString(fmt.Sprintf("Outgoing Messages: %d \n",outgoing))
     buffer.WriteString(fmt.Sprintf("Bytes Read: %d \n",bytesRead))
     buffer.WriteString(fmt.Sprintf("Bytes Written: %d \n",bytesWrote))
+    buffer.WriteString(fmt.Sprintf("Dropped Messages: %d \n",dropped))
+    buffer.WriteString(fmt.Sprintf("Oversized Frames: %d \n",oversized))
+    buffer.WriteString(fmt.Sprintf("Authentication Failures: %d \n",authFailed))
+    buffer.WriteString(fmt.Sprintf("Sessions Resumed: %d \n",resumed))
+    buffer.WriteString(fmt.Sprintf("Stored Messages: %d \n",stored))
+    buffer.WriteString(fmt.Sprintf("Rate Limited: %d \n",limited))
+    buffer.WriteString(fmt.Sprintf("Denied by Access Policy: %d \n",denied))
     
     //avoid division by 0
     if timeInSeconds > 0 {
@@ -36,6 +36,7 @@ func TestBucket(t *testing.T){
 	b1.OutgoingMessages.Set(5)
 	b1.ByteRead.Set(6)
 	b1.ByteWritten.Set(7)
+	b1.DroppedMessages.Set(8)
 
 	b2.TimeAlive.Set(7)
 	b2.ClientsConnected.Set(6)
@@ -44,6 +45,7 @@ func TestBucket(t *testing.T){
 	b2.OutgoingMessages.Set(3)
 	b2.ByteRead.Set(2)
 	b2.ByteWritten.Set(1)
+	b2.DroppedMessages.Set(0)
 
 	b1.Merge(&b2)
 	assert.Equal(uint64(1), b1.TimeAlive.Get(), "TimeAlive is not affacted by merge")
@@ -53,13 +55,15 @@ func TestBucket(t *testing.T){
 	assert.Equal(uint64(8), b1.OutgoingMessages.Get(), "Merge")
 	assert.Equal(uint64(8), b1.ByteRead.Get(), "Merge")
 	assert.Equal(uint64(8), b1.ByteWritten.Get(), "Merge")
+	assert.Equal(uint64(8), b1.DroppedMessages.Get(), "Merge")
 }
 
 func TestBucketSerialize(t *testing.T){
 	assert := assert.New(t)
 
 	arr := b1.ToByteArray()
-	b2.FromByteArray(arr)
+	assert.Nil(b2.FromByteArray(arr), "Serialized bucket should be decoded")
+	assert.NotNil(b2.FromByteArray(arr[:8]), "Truncated bucket should give error")
 
 	assert.Equal(b1.TimeAlive.Get(), b2.TimeAlive.Get(), "Element should be the same")
 	assert.Equal(b1.ClientsConnected.Get(), b2.ClientsConnected.Get(), "Element should be the same")
@@ -68,7 +72,12 @@ func TestBucketSerialize(t *testing.T){
 	assert.Equal(b1.OutgoingMessages.Get(), b2.OutgoingMessages.Get(), "Element should be the same")
 	assert.Equal(b1.ByteRead.Get(), b2.ByteRead.Get(), "Element should be the same")
 	assert.Equal(b1.ByteWritten.Get(), b2.ByteWritten.Get(), "Element should be the same")
+	assert.Equal(b1.DroppedMessages.Get(), b2.DroppedMessages.Get(), "Element should be the same")
 
+	var legacy statbucket.StatBucket
+	assert.Nil(legacy.FromByteArray(arr[:statbucket.LEGACY_FIELDS*8]), "Buckets without the newer fields should be decoded")
+	assert.Equal(b1.ByteWritten.Get(), legacy.ByteWritten.Get(), "Element should be the same")
+	assert.Equal(uint64(0), legacy.DroppedMessages.Get(), "Missing fields should be 0")
 }
 
 func TestString(t *testing.T){
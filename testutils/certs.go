@@ -0,0 +1,111 @@
+package testutils
+
+import(
+	"time"
+	"math/big"
+	"crypto/tls"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"net"
+)
+
+/* Certificates generated on the fly for TLS tests: a CA, a server certificate
+ * valid for localhost and a client certificate, both signed by the CA
+ */
+type TestPKI struct {
+	Pool 	*x509.CertPool
+	Server 	tls.Certificate
+	Client 	tls.Certificate
+}
+
+func NewTestPKI(clientName string) (*TestPKI, error) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber: 			big.NewInt(1),
+		Subject: 				pkix.Name{CommonName: "test-ca"},
+		NotBefore: 				time.Now().Add(-time.Hour),
+		NotAfter: 				time.Now().Add(time.Hour),
+		IsCA: 					true,
+		KeyUsage: 				x509.KeyUsageCertSign,
+		BasicConstraintsValid: 	true,
+	}
+
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := signCertificate(ca, caKey, 2, &x509.Certificate{
+		Subject: 		pkix.Name{CommonName: "localhost"},
+		DNSNames: 		[]string{"localhost"},
+		IPAddresses: 	[]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		ExtKeyUsage: 	[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := signCertificate(ca, caKey, 3, &x509.Certificate{
+		Subject: 		pkix.Name{CommonName: clientName},
+		ExtKeyUsage: 	[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return &TestPKI{pool, server, client}, nil
+}
+
+//config for a hub that requires client certificates signed by the CA
+func (pki *TestPKI) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: 	[]tls.Certificate{pki.Server},
+		ClientCAs: 		pki.Pool,
+		ClientAuth: 	tls.RequireAndVerifyClientCert,
+	}
+}
+
+//config for a client presenting its certificate
+func (pki *TestPKI) ClientConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: 	[]tls.Certificate{pki.Client},
+		RootCAs: 		pki.Pool,
+		ServerName: 	"localhost",
+	}
+}
+
+func signCertificate(ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64, template *x509.Certificate) (tls.Certificate, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template.SerialNumber 	= big.NewInt(serial)
+	template.NotBefore 		= ca.NotBefore
+	template.NotAfter 		= ca.NotAfter
+	template.KeyUsage 		= x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -7,6 +7,7 @@ import(
 	"log"
 	"fmt"
 	"bytes"
+	"sync"
 	"strconv"
 	"crypto/rand"
 	"gopkg.in/fatih/set.v0"
@@ -35,9 +36,20 @@ type MockServer struct{
 	quitDone 	chan bool
 	Clichan 	chan uint64
 
+	//written by the accepting goroutine, read by the tests and the connections
 	sockets 	map[uint64]*mexsocket.MexSocket
+	socketLock 	sync.RWMutex
+
+	//automatic answers to requests, by request type
+	handlers 	map[byte]Handler
+	handlerLock sync.RWMutex
 }
 
+/* Builds the answer of the mock server to a request. The correlation id
+ * of the request is copied into the answer
+ */
+type Handler func(id uint64, req *message.Request) *message.Answer
+
 func NewServer() *MockServer{
 	return &MockServer{
 		nextId: 	1,
@@ -45,6 +57,7 @@ func NewServer() *MockServer{
 		quit: 		make(chan bool),
 		quitDone: 	make(chan bool),
 		sockets: 	make(map[uint64]*mexsocket.MexSocket),
+		handlers: 	make(map[byte]Handler),
 	}
 }
 
@@ -109,6 +122,26 @@ func CompareRequests(m1, m2 *message.Request) error {
 		return fmt.Errorf("Type mismatch. Expect %d, got %d", m1.MexType, m2.MexType)
 	}
 
+	if m1.Corr != m2.Corr {
+		return fmt.Errorf("Correlation id mismatch. Expect %d, got %d", m1.Corr, m2.Corr)
+	}
+
+	if m1.Ack != m2.Ack {
+		return fmt.Errorf("Ack mismatch. Expect %t, got %t", m1.Ack, m2.Ack)
+	}
+
+	if m1.Topic != m2.Topic {
+		return fmt.Errorf("Topic mismatch. Expect %s, got %s", m1.Topic, m2.Topic)
+	}
+
+	if m1.Stream != m2.Stream || m1.Flags != m2.Flags {
+		return fmt.Errorf("Stream mismatch. Expect %d/%d, got %d/%d", m1.Stream, m1.Flags, m2.Stream, m2.Flags)
+	}
+
+	if m1.Exclude != m2.Exclude {
+		return fmt.Errorf("Exclude mismatch. Expect %t, got %t", m1.Exclude, m2.Exclude)
+	}
+
 	if err := CompareList(m1.Receivers, m2.Receivers); err != nil {
 		return err
 	}
@@ -240,26 +273,51 @@ func (server *MockServer) Run(port int, autoReadRoutine bool) {
 					fmt.Println(err)
 					continue
 				}
-				s := mexsocket.New(server.nextId, conn)
-				server.sockets[server.nextId] = s
+				server.socketLock.Lock()
+				id := server.nextId
+				s := mexsocket.New(id, conn)
+				server.sockets[id] = s
+				server.nextId++
+				server.socketLock.Unlock()
 				
 				//notify that a new client connected
-				server.Clichan <- server.nextId
+				server.Clichan <- id
 
 				if(autoReadRoutine){
-					go server.newConnection(server.nextId, s)
+					go server.newConnection(id, s)
 				}
-
-				server.nextId++
 			}
 		}
 	}()
 }
 
+//answer automatically to requests of the given type. A nil handler removes it
+func (server *MockServer) Handle(mexType byte, h Handler) {
+	server.handlerLock.Lock()
+	defer server.handlerLock.Unlock()
+
+	if h == nil {
+		delete(server.handlers, mexType)
+	} else {
+		server.handlers[mexType] = h
+	}
+}
+
 func (server *MockServer) NextId() uint64 {
+	server.socketLock.RLock()
+	defer server.socketLock.RUnlock()
+
 	return server.nextId
 }
 
+func (server *MockServer) socket(id uint64) (*mexsocket.MexSocket, bool) {
+	server.socketLock.RLock()
+	defer server.socketLock.RUnlock()
+
+	s, ok := server.sockets[id]
+	return s, ok
+}
+
 func (server *MockServer) Stop() {
 	close(server.quit)
 	server.listener.Close()
@@ -267,25 +325,25 @@ func (server *MockServer) Stop() {
 }
 
 func (server *MockServer) WriteTo(id uint64, mex message.Message) (int, error){
-	s,ok := server.sockets[id]
+	s,ok := server.socket(id)
 	if ok{
 		return s.Send(mex)
 	} else {
-		log.Fatalln("MocServer id ",id," not present (length:",len(server.sockets))
+		log.Fatalln("MocServer id ",id," not present")
 		return 0, nil
 	}
 }
 
 
 func (server *MockServer) ReadAnswerFrom(id uint64) *message.Answer {
-	s := server.sockets[id]
+	s, _ := server.socket(id)
 	ans := new(message.Answer)
 	s.Read(ans)
 	return ans
 }
 
 func (server *MockServer) ReadRequestFrom(id uint64) *message.Request {
-	s := server.sockets[id]
+	s, _ := server.socket(id)
 	req := new(message.Request)
 	s.Read(req)
 	return req
@@ -304,7 +362,33 @@ func (server *MockServer) newConnection(id uint64, s *mexsocket.MexSocket){
 		}
 		
 		if(req.MexType == message.Identity){
-			server.WriteTo(id, message.NewAnswerIdentity(id))
+			ans := message.NewAnswerIdentity(id)
+			ans.Corr = req.Corr
+			server.WriteTo(id, ans)
+			continue
+		}
+
+		server.handlerLock.RLock()
+		h, ok := server.handlers[req.MexType]
+		server.handlerLock.RUnlock()
+
+		if ok {
+			if ans := h(id, req); ans != nil {
+				ans.Corr = req.Corr
+				server.WriteTo(id, ans)
+			}
+			continue
+		}
+
+		//agree to everything the client asks, unless a handler is set for Hello
+		if(req.MexType == message.Hello){
+			min, max := req.Versions()
+			protocol, err := message.NegotiateProtocol(min, max, req.Features(), req.Features())
+			if err == nil {
+				s.SetReadProtocol(protocol)
+				server.WriteTo(id, message.NewAnswerHello(protocol))
+				s.SetProtocol(protocol)
+			}
 		}
 	}
 }
\ No newline at end of file
@@ -0,0 +1,82 @@
+package topic
+
+import(
+	"errors"
+	"strings"
+)
+
+/* Topics are hierarchical, with levels separated by SEPARATOR. Filters used to
+ * subscribe can contain wildcards:
+ * SINGLE_LEVEL matches exactly one level, "sensors/+/temp" matches "sensors/kitchen/temp".
+ * MULTI_LEVEL matches any number of levels, even none, and must be the last one:
+ * "logs/#" matches "logs", "logs/hub" and "logs/hub/errors"
+ */
+const(
+	SEPARATOR 		= "/"
+	SINGLE_LEVEL 	= "+"
+	MULTI_LEVEL 	= "#"
+)
+
+var(
+	ErrEmpty 		= errors.New("Topic is empty")
+	ErrWildcard 	= errors.New("Wildcards must be alone in their level, and # must be the last level")
+	ErrWildcardName = errors.New("Wildcards are allowed only in filters")
+)
+
+//check that a subscription filter is well formed
+func ValidateFilter(filter string) error {
+
+	if filter == "" {
+		return ErrEmpty
+	}
+
+	levels := strings.Split(filter, SEPARATOR)
+	for i, level := range levels {
+
+		if level == SINGLE_LEVEL || (level == MULTI_LEVEL && i == len(levels)-1) {
+			continue
+		}
+
+		if strings.Contains(level, SINGLE_LEVEL) || strings.Contains(level, MULTI_LEVEL) {
+			return ErrWildcard
+		}
+	}
+	return nil
+}
+
+//check that a topic can be published, it can't contain wildcards
+func ValidateName(name string) error {
+
+	if name == "" {
+		return ErrEmpty
+	}
+
+	if strings.Contains(name, SINGLE_LEVEL) || strings.Contains(name, MULTI_LEVEL) {
+		return ErrWildcardName
+	}
+	return nil
+}
+
+//true if the topic name is matched by the filter. Both must be valid
+func Match(filter, name string) bool {
+
+	filterLevels := strings.Split(filter, SEPARATOR)
+	nameLevels 	 := strings.Split(name, SEPARATOR)
+
+	for i, level := range filterLevels {
+
+		if level == MULTI_LEVEL {
+			return true
+		}
+
+		if i >= len(nameLevels) {
+			return false
+		}
+
+		if level != SINGLE_LEVEL && level != nameLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(nameLevels)
+}
@@ -0,0 +1,150 @@
+package topic_test
+
+import(
+	"sort"
+	"strconv"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/sech90/go-message-hub/topic"
+)
+
+//filter, name, expected match
+var matchCases = []struct{
+	filter 	string
+	name 	string
+	match 	bool
+}{
+	{"sensors/kitchen/temp", "sensors/kitchen/temp", true},
+	{"sensors/kitchen/temp", "sensors/kitchen", false},
+	{"sensors/+/temp", "sensors/kitchen/temp", true},
+	{"sensors/+/temp", "sensors/kitchen/humidity", false},
+	{"sensors/+/temp", "sensors/temp", false},
+	{"sensors/+", "sensors/kitchen/temp", false},
+	{"+/+", "a/b", true},
+	{"+", "a", true},
+	{"logs/#", "logs", true},
+	{"logs/#", "logs/hub", true},
+	{"logs/#", "logs/hub/errors", true},
+	{"logs/#", "log", false},
+	{"#", "anything/at/all", true},
+	{"+/hub/#", "logs/hub/errors", true},
+	{"+/hub/#", "logs/client/errors", false},
+}
+
+const benchSubscriptions = 50000
+
+var benchTrie = buildTrie(benchSubscriptions)
+
+//a mix of exact filters and filters with wildcards, like a busy hub would have
+func benchFilter(i int) string {
+
+	building := strconv.Itoa(i % 101)
+	room 	 := strconv.Itoa(i)
+
+	switch i % 4 {
+	case 0, 1:
+		return "sensors/"+building+"/"+room+"/temp"
+	case 2:
+		return "sensors/"+building+"/+/temp"
+	}
+	return "sensors/"+building+"/"+room+"/#"
+}
+
+func buildTrie(n int) *topic.Trie {
+
+	trie := topic.NewTrie()
+	for i := 0; i < n; i++ {
+		trie.Add(benchFilter(i), uint64(i))
+	}
+	return trie
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		topic.Match("sensors/+/temp/#", "sensors/kitchen/temp/celsius")
+	}
+}
+
+func BenchmarkTrieMatch(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		benchTrie.Match("sensors/42/4242/temp")
+	}
+}
+
+func BenchmarkTrieMatchMiss(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		benchTrie.Match("actuators/42/4242/valve")
+	}
+}
+
+func BenchmarkTrieAddRemove(b *testing.B) {
+	trie := buildTrie(benchSubscriptions)
+	for n := 0; n < b.N; n++ {
+		trie.Add("sensors/42/+/humidity", 1)
+		trie.Remove("sensors/42/+/humidity", 1)
+	}
+}
+
+func TestValidate(t *testing.T){
+	assert := assert.New(t)
+
+	assert.Nil(topic.ValidateFilter("sensors/+/temp"), "Single level wildcard is valid")
+	assert.Nil(topic.ValidateFilter("logs/#"), "Multi level wildcard is valid at the end")
+	assert.Nil(topic.ValidateFilter("#"), "Multi level wildcard alone is valid")
+	assert.Equal(topic.ErrEmpty, topic.ValidateFilter(""), "Empty filter")
+	assert.Equal(topic.ErrWildcard, topic.ValidateFilter("logs/#/hub"), "Multi level wildcard must be the last")
+	assert.Equal(topic.ErrWildcard, topic.ValidateFilter("sensors/kit+/temp"), "Wildcard must be alone in the level")
+
+	assert.Nil(topic.ValidateName("sensors/kitchen/temp"), "Plain name is valid")
+	assert.Equal(topic.ErrWildcardName, topic.ValidateName("sensors/+"), "Names can't have wildcards")
+	assert.Equal(topic.ErrEmpty, topic.ValidateName(""), "Empty name")
+}
+
+func TestMatch(t *testing.T){
+	for _, c := range matchCases {
+		assert.Equal(t, c.match, topic.Match(c.filter, c.name), c.filter+" on "+c.name)
+	}
+}
+
+func TestTrie(t *testing.T){
+	assert := assert.New(t)
+
+	//the trie must agree with Match on every case
+	for _, c := range matchCases {
+		trie := topic.NewTrie()
+		trie.Add(c.filter, 1)
+
+		ids := trie.Match(c.name)
+		assert.Equal(c.match, len(ids) == 1, c.filter+" on "+c.name)
+	}
+
+	trie := topic.NewTrie()
+	trie.Add("sensors/+/temp", 1)
+	trie.Add("sensors/kitchen/temp", 2)
+	trie.Add("sensors/#", 3)
+	trie.Add("sensors/#", 1)
+	trie.Add("sensors/#", 1)
+	assert.Equal(4, trie.Len(), "Duplicated subscriptions should be counted once")
+
+	ids := trie.Match("sensors/kitchen/temp")
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	assert.Equal([]uint64{1, 2, 3}, ids, "Every id should be matched once")
+
+	trie.Remove("sensors/#", 3)
+	trie.Remove("sensors/#", 1)
+	trie.Remove("not/subscribed", 1)
+	assert.Equal(2, trie.Len(), "Removed subscriptions should not be counted")
+	assert.Len(trie.Match("sensors/kitchen/humidity"), 0, "Removed subscriptions should not match")
+	assert.Len(trie.Match("sensors/kitchen/temp"), 2, "Other subscriptions should still match")
+
+	//the trie must agree with Match on many subscriptions
+	for _, name := range []string{"sensors/42/4242/temp", "sensors/42/4242/temp/celsius", "sensors/7/1/temp"} {
+		var expected int
+		for i := 0; i < benchSubscriptions; i++ {
+			if topic.Match(benchFilter(i), name) {
+				expected++
+			}
+		}
+		assert.Len(benchTrie.Match(name), expected, "Every matching subscription should be found on "+name)
+	}
+}
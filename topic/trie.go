@@ -0,0 +1,135 @@
+package topic
+
+import(
+	"strings"
+)
+
+/* Index of the subscriptions, by filter. Matching a topic name costs in the number
+ * of its levels and of the wildcards met, not in the number of subscriptions.
+ * Not thread safe
+ */
+type Trie struct {
+	root 	*node
+	size 	int
+}
+
+//one level of a filter
+type node struct {
+	children 	map[string]*node
+
+	//ids subscribed to the filter ending at this level
+	subs 		map[uint64]bool
+}
+
+func NewTrie() *Trie {
+	return &Trie{root: newNode()}
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node)}
+}
+
+//number of subscriptions
+func (t *Trie) Len() int {
+	return t.size
+}
+
+//subscribe the id to the filter, which must be valid
+func (t *Trie) Add(filter string, id uint64) {
+
+	n := t.root
+	for _, level := range strings.Split(filter, SEPARATOR) {
+
+		child, ok := n.children[level]
+		if !ok {
+			child = newNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+
+	if n.subs == nil {
+		n.subs = make(map[uint64]bool)
+	}
+
+	if !n.subs[id] {
+		n.subs[id] = true
+		t.size++
+	}
+}
+
+//unsubscribe the id from the filter, pruning the levels left empty
+func (t *Trie) Remove(filter string, id uint64) {
+
+	levels := strings.Split(filter, SEPARATOR)
+	path := make([]*node, 0, len(levels)+1)
+
+	n := t.root
+	path = append(path, n)
+	for _, level := range levels {
+
+		child, ok := n.children[level]
+		if !ok {
+			return
+		}
+		n = child
+		path = append(path, n)
+	}
+
+	if !n.subs[id] {
+		return
+	}
+
+	delete(n.subs, id)
+	t.size--
+
+	//walk back up while the nodes are useless
+	for i := len(levels); i > 0; i-- {
+
+		n = path[i]
+		if len(n.subs) > 0 || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+}
+
+//ids subscribed to at least one filter matching the topic name, without duplicates
+func (t *Trie) Match(name string) []uint64 {
+
+	found := make(map[uint64]bool)
+	t.root.match(strings.Split(name, SEPARATOR), found)
+
+	out := make([]uint64, 0, len(found))
+	for id := range found {
+		out = append(out, id)
+	}
+	return out
+}
+
+func (n *node) match(levels []string, found map[uint64]bool) {
+
+	//matches the rest of the name, even if nothing is left
+	if multi, ok := n.children[MULTI_LEVEL]; ok {
+		multi.collect(found)
+	}
+
+	if len(levels) == 0 {
+		n.collect(found)
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], found)
+	}
+
+	if single, ok := n.children[SINGLE_LEVEL]; ok {
+		single.match(levels[1:], found)
+	}
+}
+
+func (n *node) collect(found map[uint64]bool) {
+	for id := range n.subs {
+		found[id] = true
+	}
+}